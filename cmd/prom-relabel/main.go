@@ -1,52 +1,104 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"flag"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
 	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/logging"
 	"github.com/zwo-bot/prom-relabel-proxy/internal/proxy"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/tlsutil"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/tracing"
 )
 
 func main() {
 	// Parse command line flags
 	configPath := flag.String("config", "configs/config.yaml", "Path to configuration file")
 	listenAddr := flag.String("listen", ":8080", "Address to listen on")
-	debugMode := flag.Bool("debug", false, "Enable debug logging")
+	debugMode := flag.Bool("debug", false, "Enable debug logging (shorthand for --log-level=debug)")
+	logLevel := flag.String("log-level", "info", "Log level (debug, info, warn, error)")
+	logFormat := flag.String("log-format", "text", "Log format (text, json)")
+	metricsPath := flag.String("metrics-path", "/-/proxy/metrics", "Path serving the proxy's own metrics, empty to disable")
 	flag.Parse()
 
+	if *debugMode {
+		*logLevel = "debug"
+	}
+
+	// Set up structured logging
+	logger, err := logging.New(os.Stderr, logging.Format(*logFormat), *logLevel)
+	if err != nil {
+		slog.Error("Failed to set up logging", slog.Any("error", err))
+		os.Exit(1)
+	}
+	slog.SetDefault(logger)
+
 	// Load configuration
 	cfg, err := config.LoadFromFile(*configPath)
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		logger.Error("Failed to load configuration", slog.Any("error", err))
+		os.Exit(1)
+	}
+
+	// Set up tracing
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.GetTracing())
+	if err != nil {
+		logger.Error("Failed to set up tracing", slog.Any("error", err))
+		os.Exit(1)
 	}
 
 	// Create proxy
-	proxy, err := proxy.New(cfg, *debugMode)
+	proxy, err := proxy.New(cfg, logger)
 	if err != nil {
-		log.Fatalf("Failed to create proxy: %v", err)
+		logger.Error("Failed to create proxy", slog.Any("error", err))
+		os.Exit(1)
 	}
-	
-	if *debugMode {
-		log.Printf("Debug logging enabled")
+
+	logger.Debug("Debug logging enabled")
+
+	// Export metrics about the proxy and its upstreams
+	prometheus.MustRegister(proxy)
+
+	// Set up TLS if configured
+	serverCfg := cfg.GetServer()
+	var tlsConfig *tls.Config
+	if serverCfg.TLS.Enabled() {
+		tlsConfig, err = tlsutil.NewServerConfig(serverCfg.TLS)
+		if err != nil {
+			logger.Error("Failed to set up TLS", slog.Any("error", err))
+			os.Exit(1)
+		}
 	}
 
-	// Set up HTTP server
-	server := &http.Server{
-		Addr:    *listenAddr,
-		Handler: proxy,
+	// Start the main listener and any additional listeners with their
+	// mapping profiles
+	for _, u := range cfg.GetUpstreams() {
+		logger.Info("Forwarding requests to upstream", slog.String("upstream", u.Name), slog.String("url", u.URL))
+	}
+	logger.Info("Starting Prometheus label rewriting proxy", slog.Bool("tls", tlsConfig != nil))
+	serve(logger, *listenAddr, "", withMetrics(proxy, *metricsPath), tlsConfig)
+	for _, listener := range serverCfg.Listeners {
+		serve(logger, listener.Address, listener.Profile, withMetrics(proxy.ListenerHandler(listener), *metricsPath), tlsConfig)
 	}
 
-	// Start server in a goroutine
+	// Reopen the access log on SIGUSR1 so it can be rotated
+	reopen := make(chan os.Signal, 1)
+	notifyReopen(reopen)
 	go func() {
-		log.Printf("Starting Prometheus label rewriting proxy on %s", *listenAddr)
-		log.Printf("Forwarding requests to %s", cfg.GetTargetPrometheus())
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start server: %v", err)
+		for range reopen {
+			logger.Info("Reopening access log")
+			if err := proxy.ReopenAccessLog(); err != nil {
+				logger.Error("Failed to reopen access log", slog.Any("error", err))
+			}
 		}
 	}()
 
@@ -56,5 +108,51 @@ func main() {
 
 	// Wait for interrupt signal
 	<-stop
-	log.Println("Shutting down server...")
+	logger.Info("Shutting down server...")
+	proxy.Close()
+	if err := shutdownTracing(context.Background()); err != nil {
+		logger.Error("Failed to flush traces", slog.Any("error", err))
+	}
+}
+
+// withMetrics serves the proxy's metrics on metricsPath and passes all other
+// requests to handler
+func withMetrics(handler http.Handler, metricsPath string) http.Handler {
+	if metricsPath == "" {
+		return handler
+	}
+
+	metricsHandler := promhttp.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == metricsPath {
+			metricsHandler.ServeHTTP(w, r)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// serve starts an HTTP server for the handler in a goroutine
+func serve(logger *slog.Logger, addr, profile string, handler http.Handler, tlsConfig *tls.Config) {
+	server := &http.Server{
+		Addr:      addr,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+		ErrorLog:  slog.NewLogLogger(logger.Handler(), slog.LevelError),
+	}
+
+	go func() {
+		logger.Info("Listening", slog.String("listen", addr), slog.String("profile", profile))
+		var err error
+		if tlsConfig != nil {
+			// Certificates are served by the TLS config so they can be reloaded
+			err = server.ListenAndServeTLS("", "")
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logger.Error("Failed to start server", slog.String("listen", addr), slog.Any("error", err))
+			os.Exit(1)
+		}
+	}()
 }
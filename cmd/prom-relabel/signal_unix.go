@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReopen relays SIGUSR1, used to reopen log files after rotation
+func notifyReopen(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
@@ -0,0 +1,10 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+)
+
+// notifyReopen is a no-op on Windows, which has no SIGUSR1
+func notifyReopen(c chan<- os.Signal) {}
@@ -0,0 +1,245 @@
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+// commonLogTime is the timestamp layout used by the common and combined formats
+const commonLogTime = "02/Jan/2006:15:04:05 -0700"
+
+// Entry describes a single proxied request
+type Entry struct {
+	Time             time.Time
+	RequestID        string
+	Method           string
+	Path             string
+	RawQuery         string
+	Proto            string
+	ClientIP         string
+	User             string
+	Status           int
+	Bytes            int64
+	Duration         time.Duration
+	Referer          string
+	UserAgent        string
+	Profile          string
+	Upstream         string
+	OriginalQueries  []string
+	RewrittenQueries []string
+}
+
+// Logger writes access log entries in a configurable format
+type Logger struct {
+	format     config.AccessLogFormat
+	path       string
+	sampleRate float64
+
+	// random returns a number in [0, 1) to sample entries with
+	random func() float64
+
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File
+}
+
+// New creates an access logger from the given configuration. Entries are
+// written to the configured file, or to stdout if no file is set.
+func New(cfg config.AccessLog) (*Logger, error) {
+	l := &Logger{
+		format:     cfg.Format,
+		path:       cfg.File,
+		sampleRate: 1,
+		random:     rand.Float64,
+		w:          os.Stdout,
+	}
+	if l.format == "" {
+		l.format = config.AccessLogFormatCommon
+	}
+	if cfg.SampleRate != nil {
+		l.sampleRate = *cfg.SampleRate
+	}
+
+	if err := l.Reopen(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Reopen closes and reopens the log file, so that it can be rotated by an
+// external tool. It is a no-op when logging to stdout.
+func (l *Logger) Reopen() error {
+	if l.path == "" {
+		return nil
+	}
+
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log file: %w", err)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+	l.w = file
+	return nil
+}
+
+// Close closes the log file
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	l.w = io.Discard
+	return err
+}
+
+// Log writes the entry if it is selected by sampling. Failed requests
+// (status >= 400) are always logged.
+func (l *Logger) Log(e Entry) {
+	if e.Status < 400 && l.sampleRate < 1 && l.random() >= l.sampleRate {
+		return
+	}
+
+	var line []byte
+	switch l.format {
+	case config.AccessLogFormatJSON:
+		line = formatJSON(e)
+	case config.AccessLogFormatCombined:
+		line = formatCommon(e, true)
+	default:
+		line = formatCommon(e, false)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line)
+}
+
+// formatCommon formats the entry in the Common or Combined Log Format
+func formatCommon(e Entry, combined bool) []byte {
+	var b strings.Builder
+
+	b.WriteString(dash(e.ClientIP))
+	b.WriteString(" - ")
+	// The user may come from a header or certificate, so it must not
+	// contain spaces that separate fields
+	b.WriteString(dash(escape(e.User, true)))
+	b.WriteString(" [")
+	b.WriteString(e.Time.Format(commonLogTime))
+	b.WriteString("] \"")
+	b.WriteString(escape(e.Method, false))
+	b.WriteByte(' ')
+	b.WriteString(escape(e.Path, false))
+	if e.RawQuery != "" {
+		b.WriteByte('?')
+		b.WriteString(escape(e.RawQuery, false))
+	}
+	b.WriteByte(' ')
+	b.WriteString(escape(e.Proto, false))
+	b.WriteString("\" ")
+	b.WriteString(strconv.Itoa(e.Status))
+	b.WriteByte(' ')
+	if e.Bytes > 0 {
+		b.WriteString(strconv.FormatInt(e.Bytes, 10))
+	} else {
+		b.WriteByte('-')
+	}
+
+	if combined {
+		b.WriteString(" ")
+		b.WriteString(strconv.Quote(e.Referer))
+		b.WriteString(" ")
+		b.WriteString(strconv.Quote(e.UserAgent))
+	}
+
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+// formatJSON formats the entry as a single JSON object
+func formatJSON(e Entry) []byte {
+	data, _ := json.Marshal(struct {
+		Time             string   `json:"time"`
+		RequestID        string   `json:"request_id,omitempty"`
+		Method           string   `json:"method"`
+		Path             string   `json:"path"`
+		RawQuery         string   `json:"raw_query,omitempty"`
+		Proto            string   `json:"proto"`
+		ClientIP         string   `json:"client_ip"`
+		User             string   `json:"user,omitempty"`
+		Status           int      `json:"status"`
+		Bytes            int64    `json:"bytes"`
+		DurationSeconds  float64  `json:"duration_seconds"`
+		Referer          string   `json:"referer,omitempty"`
+		UserAgent        string   `json:"user_agent,omitempty"`
+		Profile          string   `json:"profile,omitempty"`
+		Upstream         string   `json:"upstream,omitempty"`
+		OriginalQueries  []string `json:"original_query,omitempty"`
+		RewrittenQueries []string `json:"rewritten_query,omitempty"`
+	}{
+		Time:             e.Time.Format(time.RFC3339Nano),
+		RequestID:        e.RequestID,
+		Method:           e.Method,
+		Path:             e.Path,
+		RawQuery:         e.RawQuery,
+		Proto:            e.Proto,
+		ClientIP:         e.ClientIP,
+		User:             e.User,
+		Status:           e.Status,
+		Bytes:            e.Bytes,
+		DurationSeconds:  e.Duration.Seconds(),
+		Referer:          e.Referer,
+		UserAgent:        e.UserAgent,
+		Profile:          e.Profile,
+		Upstream:         e.Upstream,
+		OriginalQueries:  e.OriginalQueries,
+		RewrittenQueries: e.RewrittenQueries,
+	})
+	return append(data, '\n')
+}
+
+// escape escapes quotes, backslashes and non-printable characters in a field
+// of the common log format as Apache does, and spaces if space is set
+func escape(s string, space bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f || (space && c == ' '):
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// dash returns "-" for empty fields, as required by the common log format
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,138 @@
+package accesslog
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+// newTestLogger returns a logger writing to a buffer
+func newTestLogger(t *testing.T, cfg config.AccessLog) (*Logger, *bytes.Buffer) {
+	t.Helper()
+	l, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	l.w = &buf
+	return l, &buf
+}
+
+var testEntry = Entry{
+	Time:             time.Date(2024, 6, 10, 13, 55, 36, 0, time.UTC),
+	RequestID:        "abc",
+	Method:           "GET",
+	Path:             "/api/v1/query",
+	RawQuery:         "query=up",
+	Proto:            "HTTP/1.1",
+	ClientIP:         "10.0.0.1",
+	User:             "alice",
+	Status:           200,
+	Bytes:            123,
+	Duration:         1500 * time.Millisecond,
+	Referer:          "http://grafana/d/1",
+	UserAgent:        "Grafana/11.0",
+	Profile:          "team-a",
+	Upstream:         "default",
+	OriginalQueries:  []string{"up"},
+	RewrittenQueries: []string{"up"},
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		format config.AccessLogFormat
+		want   string
+	}{
+		{
+			format: config.AccessLogFormatCommon,
+			want:   `10.0.0.1 - alice [10/Jun/2024:13:55:36 +0000] "GET /api/v1/query?query=up HTTP/1.1" 200 123` + "\n",
+		},
+		{
+			format: config.AccessLogFormatCombined,
+			want:   `10.0.0.1 - alice [10/Jun/2024:13:55:36 +0000] "GET /api/v1/query?query=up HTTP/1.1" 200 123 "http://grafana/d/1" "Grafana/11.0"` + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		l, buf := newTestLogger(t, config.AccessLog{Format: tt.format})
+		l.Log(testEntry)
+		if got := buf.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.format, got, tt.want)
+		}
+	}
+
+	l, buf := newTestLogger(t, config.AccessLog{Format: config.AccessLogFormatJSON})
+	l.Log(testEntry)
+	var got map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON %q: %v", buf.String(), err)
+	}
+	for key, want := range map[string]interface{}{
+		"time":             "2024-06-10T13:55:36Z",
+		"user":             "alice",
+		"status":           200.0,
+		"duration_seconds": 1.5,
+		"profile":          "team-a",
+	} {
+		if got[key] != want {
+			t.Errorf("json %s = %v, want %v", key, got[key], want)
+		}
+	}
+}
+
+func TestEscape(t *testing.T) {
+	e := testEntry
+	e.User = `CN=alice smith,O="ACME"`
+	e.Path = `/api/v1/"query"`
+	e.RawQuery = ""
+	e.Bytes = 0
+
+	l, buf := newTestLogger(t, config.AccessLog{})
+	l.Log(e)
+	want := `10.0.0.1 - CN=alice\x20smith,O=\"ACME\" [10/Jun/2024:13:55:36 +0000] "GET /api/v1/\"query\" HTTP/1.1" 200 -` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The fields of the line are still separated by single spaces
+	if fields := strings.Fields(strings.SplitN(buf.String(), "[", 2)[0]); len(fields) != 3 {
+		t.Errorf("expected 3 fields before the time, got %q", fields)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	rate := func(r float64) *float64 { return &r }
+
+	tests := []struct {
+		name       string
+		sampleRate *float64
+		random     float64
+		status     int
+		want       bool
+	}{
+		{name: "default logs all", status: 200, random: 0.99, want: true},
+		{name: "zero logs no successes", sampleRate: rate(0), status: 200, random: 0, want: false},
+		{name: "zero logs errors", sampleRate: rate(0), status: 500, random: 0, want: true},
+		{name: "sampled in", sampleRate: rate(0.5), status: 200, random: 0.4, want: true},
+		{name: "sampled out", sampleRate: rate(0.5), status: 200, random: 0.6, want: false},
+		{name: "client errors are logged", sampleRate: rate(0.5), status: 404, random: 0.6, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, buf := newTestLogger(t, config.AccessLog{SampleRate: tt.sampleRate})
+			l.random = func() float64 { return tt.random }
+
+			e := testEntry
+			e.Status = tt.status
+			l.Log(e)
+			if got := buf.Len() > 0; got != tt.want {
+				t.Errorf("logged = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,109 @@
+// Package cache provides in-memory caches for proxied responses.
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// entryOverhead approximates the memory used by an entry besides its key
+// and value
+const entryOverhead = 64
+
+// LRU is a cache of byte values bounded by their total size. Entries
+// expire after their TTL and the least recently used entries are evicted
+// when the cache is full. It is safe for concurrent use.
+type LRU struct {
+	mu        sync.Mutex
+	maxSize   int64
+	size      int64
+	evictions uint64
+	ll        *list.List
+	items     map[string]*list.Element
+
+	// now returns the current time, replaced in tests
+	now func() time.Time
+}
+
+// entry is a cached value
+type entry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+// size returns the memory accounted for the entry
+func (e *entry) size() int64 {
+	return int64(len(e.key) + len(e.value) + entryOverhead)
+}
+
+// NewLRU creates a cache holding up to maxSize bytes
+func NewLRU(maxSize int64) *LRU {
+	return &LRU{
+		maxSize: maxSize,
+		ll:      list.New(),
+		items:   make(map[string]*list.Element),
+		now:     time.Now,
+	}
+}
+
+// Get returns the value cached for key, if any and not expired
+func (c *LRU) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*entry)
+	if !c.now().Before(e.expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.ll.MoveToFront(elem)
+	return e.value, true
+}
+
+// Set caches value for key until the TTL expires, evicting the least
+// recently used entries as needed. Values larger than the cache are not
+// cached. The value must not be modified afterwards.
+func (c *LRU) Set(key string, value []byte, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	e := &entry{key: key, value: value, expires: c.now().Add(ttl)}
+	if e.size() > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.remove(elem)
+	}
+	c.items[key] = c.ll.PushFront(e)
+	c.size += e.size()
+
+	for c.size > c.maxSize {
+		c.remove(c.ll.Back())
+		c.evictions++
+	}
+}
+
+// remove deletes an entry from the cache
+func (c *LRU) remove(elem *list.Element) {
+	e := c.ll.Remove(elem).(*entry)
+	delete(c.items, e.key)
+	c.size -= e.size()
+}
+
+// Stats returns the number of entries, their total size in bytes and the
+// number of entries evicted to make room for others
+func (c *LRU) Stats() (entries int, size int64, evictions uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len(), c.size, c.evictions
+}
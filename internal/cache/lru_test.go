@@ -0,0 +1,76 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLRU(t *testing.T) {
+	now := time.Unix(1718000000, 0)
+	c := NewLRU(3 * (entryOverhead + 2))
+	c.now = func() time.Time { return now }
+
+	c.Set("a", []byte("1"), time.Minute)
+	c.Set("b", []byte("2"), time.Minute)
+	c.Set("c", []byte("3"), time.Minute)
+
+	// Using a makes b the least recently used entry
+	if value, ok := c.Get("a"); !ok || string(value) != "1" {
+		t.Fatalf("Get(a) = %q, %v, want 1, true", value, ok)
+	}
+	c.Set("d", []byte("4"), time.Minute)
+	if _, ok := c.Get("b"); ok {
+		t.Errorf("expected b to be evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := c.Get(key); !ok {
+			t.Errorf("expected %s to be cached", key)
+		}
+	}
+
+	entries, size, evictions := c.Stats()
+	if entries != 3 || size != 3*(entryOverhead+2) || evictions != 1 {
+		t.Errorf("Stats() = %d, %d, %d, want 3, %d, 1", entries, size, evictions, 3*(entryOverhead+2))
+	}
+
+	// Replacing an entry updates its value and size
+	c.Set("a", []byte("5"), time.Minute)
+	if value, _ := c.Get("a"); string(value) != "5" {
+		t.Errorf("Get(a) = %q, want 5", value)
+	}
+	if entries, _, _ := c.Stats(); entries != 3 {
+		t.Errorf("expected 3 entries after replacing, got %d", entries)
+	}
+}
+
+func TestLRUExpiry(t *testing.T) {
+	now := time.Unix(1718000000, 0)
+	c := NewLRU(1 << 20)
+	c.now = func() time.Time { return now }
+
+	c.Set("short", []byte("1"), time.Second)
+	c.Set("long", []byte("2"), time.Hour)
+	c.Set("none", []byte("3"), 0)
+
+	now = now.Add(time.Minute)
+	if _, ok := c.Get("short"); ok {
+		t.Errorf("expected short to be expired")
+	}
+	if _, ok := c.Get("long"); !ok {
+		t.Errorf("expected long to be cached")
+	}
+	if _, ok := c.Get("none"); ok {
+		t.Errorf("expected entry without TTL not to be cached")
+	}
+	if entries, _, _ := c.Stats(); entries != 1 {
+		t.Errorf("expected expired entries to be removed, got %d entries", entries)
+	}
+}
+
+func TestLRUTooLarge(t *testing.T) {
+	c := NewLRU(entryOverhead + 10)
+	c.Set("key", make([]byte, 100), time.Minute)
+	if _, ok := c.Get("key"); ok {
+		t.Errorf("expected value larger than the cache not to be cached")
+	}
+}
@@ -0,0 +1,160 @@
+// Package codec provides the content encodings the proxy can decode
+// upstream response bodies from and encode client response bodies with.
+package codec
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Identity is the content encoding of bodies that are not compressed
+const Identity = "identity"
+
+// Codec compresses and decompresses bodies of one content encoding
+type Codec interface {
+	// Name returns the content encoding token, e.g. "gzip"
+	Name() string
+	// NewReader returns a reader decompressing r
+	NewReader(r io.Reader) (io.ReadCloser, error)
+	// NewWriter returns a writer compressing to w. Closing it flushes the
+	// compressed data but does not close w.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+var (
+	mu     sync.RWMutex
+	codecs []Codec
+)
+
+// Register adds a codec to the registry, replacing a codec of the same
+// name. Codecs registered earlier are preferred when negotiating with
+// clients that accept several encodings equally.
+func Register(c Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for i, existing := range codecs {
+		if existing.Name() == c.Name() {
+			codecs[i] = c
+			return
+		}
+	}
+	codecs = append(codecs, c)
+}
+
+// Lookup returns the codec for a Content-Encoding header value. The codec
+// is nil for the identity encoding; ok is false if the encoding is not
+// supported.
+func Lookup(contentEncoding string) (c Codec, ok bool) {
+	name := strings.ToLower(strings.TrimSpace(contentEncoding))
+	if name == "" || name == Identity {
+		return nil, true
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	for _, c := range codecs {
+		if c.Name() == name {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// AcceptEncoding returns an Accept-Encoding header value listing all
+// registered codecs in order of preference
+func AcceptEncoding() string {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	names := make([]string, len(codecs))
+	for i, c := range codecs {
+		names[i] = c.Name()
+	}
+	return strings.Join(names, ", ")
+}
+
+// Negotiate returns the codec to encode a response with for a request with
+// the given Accept-Encoding header value: the registered codec the client
+// gives the highest quality, unless it prefers the identity encoding. It
+// returns nil for the identity encoding.
+func Negotiate(acceptEncoding string) Codec {
+	accepted := parseAcceptEncoding(acceptEncoding)
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	var (
+		best     Codec
+		bestQ    float64
+		identity = accepted.quality(Identity)
+	)
+	if _, ok := accepted[Identity]; !ok {
+		// The identity encoding is always acceptable unless excluded
+		identity = 1
+		if q, ok := accepted["*"]; ok {
+			identity = q
+		}
+	}
+
+	for _, c := range codecs {
+		if q := accepted.quality(c.Name()); q > bestQ {
+			best, bestQ = c, q
+		}
+	}
+	if best == nil || bestQ < identity {
+		return nil
+	}
+	return best
+}
+
+// Acceptable reports whether a client sending the given Accept-Encoding
+// header value accepts a body with the given content encoding
+func Acceptable(acceptEncoding, contentEncoding string) bool {
+	name := strings.ToLower(strings.TrimSpace(contentEncoding))
+	if name == "" || name == Identity {
+		return true
+	}
+	return parseAcceptEncoding(acceptEncoding).quality(name) > 0
+}
+
+// acceptEncoding maps content encodings to their quality values
+type acceptEncoding map[string]float64
+
+// quality returns the quality value of an encoding, falling back to the
+// wildcard
+func (a acceptEncoding) quality(name string) float64 {
+	if q, ok := a[name]; ok {
+		return q
+	}
+	return a["*"]
+}
+
+// parseAcceptEncoding parses an Accept-Encoding header value such as
+// "gzip;q=1.0, br;q=0.5, *;q=0"
+func parseAcceptEncoding(header string) acceptEncoding {
+	accepted := make(acceptEncoding)
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, _ := strings.Cut(param, "=")
+			if strings.TrimSpace(strings.ToLower(key)) != "q" {
+				continue
+			}
+			if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				q = v
+			}
+		}
+		accepted[name] = q
+	}
+	return accepted
+}
@@ -0,0 +1,135 @@
+package codec
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+func TestRoundTrip(t *testing.T) {
+	body := bytes.Repeat([]byte(`{"metric":{"__name__":"up"},"values":[[1700000000.123,"1"]]}`), 1000)
+
+	for _, name := range []string{"gzip", "deflate", "zstd", "snappy"} {
+		t.Run(name, func(t *testing.T) {
+			c, ok := Lookup(name)
+			if !ok || c == nil {
+				t.Fatalf("Lookup(%q) = %v, %v", name, c, ok)
+			}
+
+			var compressed bytes.Buffer
+			w, err := c.NewWriter(&compressed)
+			if err != nil {
+				t.Fatalf("NewWriter() error = %v", err)
+			}
+			w.Write(body)
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			r, err := c.NewReader(&compressed)
+			if err != nil {
+				t.Fatalf("NewReader() error = %v", err)
+			}
+			decompressed, err := ioutil.ReadAll(r)
+			r.Close()
+			if err != nil {
+				t.Fatalf("ReadAll() error = %v", err)
+			}
+			if !bytes.Equal(decompressed, body) {
+				t.Errorf("round trip changed the body")
+			}
+		})
+	}
+}
+
+func TestReadAlternativeFormats(t *testing.T) {
+	body := []byte(`{"status":"success"}`)
+
+	var rawDeflate bytes.Buffer
+	fw, _ := flate.NewWriter(&rawDeflate, flate.DefaultCompression)
+	fw.Write(body)
+	fw.Close()
+
+	tests := []struct {
+		name       string
+		encoding   string
+		compressed []byte
+	}{
+		{name: "raw deflate", encoding: "deflate", compressed: rawDeflate.Bytes()},
+		{name: "snappy block", encoding: "snappy", compressed: snappy.Encode(nil, body)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := Lookup(tt.encoding)
+			r, err := c.NewReader(bytes.NewReader(tt.compressed))
+			if err != nil {
+				t.Fatalf("NewReader() error = %v", err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatalf("ReadAll() error = %v", err)
+			}
+			if !bytes.Equal(got, body) {
+				t.Errorf("got %q, want %q", got, body)
+			}
+		})
+	}
+}
+
+func TestLookup(t *testing.T) {
+	if c, ok := Lookup(""); c != nil || !ok {
+		t.Errorf("Lookup(\"\") = %v, %v, want identity", c, ok)
+	}
+	if c, ok := Lookup("GZIP"); c == nil || !ok {
+		t.Errorf("Lookup(\"GZIP\") = %v, %v, want gzip", c, ok)
+	}
+	if _, ok := Lookup("br"); ok {
+		t.Errorf("Lookup(\"br\") succeeded for unsupported encoding")
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{acceptEncoding: "", want: Identity},
+		{acceptEncoding: "gzip", want: "gzip"},
+		{acceptEncoding: "gzip, deflate, br, zstd", want: "zstd"},
+		{acceptEncoding: "gzip;q=1.0, zstd;q=0.5", want: "gzip"},
+		{acceptEncoding: "br", want: Identity},
+		{acceptEncoding: "*", want: "zstd"},
+		{acceptEncoding: "*, zstd;q=0", want: "gzip"},
+		{acceptEncoding: "gzip;q=0.5, identity", want: Identity},
+		{acceptEncoding: "gzip;q=0.5, identity;q=0", want: "gzip"},
+		{acceptEncoding: "gzip;q=0", want: Identity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.acceptEncoding, func(t *testing.T) {
+			got := Identity
+			if c := Negotiate(tt.acceptEncoding); c != nil {
+				got = c.Name()
+			}
+			if got != tt.want {
+				t.Errorf("Negotiate(%q) = %s, want %s", tt.acceptEncoding, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcceptable(t *testing.T) {
+	if !Acceptable("", "") {
+		t.Error("identity should always be acceptable")
+	}
+	if !Acceptable("deflate, gzip", "gzip") {
+		t.Error("gzip should be acceptable")
+	}
+	if Acceptable("deflate", "gzip") {
+		t.Error("gzip should not be acceptable")
+	}
+}
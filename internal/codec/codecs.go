@@ -0,0 +1,123 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+func init() {
+	// In order of preference
+	Register(zstdCodec{})
+	Register(gzipCodec{})
+	Register(deflateCodec{})
+	Register(snappyCodec{})
+}
+
+// gzipCodec implements the gzip content encoding
+type gzipCodec struct{}
+
+func (gzipCodec) Name() string { return "gzip" }
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func (gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriter(w), nil
+}
+
+// deflateCodec implements the deflate content encoding, which is zlib
+// framed deflate data. Some servers send raw deflate data instead, which is
+// accepted as well.
+type deflateCodec struct{}
+
+func (deflateCodec) Name() string { return "deflate" }
+
+func (deflateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if isZlibHeader(header) {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+func (deflateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zlib.NewWriter(w), nil
+}
+
+// isZlibHeader reports whether b starts with a zlib header using the
+// deflate compression method
+func isZlibHeader(b []byte) bool {
+	if len(b) < 2 {
+		return false
+	}
+	return b[0]&0x0f == 8 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0
+}
+
+// zstdCodec implements the zstd content encoding
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return "zstd" }
+
+func (zstdCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	// Bodies are decoded as they are streamed, so decoding concurrently
+	// would only add goroutines
+	dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
+
+func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+}
+
+// snappyCodec implements the snappy content encoding. Bodies are written
+// in the snappy framing format so they can be streamed. Bodies in the
+// block format, as used by the Prometheus remote read protocol, are read
+// as well.
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string { return "snappy" }
+
+// snappyStreamHeader is the stream identifier chunk starting framed data
+var snappyStreamHeader = []byte("\xff\x06\x00\x00sNaPpY")
+
+func (snappyCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len(snappyStreamHeader))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if bytes.Equal(header, snappyStreamHeader) {
+		return ioutil.NopCloser(snappy.NewReader(br)), nil
+	}
+
+	// The block format can only be decoded as a whole
+	block, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := snappy.Decode(nil, block)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(decoded)), nil
+}
+
+func (snappyCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return snappy.NewBufferedWriter(w), nil
+}
@@ -0,0 +1,114 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Cache configures caching of query responses
+type Cache struct {
+	// Enabled enables the cache of instant and range queries
+	Enabled bool `yaml:"enabled"`
+	// MaxSizeMB is the maximum total size of cached responses (default 256)
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// MaxEntrySizeMB is the maximum size of a cached response (default 8)
+	MaxEntrySizeMB int `yaml:"max_entry_size_mb"`
+	// TTL is how long responses are cached whose time range ends within
+	// the recent window (default 1m)
+	TTL time.Duration `yaml:"ttl"`
+	// HistoricalTTL is how long responses are cached whose time range ends
+	// before the recent window (default 1h)
+	HistoricalTTL time.Duration `yaml:"historical_ttl"`
+	// RecentWindow is how far back data may still change, e.g. due to
+	// late samples or rule evaluation (default 10m)
+	RecentWindow time.Duration `yaml:"recent_window"`
+	// KeyHeaders are the request headers passed through to the upstream
+	// that scope the data it returns, such as credentials or the tenant.
+	// Only requests with the same values share cached and coalesced
+	// responses (default Authorization, Cookie and X-Scope-OrgID).
+	KeyHeaders []string `yaml:"key_headers"`
+
+	Labels LabelsCache `yaml:"labels"`
+}
+
+// DefaultKeyHeaders are the request headers that are part of cache and
+// coalescing keys by default
+var DefaultKeyHeaders = []string{"Authorization", "Cookie", "X-Scope-OrgID"}
+
+// LabelsCache configures caching of label names and label values responses
+type LabelsCache struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxSizeMB is the maximum total size of cached responses (default 32)
+	MaxSizeMB int `yaml:"max_size_mb"`
+	// TTL is how long responses are cached (default 30s)
+	TTL time.Duration `yaml:"ttl"`
+	// TimeAlignment widens the time range of requests to multiples of it,
+	// so requests over ranges relative to the current time share entries
+	// (default 1m)
+	TimeAlignment time.Duration `yaml:"time_alignment"`
+}
+
+// validate checks if the cache settings are valid
+func (c Cache) validate() error {
+	if c.MaxSizeMB < 0 {
+		return fmt.Errorf("cache max_size_mb must not be negative")
+	}
+	if c.MaxEntrySizeMB < 0 {
+		return fmt.Errorf("cache max_entry_size_mb must not be negative")
+	}
+	if c.TTL < 0 || c.HistoricalTTL < 0 {
+		return fmt.Errorf("cache ttl must not be negative")
+	}
+	if c.RecentWindow < 0 {
+		return fmt.Errorf("cache recent_window must not be negative")
+	}
+	if c.Labels.MaxSizeMB < 0 {
+		return fmt.Errorf("cache labels max_size_mb must not be negative")
+	}
+	if c.Labels.TTL < 0 {
+		return fmt.Errorf("cache labels ttl must not be negative")
+	}
+	if c.Labels.TimeAlignment < 0 {
+		return fmt.Errorf("cache labels time_alignment must not be negative")
+	}
+	if c.Labels.TimeAlignment > 0 && c.Labels.TimeAlignment < time.Millisecond {
+		return fmt.Errorf("cache labels time_alignment must be at least 1ms, got %s", c.Labels.TimeAlignment)
+	}
+	return nil
+}
+
+// GetCache returns the cache configuration with defaults applied
+func (c *Config) GetCache() Cache {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	cache := c.Cache
+	if cache.MaxSizeMB == 0 {
+		cache.MaxSizeMB = 256
+	}
+	if cache.MaxEntrySizeMB == 0 {
+		cache.MaxEntrySizeMB = 8
+	}
+	if cache.TTL == 0 {
+		cache.TTL = time.Minute
+	}
+	if cache.HistoricalTTL == 0 {
+		cache.HistoricalTTL = time.Hour
+	}
+	if cache.RecentWindow == 0 {
+		cache.RecentWindow = 10 * time.Minute
+	}
+	if len(cache.KeyHeaders) == 0 {
+		cache.KeyHeaders = DefaultKeyHeaders
+	}
+	if cache.Labels.MaxSizeMB == 0 {
+		cache.Labels.MaxSizeMB = 32
+	}
+	if cache.Labels.TTL == 0 {
+		cache.Labels.TTL = 30 * time.Second
+	}
+	if cache.Labels.TimeAlignment == 0 {
+		cache.Labels.TimeAlignment = time.Minute
+	}
+	return cache
+}
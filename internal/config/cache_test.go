@@ -0,0 +1,28 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cache   Cache
+		wantErr bool
+	}{
+		{name: "defaults", cache: Cache{}},
+		{name: "time alignment", cache: Cache{Labels: LabelsCache{TimeAlignment: time.Millisecond}}},
+		{name: "time alignment under 1ms", cache: Cache{Labels: LabelsCache{TimeAlignment: 500 * time.Microsecond}}, wantErr: true},
+		{name: "negative time alignment", cache: Cache{Labels: LabelsCache{TimeAlignment: -time.Minute}}, wantErr: true},
+		{name: "negative ttl", cache: Cache{TTL: -time.Second}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cache.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package config
+
+import "fmt"
+
+// Coalesce configures sharing of upstream responses between concurrent
+// identical requests
+type Coalesce struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxResponseSizeMB is the maximum size of a shared response. Requests
+	// waiting for a larger response send their own (default 16)
+	MaxResponseSizeMB int `yaml:"max_response_size_mb"`
+}
+
+// validate checks if the coalescing settings are valid
+func (c Coalesce) validate() error {
+	if c.MaxResponseSizeMB < 0 {
+		return fmt.Errorf("coalesce max_response_size_mb must not be negative")
+	}
+	return nil
+}
+
+// GetCoalesce returns the coalescing configuration with defaults applied
+func (c *Config) GetCoalesce() Coalesce {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	coalesce := c.Coalesce
+	if coalesce.MaxResponseSizeMB == 0 {
+		coalesce.MaxResponseSizeMB = 16
+	}
+	return coalesce
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"log/slog"
+	"strings"
 	"sync"
 
 	"gopkg.in/yaml.v3"
@@ -29,11 +31,196 @@ type Mapping struct {
 	Rules     []Rule    `yaml:"rules"`
 }
 
+// AccessLogFormat represents the output format of the access log
+type AccessLogFormat string
+
+const (
+	AccessLogFormatCommon   AccessLogFormat = "common"
+	AccessLogFormatCombined AccessLogFormat = "combined"
+	AccessLogFormatJSON     AccessLogFormat = "json"
+)
+
+// AccessLog configures the access log
+type AccessLog struct {
+	Enabled bool            `yaml:"enabled"`
+	Format  AccessLogFormat `yaml:"format"`
+	File    string          `yaml:"file"`
+	// SampleRate is the fraction of successful requests logged, so 0 only
+	// logs failed requests (default 1)
+	SampleRate *float64 `yaml:"sample_rate"`
+}
+
+// Diagnostics configures how the proxy reports what it did to a response
+type Diagnostics struct {
+	// Warnings appends diagnostics to the warnings of API responses
+	Warnings bool `yaml:"warnings"`
+}
+
+// TracingProtocol represents the OTLP protocol used to export traces
+type TracingProtocol string
+
+const (
+	TracingProtocolHTTP TracingProtocol = "http"
+	TracingProtocolGRPC TracingProtocol = "grpc"
+)
+
+// Tracing configures OpenTelemetry tracing
+type Tracing struct {
+	Enabled     bool            `yaml:"enabled"`
+	Endpoint    string          `yaml:"endpoint"`
+	Protocol    TracingProtocol `yaml:"protocol"`
+	Insecure    bool            `yaml:"insecure"`
+	SampleRatio *float64        `yaml:"sample_ratio"`
+	ServiceName string          `yaml:"service_name"`
+}
+
+// ClientAuth represents the policy for TLS client certificates
+type ClientAuth string
+
+const (
+	ClientAuthNone             ClientAuth = "none"
+	ClientAuthRequest          ClientAuth = "request"
+	ClientAuthRequire          ClientAuth = "require"
+	ClientAuthVerifyIfGiven    ClientAuth = "verify_if_given"
+	ClientAuthRequireAndVerify ClientAuth = "require_and_verify"
+)
+
+// IdentityField represents the client certificate field used as the client identity
+type IdentityField string
+
+const (
+	IdentityFieldCommonName IdentityField = "common_name"
+	IdentityFieldSubject    IdentityField = "subject"
+	IdentityFieldDNSName    IdentityField = "dns_name"
+	IdentityFieldEmail      IdentityField = "email"
+	IdentityFieldURI        IdentityField = "uri"
+)
+
+// ServerTLS configures TLS on the listener
+type ServerTLS struct {
+	CertFile       string        `yaml:"cert_file"`
+	KeyFile        string        `yaml:"key_file"`
+	ClientCAFile   string        `yaml:"client_ca_file"`
+	ClientAuth     ClientAuth    `yaml:"client_auth"`
+	ClientIdentity IdentityField `yaml:"client_identity"`
+}
+
+// Enabled returns true if TLS serving is configured
+func (t ServerTLS) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// Server configures the proxy listener
+type Server struct {
+	TLS ServerTLS `yaml:"tls"`
+	// PathPrefix is the path the proxy is served under, e.g. by an ingress.
+	// It is stripped from requests before they are routed.
+	PathPrefix string     `yaml:"path_prefix"`
+	Listeners  []Listener `yaml:"listeners"`
+}
+
+// UpstreamTLS configures TLS for connections to the upstream Prometheus
+type UpstreamTLS struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// BasicAuth configures HTTP basic authentication
+type BasicAuth struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+// Upstream configures how the proxy connects to the upstream Prometheus
+type Upstream struct {
+	TLS             UpstreamTLS       `yaml:"tls"`
+	BasicAuth       *BasicAuth        `yaml:"basic_auth"`
+	BearerToken     string            `yaml:"bearer_token"`
+	BearerTokenFile string            `yaml:"bearer_token_file"`
+	Headers         map[string]string `yaml:"headers"`
+}
+
+// TenantSource represents where the tenant of a request is taken from
+type TenantSource string
+
+const (
+	TenantSourceHeader     TenantSource = "header"
+	TenantSourceQueryParam TenantSource = "query_param"
+	TenantSourceClientCert TenantSource = "client_cert"
+)
+
+// Tenant configures enforcement of a tenant label on every query
+type Tenant struct {
+	Enabled    bool         `yaml:"enabled"`
+	Label      string       `yaml:"label"`
+	Source     TenantSource `yaml:"source"`
+	Header     string       `yaml:"header"`
+	QueryParam string       `yaml:"query_param"`
+}
+
+// Profile is a named set of mappings that can be selected per request
+type Profile struct {
+	Mappings []Mapping `yaml:"mappings"`
+}
+
+// GetQueryRules returns the profile's rules for query direction
+func (p Profile) GetQueryRules() []Rule {
+	return rulesForDirection(p.Mappings, DirectionQuery)
+}
+
+// GetResultRules returns the profile's rules for result direction
+func (p Profile) GetResultRules() []Rule {
+	return rulesForDirection(p.Mappings, DirectionResult)
+}
+
+// ProfileSelection configures how the mapping profile of a request is chosen
+type ProfileSelection struct {
+	Header     string `yaml:"header"`
+	PathPrefix bool   `yaml:"path_prefix"`
+}
+
+// Listener is an additional address the proxy listens on
+type Listener struct {
+	Address string `yaml:"address"`
+	Profile string `yaml:"profile"`
+	// PathPrefix overrides the server's path prefix for the listener
+	PathPrefix string `yaml:"path_prefix"`
+}
+
 // Config represents the main configuration structure
 type Config struct {
 	TargetPrometheus string    `yaml:"target_prometheus"`
+	Upstream         Upstream  `yaml:"upstream"`
 	Mappings         []Mapping `yaml:"mappings"`
 
+	Upstreams       []UpstreamServer `yaml:"upstreams"`
+	DefaultUpstream string           `yaml:"default_upstream"`
+	Routes          []Route          `yaml:"routes"`
+	Fanout          Fanout           `yaml:"fanout"`
+
+	Endpoints []Endpoint `yaml:"endpoints"`
+	UI        UI         `yaml:"ui"`
+
+	HealthCheck    HealthCheck    `yaml:"health_check"`
+	CircuitBreaker CircuitBreaker `yaml:"circuit_breaker"`
+	Cache          Cache          `yaml:"cache"`
+	QuerySplit     QuerySplit     `yaml:"query_split"`
+	Coalesce       Coalesce       `yaml:"coalesce"`
+	RateLimit      RateLimit      `yaml:"rate_limit"`
+
+	AccessLog   AccessLog   `yaml:"access_log"`
+	Tracing     Tracing     `yaml:"tracing"`
+	Diagnostics Diagnostics `yaml:"diagnostics"`
+	Server      Server      `yaml:"server"`
+	Tenant      Tenant      `yaml:"tenant"`
+
+	Profiles         map[string]Profile `yaml:"profiles"`
+	ProfileSelection ProfileSelection   `yaml:"profile_selection"`
+
 	mu sync.RWMutex
 }
 
@@ -54,19 +241,109 @@ func LoadFromFile(path string) (*Config, error) {
 		return nil, err
 	}
 
+	slog.Debug("loaded configuration",
+		slog.String("path", path),
+		slog.Int("upstreams", len(cfg.GetUpstreams())),
+		slog.Int("mappings", len(cfg.Mappings)),
+	)
+
 	return &cfg, nil
 }
 
 // Validate checks if the configuration is valid
 func (c *Config) Validate() error {
-	if c.TargetPrometheus == "" {
-		return fmt.Errorf("target_prometheus is required")
+	if err := c.validateRouting(); err != nil {
+		return err
+	}
+
+	if err := validateMappings(c.Mappings); err != nil {
+		return err
+	}
+
+	for name, profile := range c.Profiles {
+		if name == "" {
+			return fmt.Errorf("profile name must not be empty")
+		}
+		if err := validateMappings(profile.Mappings); err != nil {
+			return fmt.Errorf("profile %q: %w", name, err)
+		}
+	}
+
+	if err := c.validateProfileSelection(); err != nil {
+		return err
+	}
+
+	for _, endpoint := range c.Endpoints {
+		if err := endpoint.validate(); err != nil {
+			return err
+		}
+	}
+
+	switch c.AccessLog.Format {
+	case "", AccessLogFormatCommon, AccessLogFormatCombined, AccessLogFormatJSON:
+	default:
+		return fmt.Errorf("invalid access_log format: %s", c.AccessLog.Format)
+	}
+
+	if r := c.AccessLog.SampleRate; r != nil && (*r < 0 || *r > 1) {
+		return fmt.Errorf("access_log sample_rate must be between 0 and 1, got %v", *r)
+	}
+
+	switch c.Tracing.Protocol {
+	case "", TracingProtocolHTTP, TracingProtocolGRPC:
+	default:
+		return fmt.Errorf("invalid tracing protocol: %s", c.Tracing.Protocol)
+	}
+
+	if r := c.Tracing.SampleRatio; r != nil && (*r < 0 || *r > 1) {
+		return fmt.Errorf("tracing sample_ratio must be between 0 and 1, got %v", *r)
+	}
+
+	if err := c.Server.TLS.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Upstream.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Tenant.validate(); err != nil {
+		return err
+	}
+
+	if err := c.HealthCheck.validate(); err != nil {
+		return err
+	}
+
+	if err := c.CircuitBreaker.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Cache.validate(); err != nil {
+		return err
+	}
+
+	if err := c.QuerySplit.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Coalesce.validate(); err != nil {
+		return err
 	}
 
-	for i, mapping := range c.Mappings {
-		if mapping.Direction != DirectionQuery && 
-		   mapping.Direction != DirectionResult && 
-		   mapping.Direction != DirectionBoth {
+	if err := c.RateLimit.validate(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validateMappings checks if a list of mappings is valid
+func validateMappings(mappings []Mapping) error {
+	for i, mapping := range mappings {
+		if mapping.Direction != DirectionQuery &&
+			mapping.Direction != DirectionResult &&
+			mapping.Direction != DirectionBoth {
 			return fmt.Errorf("invalid direction in mapping %d: %s", i, mapping.Direction)
 		}
 
@@ -87,13 +364,122 @@ func (c *Config) Validate() error {
 	return nil
 }
 
+// validateProfileSelection checks that listeners refer to defined profiles
+func (c *Config) validateProfileSelection() error {
+	for i, listener := range c.Server.Listeners {
+		if listener.Address == "" {
+			return fmt.Errorf("address is required in listener %d", i)
+		}
+		if _, ok := c.Profiles[listener.Profile]; listener.Profile != "" && !ok {
+			return fmt.Errorf("unknown profile in listener %d: %s", i, listener.Profile)
+		}
+		if err := validatePathPrefix(listener.PathPrefix); err != nil {
+			return fmt.Errorf("listener %d: %w", i, err)
+		}
+	}
+	return validatePathPrefix(c.Server.PathPrefix)
+}
+
+// validatePathPrefix checks that a path prefix, if set, is an absolute path
+func validatePathPrefix(prefix string) error {
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		return fmt.Errorf("path_prefix must start with /: %s", prefix)
+	}
+	return nil
+}
+
+// validate checks if the listener TLS configuration is valid
+func (t ServerTLS) validate() error {
+	if !t.Enabled() {
+		if t.ClientCAFile != "" || t.ClientAuth != "" {
+			return fmt.Errorf("server tls cert_file and key_file are required for client authentication")
+		}
+		return nil
+	}
+
+	if t.CertFile == "" || t.KeyFile == "" {
+		return fmt.Errorf("server tls requires both cert_file and key_file")
+	}
+
+	switch t.ClientAuth {
+	case "", ClientAuthNone, ClientAuthRequest, ClientAuthRequire:
+	case ClientAuthVerifyIfGiven, ClientAuthRequireAndVerify:
+		if t.ClientCAFile == "" {
+			return fmt.Errorf("server tls client_ca_file is required for client_auth %s", t.ClientAuth)
+		}
+	default:
+		return fmt.Errorf("invalid server tls client_auth: %s", t.ClientAuth)
+	}
+
+	switch t.ClientIdentity {
+	case "", IdentityFieldCommonName, IdentityFieldSubject, IdentityFieldDNSName, IdentityFieldEmail, IdentityFieldURI:
+	default:
+		return fmt.Errorf("invalid server tls client_identity: %s", t.ClientIdentity)
+	}
+
+	return nil
+}
+
+// validate checks if the upstream connection configuration is valid
+func (u Upstream) validate() error {
+	if (u.TLS.CertFile == "") != (u.TLS.KeyFile == "") {
+		return fmt.Errorf("upstream tls requires both cert_file and key_file")
+	}
+
+	authMethods := 0
+	if u.BasicAuth != nil {
+		authMethods++
+		if u.BasicAuth.Username == "" {
+			return fmt.Errorf("upstream basic_auth username is required")
+		}
+		if u.BasicAuth.Password != "" && u.BasicAuth.PasswordFile != "" {
+			return fmt.Errorf("upstream basic_auth password and password_file are mutually exclusive")
+		}
+	}
+	if u.BearerToken != "" || u.BearerTokenFile != "" {
+		authMethods++
+		if u.BearerToken != "" && u.BearerTokenFile != "" {
+			return fmt.Errorf("upstream bearer_token and bearer_token_file are mutually exclusive")
+		}
+	}
+	if authMethods > 1 {
+		return fmt.Errorf("upstream basic_auth and bearer token are mutually exclusive")
+	}
+
+	return nil
+}
+
+// validate checks if the tenant configuration is valid
+func (t Tenant) validate() error {
+	if !t.Enabled {
+		return nil
+	}
+
+	if t.Label == "" {
+		return fmt.Errorf("tenant label is required")
+	}
+
+	switch t.Source {
+	case TenantSourceHeader, TenantSourceQueryParam, TenantSourceClientCert:
+	default:
+		return fmt.Errorf("invalid tenant source: %s", t.Source)
+	}
+
+	return nil
+}
+
 // GetRules returns rules for a specific direction
 func (c *Config) GetRules(direction Direction) []Rule {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
+	return rulesForDirection(c.Mappings, direction)
+}
+
+// rulesForDirection returns the rules of the mappings that apply to a direction
+func rulesForDirection(mappings []Mapping, direction Direction) []Rule {
 	var rules []Rule
-	for _, mapping := range c.Mappings {
+	for _, mapping := range mappings {
 		if mapping.Direction == direction || mapping.Direction == DirectionBoth {
 			rules = append(rules, mapping.Rules...)
 		}
@@ -117,3 +503,74 @@ func (c *Config) GetTargetPrometheus() string {
 	defer c.mu.RUnlock()
 	return c.TargetPrometheus
 }
+
+// GetAccessLog returns the access log configuration
+func (c *Config) GetAccessLog() AccessLog {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.AccessLog
+}
+
+// GetTracing returns the tracing configuration
+func (c *Config) GetTracing() Tracing {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Tracing
+}
+
+// GetDiagnostics returns the diagnostics configuration
+func (c *Config) GetDiagnostics() Diagnostics {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Diagnostics
+}
+
+// GetServer returns the listener configuration
+func (c *Config) GetServer() Server {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Server
+}
+
+// GetUpstream returns the upstream connection configuration
+func (c *Config) GetUpstream() Upstream {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Upstream
+}
+
+// GetTenant returns the tenant enforcement configuration with defaults applied
+func (c *Config) GetTenant() Tenant {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	tenant := c.Tenant
+	if tenant.Header == "" {
+		tenant.Header = "X-Tenant"
+	}
+	if tenant.QueryParam == "" {
+		tenant.QueryParam = "tenant"
+	}
+	return tenant
+}
+
+// GetFanout returns the fan-out configuration
+func (c *Config) GetFanout() Fanout {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Fanout
+}
+
+// GetProfiles returns the named mapping profiles
+func (c *Config) GetProfiles() map[string]Profile {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Profiles
+}
+
+// GetProfileSelection returns how mapping profiles are selected
+func (c *Config) GetProfileSelection() ProfileSelection {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.ProfileSelection
+}
@@ -0,0 +1,130 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Response rewriters for the responses of an endpoint
+const (
+	// ResponseRewriterResult rewrites the label sets found under "metric"
+	// keys, as in query results
+	ResponseRewriterResult = "result"
+	// ResponseRewriterLabels rewrites the label sets found under "metric",
+	// "labels" and "seriesLabels" keys, as in targets, rules, alerts and
+	// exemplars
+	ResponseRewriterLabels = "labels"
+	// ResponseRewriterQuery rewrites the PromQL expression that is the data
+	// of the response, as returned by /api/v1/format_query
+	ResponseRewriterQuery = "query"
+	// ResponseRewriterSeries rewrites the label sets listed in the data of
+	// the response, as returned by /api/v1/series
+	ResponseRewriterSeries = "series"
+	// ResponseRewriterLabelNames rewrites the label names listed in the
+	// data of the response, as returned by /api/v1/labels
+	ResponseRewriterLabelNames = "label_names"
+	// ResponseRewriterNone passes responses through unchanged
+	ResponseRewriterNone = "none"
+)
+
+// Endpoint configures which parameters of requests to an API endpoint are
+// rewritten and how its responses are rewritten
+type Endpoint struct {
+	// Path is a path pattern as accepted by path.Match, e.g.
+	// /api/v1/label/*/values
+	Path string `yaml:"path"`
+	// QueryParams contain PromQL expressions or series selectors
+	QueryParams []string `yaml:"query_params"`
+	// LabelParams contain label names
+	LabelParams []string `yaml:"label_params"`
+	// MetricParams contain metric names. They are not rewritten, but used
+	// for routing like selectors of the metric name.
+	MetricParams []string `yaml:"metric_params"`
+	// PathLabel is set if the last wildcard in Path matches a label name,
+	// as in /api/v1/label/*/values, which is rewritten
+	PathLabel bool `yaml:"path_label"`
+	// Response is the response rewriter (default: result)
+	Response string `yaml:"response"`
+}
+
+// defaultEndpoints describe the endpoints of the Prometheus HTTP API
+var defaultEndpoints = []Endpoint{
+	{Path: "/api/v1/query", QueryParams: []string{"query"}},
+	{Path: "/api/v1/query_range", QueryParams: []string{"query"}},
+	{Path: "/api/v1/query_exemplars", QueryParams: []string{"query"}},
+	{Path: "/api/v1/format_query", QueryParams: []string{"query"}, Response: ResponseRewriterNone},
+	{Path: "/api/v1/parse_query", QueryParams: []string{"query"}, Response: ResponseRewriterNone},
+	{Path: "/api/v1/series", QueryParams: []string{"match[]"}, Response: ResponseRewriterSeries},
+	{Path: "/api/v1/labels", QueryParams: []string{"match[]"}, Response: ResponseRewriterLabelNames},
+	{Path: "/api/v1/label/*/values", QueryParams: []string{"match[]"}, PathLabel: true},
+	{Path: "/api/v1/metadata", MetricParams: []string{"metric"}, Response: ResponseRewriterNone},
+	{Path: "/api/v1/targets/metadata", QueryParams: []string{"match_target"}, MetricParams: []string{"metric"}},
+	{Path: "/federate", QueryParams: []string{"match[]"}, Response: ResponseRewriterNone},
+}
+
+// uiEndpoints are the endpoints used by the Prometheus web UI that are
+// rewritten differently in UI compatibility mode, so the UI shows the
+// client's label names throughout
+var uiEndpoints = []Endpoint{
+	{Path: "/api/v1/label/*/values", QueryParams: []string{"match[]"}, PathLabel: true, Response: ResponseRewriterNone},
+	{Path: "/api/v1/format_query", QueryParams: []string{"query"}, Response: ResponseRewriterQuery},
+	{Path: "/api/v1/query_exemplars", QueryParams: []string{"query"}, Response: ResponseRewriterLabels},
+	{Path: "/api/v1/targets", Response: ResponseRewriterLabels},
+	{Path: "/api/v1/rules", Response: ResponseRewriterLabels},
+	{Path: "/api/v1/alerts", Response: ResponseRewriterLabels},
+}
+
+// DefaultEndpoint applies to requests to paths that match no endpoint
+var DefaultEndpoint = Endpoint{
+	QueryParams: []string{"query", "match[]"},
+	Response:    ResponseRewriterResult,
+}
+
+// validate checks if the endpoint is valid
+func (e Endpoint) validate() error {
+	if e.Path == "" {
+		return fmt.Errorf("endpoint path must not be empty")
+	}
+	if _, err := path.Match(e.Path, ""); err != nil {
+		return fmt.Errorf("endpoint %s: invalid path pattern: %w", e.Path, err)
+	}
+	if e.PathLabel && !strings.Contains(e.Path, "*") {
+		return fmt.Errorf("endpoint %s: path_label requires a wildcard in the path", e.Path)
+	}
+
+	switch e.Response {
+	case "", ResponseRewriterResult, ResponseRewriterLabels, ResponseRewriterQuery, ResponseRewriterSeries, ResponseRewriterLabelNames, ResponseRewriterNone:
+	default:
+		return fmt.Errorf("endpoint %s: invalid response rewriter: %s", e.Path, e.Response)
+	}
+	return nil
+}
+
+// UI configures support for the Prometheus web UI
+type UI struct {
+	// Compat enables UI compatibility mode, which rewrites all endpoints
+	// the bundled web UI uses
+	Compat bool `yaml:"compat"`
+}
+
+// GetEndpoints returns the configured endpoints followed by the endpoints of
+// the Prometheus HTTP API, with defaults applied. The first endpoint whose
+// path matches a request applies to it.
+func (c *Config) GetEndpoints() []Endpoint {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	endpoints := make([]Endpoint, 0, len(c.Endpoints)+len(uiEndpoints)+len(defaultEndpoints))
+	endpoints = append(endpoints, c.Endpoints...)
+	if c.UI.Compat {
+		endpoints = append(endpoints, uiEndpoints...)
+	}
+	endpoints = append(endpoints, defaultEndpoints...)
+	for i := range endpoints {
+		if endpoints[i].Response == "" {
+			endpoints[i].Response = ResponseRewriterResult
+		}
+	}
+	return endpoints
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// HealthCheck configures active health checking of upstreams
+type HealthCheck struct {
+	Enabled  bool          `yaml:"enabled"`
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// CircuitBreaker configures when requests to a failing upstream are stopped
+type CircuitBreaker struct {
+	Enabled bool `yaml:"enabled"`
+	// FailureThreshold is the number of consecutive failures that open the
+	// circuit
+	FailureThreshold int `yaml:"failure_threshold"`
+	// OpenDuration is how long the circuit stays open before a request is
+	// let through to probe the upstream
+	OpenDuration time.Duration `yaml:"open_duration"`
+}
+
+// validate checks if the health check settings are valid
+func (h HealthCheck) validate() error {
+	if h.Interval < 0 {
+		return fmt.Errorf("health_check interval must not be negative")
+	}
+	if h.Timeout < 0 {
+		return fmt.Errorf("health_check timeout must not be negative")
+	}
+	return nil
+}
+
+// validate checks if the circuit breaker settings are valid
+func (b CircuitBreaker) validate() error {
+	if b.FailureThreshold < 0 {
+		return fmt.Errorf("circuit_breaker failure_threshold must not be negative")
+	}
+	if b.OpenDuration < 0 {
+		return fmt.Errorf("circuit_breaker open_duration must not be negative")
+	}
+	return nil
+}
+
+// GetHealthCheck returns the health check configuration with defaults applied
+func (c *Config) GetHealthCheck() HealthCheck {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	health := c.HealthCheck
+	if health.Path == "" {
+		health.Path = "/-/ready"
+	}
+	if health.Interval == 0 {
+		health.Interval = 10 * time.Second
+	}
+	if health.Timeout == 0 {
+		health.Timeout = 2 * time.Second
+	}
+	return health
+}
+
+// GetCircuitBreaker returns the circuit breaker configuration with defaults
+// applied
+func (c *Config) GetCircuitBreaker() CircuitBreaker {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	breaker := c.CircuitBreaker
+	if breaker.FailureThreshold == 0 {
+		breaker.FailureThreshold = 5
+	}
+	if breaker.OpenDuration == 0 {
+		breaker.OpenDuration = 30 * time.Second
+	}
+	return breaker
+}
@@ -0,0 +1,120 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"strings"
+)
+
+// ClientSource represents how the client of a request is identified for
+// rate limiting
+type ClientSource string
+
+const (
+	ClientSourceIP         ClientSource = "ip"
+	ClientSourceHeader     ClientSource = "header"
+	ClientSourceTenant     ClientSource = "tenant"
+	ClientSourceClientCert ClientSource = "client_cert"
+)
+
+// RateLimit configures limits on the requests of each client and of all
+// clients together
+type RateLimit struct {
+	Enabled bool `yaml:"enabled"`
+	// Client identifies the client of a request (default ip). Requests
+	// without the identity are limited by their IP address.
+	Client ClientSource `yaml:"client"`
+	// Header is the header identifying the client if client is header
+	// (default X-Client-ID)
+	Header string `yaml:"header"`
+	// TrustedProxies are the addresses or CIDR ranges of the load balancers
+	// in front of the proxy. The IP address of requests from them is taken
+	// from the X-Forwarded-For header.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	PerClient Limits `yaml:"per_client"`
+	Global    Limits `yaml:"global"`
+}
+
+// Limits are rate and concurrency limits. Zero values disable a limit.
+type Limits struct {
+	// RequestsPerSecond is the sustained rate of requests
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	// Burst is the number of requests allowed at once above the rate
+	// (default requests_per_second rounded up)
+	Burst int `yaml:"burst"`
+	// MaxConcurrent is the maximum number of requests in flight to the
+	// upstreams
+	MaxConcurrent int `yaml:"max_concurrent"`
+}
+
+// validate checks if the limits are valid
+func (l Limits) validate(scope string) error {
+	if l.RequestsPerSecond < 0 {
+		return fmt.Errorf("rate_limit %s requests_per_second must not be negative", scope)
+	}
+	if l.Burst < 0 {
+		return fmt.Errorf("rate_limit %s burst must not be negative", scope)
+	}
+	if l.MaxConcurrent < 0 {
+		return fmt.Errorf("rate_limit %s max_concurrent must not be negative", scope)
+	}
+	return nil
+}
+
+// validate checks if the rate limit settings are valid
+func (r RateLimit) validate() error {
+	if !r.Enabled {
+		return nil
+	}
+
+	switch r.Client {
+	case "", ClientSourceIP, ClientSourceHeader, ClientSourceTenant, ClientSourceClientCert:
+	default:
+		return fmt.Errorf("invalid rate_limit client: %s", r.Client)
+	}
+	for _, proxy := range r.TrustedProxies {
+		if _, err := ParsePrefix(proxy); err != nil {
+			return fmt.Errorf("invalid rate_limit trusted_proxies entry %q: %w", proxy, err)
+		}
+	}
+
+	if err := r.PerClient.validate("per_client"); err != nil {
+		return err
+	}
+	return r.Global.validate("global")
+}
+
+// GetRateLimit returns the rate limit configuration with defaults applied
+func (c *Config) GetRateLimit() RateLimit {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	rateLimit := c.RateLimit
+	if rateLimit.Client == "" {
+		rateLimit.Client = ClientSourceIP
+	}
+	if rateLimit.Header == "" {
+		rateLimit.Header = "X-Client-ID"
+	}
+	for _, limits := range []*Limits{&rateLimit.PerClient, &rateLimit.Global} {
+		if limits.Burst == 0 {
+			limits.Burst = int(math.Ceil(limits.RequestsPerSecond))
+		}
+	}
+	return rateLimit
+}
+
+// ParsePrefix parses a CIDR range or a single IP address
+func ParsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
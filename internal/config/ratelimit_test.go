@@ -0,0 +1,27 @@
+package config
+
+import "testing"
+
+func TestRateLimitValidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		rateLimit RateLimit
+		wantErr   bool
+	}{
+		{name: "disabled", rateLimit: RateLimit{Client: "unknown"}},
+		{name: "defaults", rateLimit: RateLimit{Enabled: true}},
+		{name: "invalid client", rateLimit: RateLimit{Enabled: true, Client: "unknown"}, wantErr: true},
+		{name: "trusted proxies", rateLimit: RateLimit{Enabled: true, TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"}}},
+		{name: "invalid trusted proxy", rateLimit: RateLimit{Enabled: true, TrustedProxies: []string{"10.0.0.0/33"}}, wantErr: true},
+		{name: "trusted proxy hostname", rateLimit: RateLimit{Enabled: true, TrustedProxies: []string{"ingress"}}, wantErr: true},
+		{name: "negative rate", rateLimit: RateLimit{Enabled: true, Global: Limits{RequestsPerSecond: -1}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.rateLimit.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+)
+
+// DefaultUpstreamName is the name of the upstream defined by target_prometheus
+const DefaultUpstreamName = "default"
+
+// UpstreamServer is a named upstream Prometheus server
+type UpstreamServer struct {
+	Name    string `yaml:"name"`
+	URL     string `yaml:"url"`
+	Profile string `yaml:"profile"`
+	// ExternalLabels are added to the series returned by this upstream
+	// when queries are fanned out
+	ExternalLabels map[string]string `yaml:"external_labels"`
+	// Failover is the upstream that read requests are sent to while this
+	// upstream is unhealthy
+	Failover string `yaml:"failover"`
+	Upstream `yaml:",inline"`
+}
+
+// Route selects an upstream for requests that match all of its conditions
+type Route struct {
+	Upstream        string            `yaml:"upstream"`
+	PathPrefix      string            `yaml:"path_prefix"`
+	StripPathPrefix bool              `yaml:"strip_path_prefix"`
+	Headers         map[string]string `yaml:"headers"`
+	Tenant          string            `yaml:"tenant"`
+	Matchers        []string          `yaml:"matchers"`
+}
+
+// Fanout sends queries to several upstreams and merges their results
+type Fanout struct {
+	Enabled bool `yaml:"enabled"`
+	// Upstreams queried on fan-out, all upstreams if empty
+	Upstreams []string `yaml:"upstreams"`
+	// ReplicaLabel identifies replicas of HA pairs whose results are
+	// deduplicated, usually set as an external label of each upstream
+	ReplicaLabel string `yaml:"replica_label"`
+}
+
+// validateRouting checks if the upstreams and routes are valid
+func (c *Config) validateRouting() error {
+	if c.TargetPrometheus == "" && len(c.Upstreams) == 0 {
+		return fmt.Errorf("target_prometheus or upstreams is required")
+	}
+	if c.TargetPrometheus != "" && len(c.Upstreams) > 0 {
+		return fmt.Errorf("target_prometheus and upstreams are mutually exclusive")
+	}
+	if len(c.Upstreams) > 0 && !reflect.ValueOf(c.Upstream).IsZero() {
+		// The upstream block only applies to target_prometheus
+		return fmt.Errorf("upstream cannot be used with upstreams, set tls, basic_auth, bearer_token, bearer_token_file and headers in each entry of upstreams instead")
+	}
+
+	// Routes may name the upstream defined by target_prometheus
+	names := make(map[string]bool)
+	if c.TargetPrometheus != "" {
+		names[DefaultUpstreamName] = true
+	}
+	for i, u := range c.Upstreams {
+		if u.Name == "" {
+			return fmt.Errorf("name is required in upstream %d", i)
+		}
+		if names[u.Name] {
+			return fmt.Errorf("duplicate upstream name: %s", u.Name)
+		}
+		names[u.Name] = true
+
+		if u.URL == "" {
+			return fmt.Errorf("url is required in upstream %s", u.Name)
+		}
+		if _, err := url.Parse(u.URL); err != nil {
+			return fmt.Errorf("invalid url in upstream %s: %w", u.Name, err)
+		}
+		if _, ok := c.Profiles[u.Profile]; u.Profile != "" && !ok {
+			return fmt.Errorf("unknown profile in upstream %s: %s", u.Name, u.Profile)
+		}
+		if err := u.Upstream.validate(); err != nil {
+			return fmt.Errorf("upstream %s: %w", u.Name, err)
+		}
+	}
+
+	for _, u := range c.Upstreams {
+		if u.Failover == "" {
+			continue
+		}
+		if !names[u.Failover] {
+			return fmt.Errorf("unknown failover in upstream %s: %s", u.Name, u.Failover)
+		}
+		if u.Failover == u.Name {
+			return fmt.Errorf("upstream %s cannot fail over to itself", u.Name)
+		}
+	}
+
+	if c.DefaultUpstream != "" && !names[c.DefaultUpstream] {
+		return fmt.Errorf("unknown default_upstream: %s", c.DefaultUpstream)
+	}
+
+	for i, route := range c.Routes {
+		if route.Upstream == "" {
+			return fmt.Errorf("upstream is required in route %d", i)
+		}
+		if !names[route.Upstream] {
+			return fmt.Errorf("unknown upstream in route %d: %s", i, route.Upstream)
+		}
+		if route.Tenant != "" && c.Tenant.Source == "" {
+			return fmt.Errorf("route %d matches a tenant but no tenant source is configured", i)
+		}
+	}
+
+	for _, name := range c.Fanout.Upstreams {
+		if !names[name] {
+			return fmt.Errorf("unknown upstream in fanout: %s", name)
+		}
+	}
+
+	return nil
+}
+
+// GetUpstreams returns the upstream servers. A configuration using
+// target_prometheus yields a single upstream named "default".
+func (c *Config) GetUpstreams() []UpstreamServer {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if len(c.Upstreams) == 0 {
+		return []UpstreamServer{{
+			Name:     DefaultUpstreamName,
+			URL:      c.TargetPrometheus,
+			Upstream: c.Upstream,
+		}}
+	}
+	return c.Upstreams
+}
+
+// GetDefaultUpstream returns the name of the upstream used when no route
+// matches
+func (c *Config) GetDefaultUpstream() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	switch {
+	case c.DefaultUpstream != "":
+		return c.DefaultUpstream
+	case len(c.Upstreams) > 0:
+		return c.Upstreams[0].Name
+	}
+	return DefaultUpstreamName
+}
+
+// GetRoutes returns the routing rules
+func (c *Config) GetRoutes() []Route {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.Routes
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRouting(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     *Config
+		wantErr string
+	}{
+		{
+			name: "route to default upstream",
+			cfg: &Config{
+				TargetPrometheus: "http://prometheus:9090",
+				Routes:           []Route{{Upstream: DefaultUpstreamName, PathPrefix: "/eu"}},
+			},
+		},
+		{
+			name: "unknown route upstream with target_prometheus",
+			cfg: &Config{
+				TargetPrometheus: "http://prometheus:9090",
+				Routes:           []Route{{Upstream: "eu", PathPrefix: "/eu"}},
+			},
+			wantErr: "unknown upstream in route 0: eu",
+		},
+		{
+			name: "unknown route upstream",
+			cfg: &Config{
+				Upstreams: []UpstreamServer{{Name: "us", URL: "http://us:9090"}},
+				Routes:    []Route{{Upstream: "eu", PathPrefix: "/eu"}},
+			},
+			wantErr: "unknown upstream in route 0: eu",
+		},
+		{
+			name: "route to named upstream",
+			cfg: &Config{
+				Upstreams: []UpstreamServer{{Name: "eu", URL: "http://eu:9090"}},
+				Routes:    []Route{{Upstream: "eu", PathPrefix: "/eu"}},
+			},
+		},
+		{
+			name: "fanout to default upstream",
+			cfg: &Config{
+				TargetPrometheus: "http://prometheus:9090",
+				Fanout:           Fanout{Enabled: true, Upstreams: []string{DefaultUpstreamName}},
+			},
+		},
+		{
+			name: "unknown fanout upstream with target_prometheus",
+			cfg: &Config{
+				TargetPrometheus: "http://prometheus:9090",
+				Fanout:           Fanout{Enabled: true, Upstreams: []string{"eu"}},
+			},
+			wantErr: "unknown upstream in fanout: eu",
+		},
+		{
+			name: "unknown fanout upstream",
+			cfg: &Config{
+				Upstreams: []UpstreamServer{{Name: "us", URL: "http://us:9090"}},
+				Fanout:    Fanout{Enabled: true, Upstreams: []string{"eu"}},
+			},
+			wantErr: "unknown upstream in fanout: eu",
+		},
+		{
+			name: "upstream block with upstreams",
+			cfg: &Config{
+				Upstreams: []UpstreamServer{{Name: "eu", URL: "http://eu:9090"}},
+				Upstream:  Upstream{BearerToken: "secret"},
+			},
+			wantErr: "set tls, basic_auth, bearer_token, bearer_token_file and headers in each entry of upstreams",
+		},
+		{
+			name: "upstream block with target_prometheus",
+			cfg: &Config{
+				TargetPrometheus: "http://prometheus:9090",
+				Upstream:         Upstream{BearerToken: "secret"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.validateRouting()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// QuerySplit configures splitting of range queries into sub-queries over
+// consecutive intervals
+type QuerySplit struct {
+	Enabled bool `yaml:"enabled"`
+	// Interval is the length of the sub-ranges, which are aligned to the
+	// Unix epoch, so the default of 24h splits at midnight UTC
+	Interval time.Duration `yaml:"interval"`
+	// MaxParallel is the maximum number of sub-queries of a query sent to
+	// the upstream concurrently (default 4)
+	MaxParallel int `yaml:"max_parallel"`
+}
+
+// validate checks if the query split settings are valid
+func (s QuerySplit) validate() error {
+	if s.Interval < 0 {
+		return fmt.Errorf("query_split interval must not be negative")
+	}
+	if s.Interval > 0 && s.Interval < time.Minute {
+		return fmt.Errorf("query_split interval must be at least 1m, got %s", s.Interval)
+	}
+	if s.MaxParallel < 0 {
+		return fmt.Errorf("query_split max_parallel must not be negative")
+	}
+	return nil
+}
+
+// GetQuerySplit returns the query split configuration with defaults applied
+func (c *Config) GetQuerySplit() QuerySplit {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	split := c.QuerySplit
+	if split.Interval == 0 {
+		split.Interval = 24 * time.Hour
+	}
+	if split.MaxParallel == 0 {
+		split.MaxParallel = 4
+	}
+	return split
+}
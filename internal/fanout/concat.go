@@ -0,0 +1,96 @@
+package fanout
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/promapi"
+)
+
+// Concat concatenates the matrix results of range queries over consecutive
+// time ranges, given in order. Series are merged by their labels. If any
+// query failed, the first failure is returned as is, since its range would
+// be missing from the result.
+func Concat(responses []Response) (int, []byte) {
+	var (
+		order    []string
+		groups   = make(map[string]*series)
+		warnings []string
+		infos    []string
+
+		seenWarnings = make(map[string]bool)
+		seenInfos    = make(map[string]bool)
+	)
+
+	for i := range responses {
+		resp := &responses[i]
+		parsed, err := parseResponse(resp)
+		if err != nil {
+			if resp.Err != nil || resp.StatusCode != http.StatusOK {
+				return failure(resp)
+			}
+			return http.StatusBadGateway, promapi.ErrorBody(promapi.ErrorInternal, fmt.Sprintf("upstream %s: %v", resp.Upstream, err))
+		}
+
+		var data queryData
+		if err := json.Unmarshal(parsed.api.Data, &data); err != nil {
+			return http.StatusBadGateway, promapi.ErrorBody(promapi.ErrorInternal, fmt.Sprintf("invalid query data from upstream %s: %v", resp.Upstream, err))
+		}
+		if data.ResultType != "matrix" {
+			return http.StatusBadGateway, promapi.ErrorBody(promapi.ErrorInternal, fmt.Sprintf("upstream %s returned %s result, expected matrix", resp.Upstream, data.ResultType))
+		}
+
+		for _, raw := range data.Result {
+			var s series
+			if err := json.Unmarshal(raw, &s); err != nil {
+				return http.StatusBadGateway, promapi.ErrorBody(promapi.ErrorInternal, fmt.Sprintf("invalid series from upstream %s: %v", resp.Upstream, err))
+			}
+			key := labelsKey(s.Metric)
+			existing, ok := groups[key]
+			if !ok {
+				groups[key] = &s
+				order = append(order, key)
+				continue
+			}
+			existing.Values = append(existing.Values, s.Values...)
+			existing.Histograms = append(existing.Histograms, s.Histograms...)
+		}
+
+		// Each range may report the same warnings
+		warnings = appendUnique(warnings, parsed.api.Warnings, seenWarnings)
+		infos = appendUnique(infos, parsed.api.Infos, seenInfos)
+	}
+
+	result := make([]json.RawMessage, 0, len(order))
+	for _, key := range order {
+		raw, err := promapi.Marshal(groups[key])
+		if err != nil {
+			return http.StatusBadGateway, promapi.ErrorBody(promapi.ErrorInternal, err.Error())
+		}
+		result = append(result, raw)
+	}
+	data, err := promapi.Marshal(queryData{ResultType: "matrix", Result: result})
+	if err != nil {
+		return http.StatusBadGateway, promapi.ErrorBody(promapi.ErrorInternal, err.Error())
+	}
+
+	body, _ := promapi.Marshal(promapi.Response{
+		Status:   "success",
+		Data:     data,
+		Warnings: warnings,
+		Infos:    infos,
+	})
+	return http.StatusOK, body
+}
+
+// appendUnique appends the messages that have not been seen yet
+func appendUnique(list, messages []string, seen map[string]bool) []string {
+	for _, msg := range messages {
+		if !seen[msg] {
+			seen[msg] = true
+			list = append(list, msg)
+		}
+	}
+	return list
+}
@@ -0,0 +1,202 @@
+package fanout
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/promapi"
+)
+
+// initialPenalty is the penalty in milliseconds applied to the replica that
+// was not picked while the sample interval is not known yet
+const initialPenalty = 5000
+
+// series is a series of a vector or matrix result
+type series struct {
+	Metric     map[string]string `json:"metric"`
+	Value      json.RawMessage   `json:"value,omitempty"`
+	Values     []json.RawMessage `json:"values,omitempty"`
+	Histogram  json.RawMessage   `json:"histogram,omitempty"`
+	Histograms []json.RawMessage `json:"histograms,omitempty"`
+}
+
+// dedupResult merges the series of a vector or matrix result that only
+// differ in the replica label. The replica label is removed from the result.
+func dedupResult(result []json.RawMessage, replicaLabel string) ([]json.RawMessage, error) {
+	var (
+		order  []string
+		groups = make(map[string]*series)
+	)
+
+	for _, raw := range result {
+		var s series
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, err
+		}
+		delete(s.Metric, replicaLabel)
+
+		key := labelsKey(s.Metric)
+		existing, ok := groups[key]
+		if !ok {
+			groups[key] = &s
+			order = append(order, key)
+			continue
+		}
+
+		// Instant vectors keep the sample of the first replica
+		existing.Values = dedupSamples(existing.Values, s.Values)
+		existing.Histograms = dedupSamples(existing.Histograms, s.Histograms)
+		if existing.Value == nil && existing.Histogram == nil {
+			existing.Value, existing.Histogram = s.Value, s.Histogram
+		}
+	}
+
+	deduped := make([]json.RawMessage, 0, len(order))
+	for _, key := range order {
+		raw, err := promapi.Marshal(groups[key])
+		if err != nil {
+			return nil, err
+		}
+		deduped = append(deduped, raw)
+	}
+	return deduped, nil
+}
+
+// dedupSeries removes the replica label from series label sets and drops
+// the resulting duplicates
+func dedupSeries(result []json.RawMessage, replicaLabel string) ([]json.RawMessage, error) {
+	seen := make(map[string]bool)
+	deduped := make([]json.RawMessage, 0, len(result))
+
+	for _, raw := range result {
+		var labels map[string]string
+		if err := json.Unmarshal(raw, &labels); err != nil {
+			return nil, err
+		}
+		if _, ok := labels[replicaLabel]; !ok {
+			if key := labelsKey(labels); !seen[key] {
+				seen[key] = true
+				deduped = append(deduped, raw)
+			}
+			continue
+		}
+
+		delete(labels, replicaLabel)
+		key := labelsKey(labels)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		raw, err := promapi.Marshal(labels)
+		if err != nil {
+			return nil, err
+		}
+		deduped = append(deduped, raw)
+	}
+	return deduped, nil
+}
+
+// labelsKey returns a string identifying a label set
+func labelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(strconv.Quote(name))
+		b.WriteByte('=')
+		b.WriteString(strconv.Quote(labels[name]))
+		b.WriteByte(',')
+	}
+	return b.String()
+}
+
+// dedupSamples merges the samples of two replicas of a series. Samples are
+// taken from one replica until it has a gap, which is filled from the
+// other. The replica that was not picked is penalized by twice the last
+// sample interval, so switching replicas does not increase the sample
+// frequency.
+func dedupSamples(a, b []json.RawMessage) []json.RawMessage {
+	if len(a) == 0 {
+		return b
+	}
+	if len(b) == 0 {
+		return a
+	}
+
+	ta, tb := sampleTimes(a), sampleTimes(b)
+	merged := make([]json.RawMessage, 0, len(a))
+
+	var (
+		i, j       int
+		penA, penB int64
+		lastT      int64 = math.MinInt64
+	)
+	for {
+		// Skip samples up to the last timestamp plus the penalty
+		for i < len(a) && ta[i] <= lastT+penA {
+			i++
+		}
+		for j < len(b) && tb[j] <= lastT+penB {
+			j++
+		}
+
+		switch {
+		case i == len(a) && j == len(b):
+			return merged
+		case i == len(a):
+			merged = append(merged, b[j])
+			lastT, penB = tb[j], 0
+			continue
+		case j == len(b):
+			merged = append(merged, a[i])
+			lastT, penA = ta[i], 0
+			continue
+		}
+
+		if ta[i] <= tb[j] {
+			penB = penalty(ta[i], lastT)
+			penA = 0
+			lastT = ta[i]
+			merged = append(merged, a[i])
+		} else {
+			penA = penalty(tb[j], lastT)
+			penB = 0
+			lastT = tb[j]
+			merged = append(merged, b[j])
+		}
+	}
+}
+
+// penalty returns the penalty for the replica that was not picked
+func penalty(t, lastT int64) int64 {
+	if lastT == math.MinInt64 {
+		return initialPenalty
+	}
+	return 2 * (t - lastT)
+}
+
+// sampleTimes returns the timestamps of samples in milliseconds. Samples
+// are encoded as [<unix seconds>, <value>].
+func sampleTimes(samples []json.RawMessage) []int64 {
+	times := make([]int64, len(samples))
+	for i, raw := range samples {
+		var sample []json.RawMessage
+		if err := json.Unmarshal(raw, &sample); err != nil || len(sample) == 0 {
+			continue
+		}
+		seconds, err := strconv.ParseFloat(string(sample[0]), 64)
+		if err != nil {
+			continue
+		}
+		times[i] = int64(math.Round(seconds * 1000))
+	}
+	return times
+}
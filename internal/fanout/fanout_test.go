@@ -0,0 +1,317 @@
+package fanout
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestScopeQuery(t *testing.T) {
+	external := map[string]string{"cluster": "eu"}
+
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		matches bool
+	}{
+		{
+			name:    "no external label matchers",
+			query:   `up{job="node"}`,
+			want:    `up{job="node"}`,
+			matches: true,
+		},
+		{
+			name:    "matching external label is removed",
+			query:   `up{cluster="eu",job="node"}`,
+			want:    `up{job="node"}`,
+			matches: true,
+		},
+		{
+			name:    "matching regexp",
+			query:   `sum(rate(http_requests_total{cluster=~"eu|us"}[5m]))`,
+			want:    `sum(rate(http_requests_total[5m]))`,
+			matches: true,
+		},
+		{
+			name:    "non-matching external label",
+			query:   `up{cluster="us"}`,
+			want:    `up{__name__!~".*"}`,
+			matches: false,
+		},
+		{
+			name:    "one of two selectors matches",
+			query:   `up{cluster="us"} or up{cluster!="us"}`,
+			want:    `up{__name__!~".*"} or up`,
+			matches: true,
+		},
+		{
+			name:    "only external label matchers",
+			query:   `{cluster="eu"}`,
+			want:    `{__name__=~".+"}`,
+			matches: true,
+		},
+		{
+			name:    "no selectors",
+			query:   `vector(1)`,
+			want:    `vector(1)`,
+			matches: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, matches, err := ScopeQuery(tt.query, external)
+			if err != nil {
+				t.Fatalf("ScopeQuery() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ScopeQuery() = %q, want %q", got, tt.want)
+			}
+			if matches != tt.matches {
+				t.Errorf("ScopeQuery() matches = %v, want %v", matches, tt.matches)
+			}
+		})
+	}
+}
+
+func TestMergeVector(t *testing.T) {
+	merger := &Merger{Endpoint: EndpointQuery}
+	status, body := merger.Merge([]Response{
+		{
+			Upstream:       "eu",
+			ExternalLabels: map[string]string{"cluster": "eu"},
+			StatusCode:     http.StatusOK,
+			Body:           []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up","cluster":"old"},"value":[1700000000,"1"]}]}}`),
+		},
+		{
+			Upstream:       "us",
+			ExternalLabels: map[string]string{"cluster": "us"},
+			StatusCode:     http.StatusOK,
+			Body:           []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"__name__":"up"},"value":[1700000000,"0"]}]},"warnings":["slow"]}`),
+		},
+	})
+
+	if status != http.StatusOK {
+		t.Fatalf("Merge() status = %d, want %d", status, http.StatusOK)
+	}
+
+	var resp struct {
+		Status string `json:"status"`
+		Data   struct {
+			ResultType string `json:"resultType"`
+			Result     []struct {
+				Metric map[string]string `json:"metric"`
+			} `json:"result"`
+		} `json:"data"`
+		Warnings []string `json:"warnings"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("invalid merged response: %v", err)
+	}
+
+	if resp.Data.ResultType != "vector" || len(resp.Data.Result) != 2 {
+		t.Fatalf("Merge() data = %s", body)
+	}
+	if got := resp.Data.Result[0].Metric["cluster"]; got != "eu" {
+		t.Errorf("first series cluster = %q, want %q", got, "eu")
+	}
+	if got := resp.Data.Result[1].Metric["cluster"]; got != "us" {
+		t.Errorf("second series cluster = %q, want %q", got, "us")
+	}
+	if !reflect.DeepEqual(resp.Warnings, []string{"slow"}) {
+		t.Errorf("Merge() warnings = %v, want [slow]", resp.Warnings)
+	}
+}
+
+func TestMergePartialFailure(t *testing.T) {
+	merger := &Merger{Endpoint: EndpointLabels}
+	status, body := merger.Merge([]Response{
+		{
+			Upstream:       "eu",
+			ExternalLabels: map[string]string{"cluster": "eu"},
+			StatusCode:     http.StatusOK,
+			Body:           []byte(`{"status":"success","data":["job","instance"]}`),
+		},
+		{
+			Upstream: "us",
+			Err:      errors.New("connection refused"),
+		},
+	})
+
+	if status != http.StatusOK {
+		t.Fatalf("Merge() status = %d, want %d", status, http.StatusOK)
+	}
+
+	var resp struct {
+		Data     []string `json:"data"`
+		Warnings []string `json:"warnings"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("invalid merged response: %v", err)
+	}
+
+	if want := []string{"cluster", "instance", "job"}; !reflect.DeepEqual(resp.Data, want) {
+		t.Errorf("Merge() data = %v, want %v", resp.Data, want)
+	}
+	if want := []string{"upstream us: connection refused"}; !reflect.DeepEqual(resp.Warnings, want) {
+		t.Errorf("Merge() warnings = %v, want %v", resp.Warnings, want)
+	}
+}
+
+func TestMergeAllFailed(t *testing.T) {
+	upstreamErr := []byte(`{"status":"error","errorType":"bad_data","error":"parse error"}`)
+
+	merger := &Merger{Endpoint: EndpointQuery}
+	status, body := merger.Merge([]Response{
+		{Upstream: "eu", StatusCode: http.StatusBadRequest, Body: upstreamErr},
+		{Upstream: "us", Err: errors.New("connection refused")},
+	})
+
+	if status != http.StatusBadRequest {
+		t.Errorf("Merge() status = %d, want %d", status, http.StatusBadRequest)
+	}
+	if string(body) != string(upstreamErr) {
+		t.Errorf("Merge() body = %s, want %s", body, upstreamErr)
+	}
+}
+
+func TestMergeLabelValues(t *testing.T) {
+	merger := &Merger{Endpoint: EndpointLabelValues, LabelName: LabelNameFromPath("/api/v1/label/cluster/values")}
+	_, body := merger.Merge([]Response{
+		{Upstream: "eu", ExternalLabels: map[string]string{"cluster": "eu"}, Body: []byte(`{"status":"success","data":[]}`)},
+		{Upstream: "us", ExternalLabels: map[string]string{"cluster": "us"}, Body: []byte(`{"status":"success","data":[]}`)},
+	})
+
+	var resp struct {
+		Data []string `json:"data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("invalid merged response: %v", err)
+	}
+	if want := []string{"eu", "us"}; !reflect.DeepEqual(resp.Data, want) {
+		t.Errorf("Merge() data = %v, want %v", resp.Data, want)
+	}
+}
+
+func TestDedupSamples(t *testing.T) {
+	samples := func(times ...int) []json.RawMessage {
+		var raw []json.RawMessage
+		for _, ts := range times {
+			raw = append(raw, json.RawMessage(`[`+strconv.Itoa(ts)+`,"1"]`))
+		}
+		return raw
+	}
+
+	tests := []struct {
+		name string
+		a, b []json.RawMessage
+		want []json.RawMessage
+	}{
+		{
+			name: "identical replicas",
+			a:    samples(0, 15, 30, 45),
+			b:    samples(0, 15, 30, 45),
+			want: samples(0, 15, 30, 45),
+		},
+		{
+			name: "gap filled from other replica after penalty",
+			a:    samples(0, 15, 90, 105),
+			b:    samples(0, 15, 30, 45, 60, 75, 90, 105),
+			want: samples(0, 15, 60, 75, 90, 105),
+		},
+		{
+			name: "offset replica does not increase sample frequency",
+			a:    samples(0, 15, 30),
+			b:    samples(5, 20, 35, 50, 65, 80),
+			want: samples(0, 15, 30, 65, 80),
+		},
+		{
+			name: "empty replica",
+			a:    nil,
+			b:    samples(0, 15),
+			want: samples(0, 15),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := dedupSamples(tt.a, tt.b)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dedupSamples() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeDedup(t *testing.T) {
+	merger := &Merger{Endpoint: EndpointQueryRange, ReplicaLabel: "replica"}
+	status, body := merger.Merge([]Response{
+		{
+			Upstream:       "eu-a",
+			ExternalLabels: map[string]string{"cluster": "eu", "replica": "a"},
+			Body:           []byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[0,"1"],[15,"1"]]}]}}`),
+		},
+		{
+			Upstream:       "eu-b",
+			ExternalLabels: map[string]string{"cluster": "eu", "replica": "b"},
+			Body:           []byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up"},"values":[[0,"1"],[15,"1"],[60,"1"],[75,"1"]]}]}}`),
+		},
+	})
+
+	if status != http.StatusOK {
+		t.Fatalf("Merge() status = %d, want %d", status, http.StatusOK)
+	}
+
+	want := `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up","cluster":"eu"},"values":[[0,"1"],[15,"1"],[60,"1"],[75,"1"]]}]}}`
+	if string(body) != want {
+		t.Errorf("Merge() = %s, want %s", body, want)
+	}
+}
+
+func TestMergePreservesValues(t *testing.T) {
+	merger := &Merger{Endpoint: EndpointQuery}
+	_, body := merger.Merge([]Response{
+		{
+			Upstream:       "eu",
+			ExternalLabels: map[string]string{"cluster": "eu"},
+			Body:           []byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"path":"/a?b=1&c=<d>"},"value":[1700000000.123,"1e-7"]}]}}`),
+		},
+	})
+
+	want := `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"cluster":"eu","path":"/a?b=1&c=<d>"},"value":[1700000000.123,"1e-7"]}]}}`
+	if string(body) != want {
+		t.Errorf("Merge() = %s, want %s", body, want)
+	}
+}
+
+func TestConcat(t *testing.T) {
+	status, body := Concat([]Response{
+		{
+			StatusCode: http.StatusOK,
+			Body:       []byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"a"},"values":[[1,"1"]]}]},"warnings":["slow"]}`),
+		},
+		{
+			StatusCode: http.StatusOK,
+			Body:       []byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"b"},"values":[[2,"3"]]},{"metric":{"job":"a"},"values":[[2,"2"]]}]},"warnings":["slow"]}`),
+		},
+	})
+
+	want := `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"job":"a"},"values":[[1,"1"],[2,"2"]]},{"metric":{"job":"b"},"values":[[2,"3"]]}]},"warnings":["slow"]}`
+	if status != http.StatusOK || string(body) != want {
+		t.Errorf("Concat() = %d, %s, want 200, %s", status, body, want)
+	}
+
+	// A failed range fails the whole query
+	upstreamErr := []byte(`{"status":"error","errorType":"timeout","error":"query timed out"}`)
+	status, body = Concat([]Response{
+		{StatusCode: http.StatusOK, Body: []byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`)},
+		{StatusCode: http.StatusServiceUnavailable, Body: upstreamErr},
+	})
+	if status != http.StatusServiceUnavailable || string(body) != string(upstreamErr) {
+		t.Errorf("Concat() = %d, %s, want 503, %s", status, body, upstreamErr)
+	}
+}
@@ -0,0 +1,308 @@
+package fanout
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/promapi"
+)
+
+// Endpoint represents a Prometheus API endpoint that supports fan-out
+type Endpoint int
+
+const (
+	EndpointQuery Endpoint = iota
+	EndpointQueryRange
+	EndpointSeries
+	EndpointLabels
+	EndpointLabelValues
+)
+
+// EndpointFor returns the fan-out endpoint for a request path
+func EndpointFor(urlPath string) (Endpoint, bool) {
+	switch urlPath {
+	case "/api/v1/query":
+		return EndpointQuery, true
+	case "/api/v1/query_range":
+		return EndpointQueryRange, true
+	case "/api/v1/series":
+		return EndpointSeries, true
+	case "/api/v1/labels":
+		return EndpointLabels, true
+	}
+	if ok, _ := path.Match("/api/v1/label/*/values", urlPath); ok {
+		return EndpointLabelValues, true
+	}
+	return 0, false
+}
+
+// Response is the response of a single upstream
+type Response struct {
+	Upstream       string
+	ExternalLabels map[string]string
+	StatusCode     int
+	// Header holds the headers of the response that are passed on to
+	// clients sharing it
+	Header http.Header
+	Body   []byte
+	Err    error
+}
+
+// queryData is the data of query and query_range responses
+type queryData struct {
+	ResultType string            `json:"resultType"`
+	Result     []json.RawMessage `json:"result"`
+}
+
+// Merger merges the responses of several upstreams
+type Merger struct {
+	Endpoint Endpoint
+	// LabelName is the label of a label values request
+	LabelName string
+	// ReplicaLabel is the label distinguishing replicas of an HA pair. If
+	// set, series that only differ in it are deduplicated.
+	ReplicaLabel string
+}
+
+// Merge combines the upstream responses into a single response. Failed
+// upstreams are reported in the warnings of the merged response. If all
+// upstreams failed, the error of the first one is returned as is.
+func (m *Merger) Merge(responses []Response) (int, []byte) {
+	var (
+		succeeded []parsedResponse
+		warnings  []string
+		infos     []string
+		firstErr  *Response
+	)
+
+	for i := range responses {
+		resp := &responses[i]
+		parsed, err := parseResponse(resp)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("upstream %s: %v", resp.Upstream, err))
+			if firstErr == nil {
+				firstErr = resp
+			}
+			continue
+		}
+		succeeded = append(succeeded, parsed)
+		warnings = append(warnings, parsed.api.Warnings...)
+		infos = append(infos, parsed.api.Infos...)
+	}
+
+	if len(succeeded) == 0 {
+		return failure(firstErr)
+	}
+
+	data, err := m.mergeData(succeeded)
+	if err != nil {
+		return http.StatusBadGateway, promapi.ErrorBody(promapi.ErrorInternal, err.Error())
+	}
+
+	body, _ := promapi.Marshal(promapi.Response{
+		Status:   "success",
+		Data:     data,
+		Warnings: warnings,
+		Infos:    infos,
+	})
+	return http.StatusOK, body
+}
+
+// parsedResponse is a successful upstream response
+type parsedResponse struct {
+	upstream       string
+	externalLabels map[string]string
+	api            promapi.Response
+}
+
+// parseResponse decodes an upstream response, returning an error if the
+// upstream failed
+func parseResponse(resp *Response) (parsedResponse, error) {
+	if resp.Err != nil {
+		return parsedResponse{}, resp.Err
+	}
+
+	var api promapi.Response
+	if err := json.Unmarshal(resp.Body, &api); err != nil {
+		return parsedResponse{}, fmt.Errorf("invalid response (status %d): %w", resp.StatusCode, err)
+	}
+	if api.Status != "success" {
+		return parsedResponse{}, fmt.Errorf("%s: %s", api.ErrorType, api.Error)
+	}
+
+	return parsedResponse{upstream: resp.Upstream, externalLabels: resp.ExternalLabels, api: api}, nil
+}
+
+// failure returns the response of a failed upstream
+func failure(resp *Response) (int, []byte) {
+	if resp.Err != nil {
+		status, errorType := promapi.UpstreamErrorStatus(resp.Err)
+		return status, promapi.ErrorBody(errorType, fmt.Sprintf("upstream %s: %v", resp.Upstream, resp.Err))
+	}
+	return resp.StatusCode, resp.Body
+}
+
+// mergeData merges the data of the successful responses
+func (m *Merger) mergeData(responses []parsedResponse) (json.RawMessage, error) {
+	switch m.Endpoint {
+	case EndpointQuery, EndpointQueryRange:
+		return mergeQueryData(responses, m.ReplicaLabel)
+	case EndpointSeries:
+		return mergeSeries(responses, m.ReplicaLabel)
+	case EndpointLabels:
+		return mergeStrings(responses, func(r parsedResponse) []string {
+			names := make([]string, 0, len(r.externalLabels))
+			for name := range r.externalLabels {
+				names = append(names, name)
+			}
+			return names
+		}, m.ReplicaLabel)
+	case EndpointLabelValues:
+		return mergeStrings(responses, func(r parsedResponse) []string {
+			if value, ok := r.externalLabels[m.LabelName]; ok {
+				return []string{value}
+			}
+			return nil
+		}, "")
+	}
+	return nil, fmt.Errorf("unsupported endpoint %d", m.Endpoint)
+}
+
+// mergeQueryData concatenates vector and matrix results, adding each
+// upstream's external labels to its series and deduplicating replicas if a
+// replica label is given. Scalar and string results cannot be merged, so
+// the first one is returned.
+func mergeQueryData(responses []parsedResponse, replicaLabel string) (json.RawMessage, error) {
+	var merged *queryData
+
+	for _, r := range responses {
+		var data queryData
+		if err := json.Unmarshal(r.api.Data, &data); err != nil {
+			return nil, fmt.Errorf("invalid query data from upstream %s: %w", r.upstream, err)
+		}
+
+		if data.ResultType != "vector" && data.ResultType != "matrix" {
+			return r.api.Data, nil
+		}
+		if merged == nil {
+			merged = &queryData{ResultType: data.ResultType, Result: []json.RawMessage{}}
+		}
+		if data.ResultType != merged.ResultType {
+			return nil, fmt.Errorf("upstream %s returned %s result, expected %s", r.upstream, data.ResultType, merged.ResultType)
+		}
+
+		for _, raw := range data.Result {
+			series, err := addExternalLabels(raw, "metric", r.externalLabels)
+			if err != nil {
+				return nil, fmt.Errorf("invalid series from upstream %s: %w", r.upstream, err)
+			}
+			merged.Result = append(merged.Result, series)
+		}
+	}
+
+	if replicaLabel != "" {
+		result, err := dedupResult(merged.Result, replicaLabel)
+		if err != nil {
+			return nil, fmt.Errorf("failed to deduplicate result: %w", err)
+		}
+		merged.Result = result
+	}
+
+	return promapi.Marshal(merged)
+}
+
+// addExternalLabels adds the external labels to the label set found under
+// key in the raw JSON object. An empty key means the object is the label set.
+func addExternalLabels(raw json.RawMessage, key string, externalLabels map[string]string) (json.RawMessage, error) {
+	if len(externalLabels) == 0 {
+		return raw, nil
+	}
+
+	if key == "" {
+		var labels map[string]string
+		if err := json.Unmarshal(raw, &labels); err != nil {
+			return nil, err
+		}
+		for name, value := range externalLabels {
+			labels[name] = value
+		}
+		return promapi.Marshal(labels)
+	}
+
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	labels, err := addExternalLabels(obj[key], "", externalLabels)
+	if err != nil {
+		return nil, err
+	}
+	obj[key] = labels
+	return promapi.Marshal(obj)
+}
+
+// mergeSeries concatenates series, adding each upstream's external labels
+// and deduplicating replicas if a replica label is given
+func mergeSeries(responses []parsedResponse, replicaLabel string) (json.RawMessage, error) {
+	merged := []json.RawMessage{}
+	for _, r := range responses {
+		var series []json.RawMessage
+		if err := json.Unmarshal(r.api.Data, &series); err != nil {
+			return nil, fmt.Errorf("invalid series data from upstream %s: %w", r.upstream, err)
+		}
+		for _, raw := range series {
+			labels, err := addExternalLabels(raw, "", r.externalLabels)
+			if err != nil {
+				return nil, fmt.Errorf("invalid series from upstream %s: %w", r.upstream, err)
+			}
+			merged = append(merged, labels)
+		}
+	}
+
+	if replicaLabel != "" {
+		deduped, err := dedupSeries(merged, replicaLabel)
+		if err != nil {
+			return nil, fmt.Errorf("failed to deduplicate series: %w", err)
+		}
+		merged = deduped
+	}
+
+	return promapi.Marshal(merged)
+}
+
+// mergeStrings returns the sorted union of string lists, such as label
+// names or values, including extra values for each upstream and excluding
+// the given value
+func mergeStrings(responses []parsedResponse, extra func(parsedResponse) []string, exclude string) (json.RawMessage, error) {
+	set := make(map[string]bool)
+	for _, r := range responses {
+		var values []string
+		if err := json.Unmarshal(r.api.Data, &values); err != nil {
+			return nil, fmt.Errorf("invalid data from upstream %s: %w", r.upstream, err)
+		}
+		for _, v := range append(values, extra(r)...) {
+			set[v] = true
+		}
+	}
+
+	if exclude != "" {
+		delete(set, exclude)
+	}
+
+	merged := make([]string, 0, len(set))
+	for v := range set {
+		merged = append(merged, v)
+	}
+	sort.Strings(merged)
+	return promapi.Marshal(merged)
+}
+
+// LabelNameFromPath returns the label name of a label values request path
+func LabelNameFromPath(urlPath string) string {
+	name := strings.TrimSuffix(strings.TrimPrefix(urlPath, "/api/v1/label/"), "/values")
+	return name
+}
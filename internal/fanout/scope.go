@@ -0,0 +1,86 @@
+package fanout
+
+import (
+	"regexp"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/promql"
+)
+
+var (
+	// noMatch is added to selectors that cannot match an upstream's series
+	noMatch = promql.Matcher{Name: "__name__", Type: promql.MatchNotRegexp, Value: ".*"}
+
+	// anyMetric replaces the matchers of selectors that only matched on
+	// external labels, as Prometheus rejects empty selectors
+	anyMetric = promql.Matcher{Name: "__name__", Type: promql.MatchRegexp, Value: ".+"}
+)
+
+// ScopeQuery prepares a query for an upstream with the given external
+// labels. Matchers on external labels are evaluated against the upstream's
+// values and removed, since the upstream's series don't carry them.
+// Selectors whose external label matchers don't match are changed to match
+// nothing. The returned bool is false if no selector can match, in which
+// case the upstream does not need to be queried.
+func ScopeQuery(query string, externalLabels map[string]string) (string, bool, error) {
+	if len(externalLabels) == 0 {
+		return query, true, nil
+	}
+
+	selectors, matching := 0, 0
+	scoped, err := promql.RewriteSelectors(query, func(sel *promql.Selector) error {
+		selectors++
+		groupMatches := false
+
+		for i, group := range sel.Groups {
+			kept := group[:0:0]
+			matches := true
+			for _, m := range group {
+				value, ok := externalLabels[m.Name]
+				if !ok {
+					kept = append(kept, m)
+					continue
+				}
+				if !matchValue(m, value) {
+					matches = false
+				}
+			}
+			switch {
+			case !matches:
+				kept = append(kept, noMatch)
+			case len(kept) == 0 && sel.MetricName == "":
+				kept = append(kept, anyMetric)
+				groupMatches = true
+			default:
+				groupMatches = true
+			}
+			sel.Groups[i] = kept
+		}
+
+		if groupMatches || len(sel.Groups) == 0 {
+			matching++
+		}
+		return nil
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	return scoped, selectors == 0 || matching > 0, nil
+}
+
+// matchValue reports whether the matcher matches the value
+func matchValue(m promql.Matcher, value string) bool {
+	switch m.Type {
+	case promql.MatchEqual:
+		return value == m.Value
+	case promql.MatchNotEqual:
+		return value != m.Value
+	case promql.MatchRegexp, promql.MatchNotRegexp:
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return false
+		}
+		return re.MatchString(value) == (m.Type == promql.MatchRegexp)
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package fileutil
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// checkInterval limits how often the files are checked for changes
+const checkInterval = time.Second
+
+// Reloader caches a value loaded from a set of files and reloads it when
+// the modification time or size of any of the files changes
+type Reloader[T any] struct {
+	files []string
+	load  func() (T, error)
+
+	mu      sync.Mutex
+	value   T
+	stamps  []fileStamp
+	checked time.Time
+}
+
+// fileStamp identifies a version of a file
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewReloader creates a Reloader and performs the initial load
+func NewReloader[T any](load func() (T, error), files ...string) (*Reloader[T], error) {
+	r := &Reloader[T]{files: files, load: load}
+
+	stamps, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	value, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	r.value = value
+	r.stamps = stamps
+	r.checked = time.Now()
+	return r, nil
+}
+
+// Get returns the current value, reloading it if the files have changed.
+// If reloading fails the previously loaded value is kept.
+func (r *Reloader[T]) Get() T {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) < checkInterval {
+		return r.value
+	}
+	r.checked = time.Now()
+
+	stamps, err := r.stat()
+	if err != nil || !r.changed(stamps) {
+		return r.value
+	}
+
+	value, err := r.load()
+	if err != nil {
+		return r.value
+	}
+	r.value = value
+	r.stamps = stamps
+	return r.value
+}
+
+// stat returns the current stamps of all files
+func (r *Reloader[T]) stat() ([]fileStamp, error) {
+	stamps := make([]fileStamp, len(r.files))
+	for i, file := range r.files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		stamps[i] = fileStamp{modTime: info.ModTime(), size: info.Size()}
+	}
+	return stamps, nil
+}
+
+// changed returns true if any stamp differs from the loaded ones
+func (r *Reloader[T]) changed(stamps []fileStamp) bool {
+	for i := range stamps {
+		if !stamps[i].modTime.Equal(r.stamps[i].modTime) || stamps[i].size != r.stamps[i].size {
+			return true
+		}
+	}
+	return false
+}
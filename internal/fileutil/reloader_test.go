@@ -0,0 +1,135 @@
+package fileutil
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeFile writes a file with a new modification time, so it is reloaded
+// even if the size did not change
+func writeFile(t *testing.T, name, data string) {
+	t.Helper()
+
+	modTime := time.Now()
+	if info, err := os.Stat(name); err == nil {
+		modTime = info.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(name, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSecret(t *testing.T) {
+	tests := []struct {
+		name   string
+		rotate func(t *testing.T, file string)
+		want   string
+	}{
+		{
+			name:   "unchanged",
+			rotate: func(*testing.T, string) {},
+			want:   "first",
+		},
+		{
+			name:   "rotated",
+			rotate: func(t *testing.T, file string) { writeFile(t, file, "  second\n") },
+			want:   "second",
+		},
+		{
+			name:   "same size",
+			rotate: func(t *testing.T, file string) { writeFile(t, file, "third\n") },
+			want:   "third",
+		},
+		{
+			name: "removed",
+			rotate: func(t *testing.T, file string) {
+				if err := os.Remove(file); err != nil {
+					t.Fatal(err)
+				}
+			},
+			want: "first",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "secret")
+			writeFile(t, file, "first\n")
+
+			secret, err := NewSecret(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := secret.Value(); got != "first" {
+				t.Fatalf("initial Value() = %q, want first", got)
+			}
+
+			tt.rotate(t, file)
+			// Check the file again right away
+			secret.r.checked = time.Time{}
+			if got := secret.Value(); got != tt.want {
+				t.Errorf("Value() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	files := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}
+	for _, file := range files {
+		writeFile(t, file, "1")
+	}
+
+	var loads int
+	var loadErr error
+	r, err := NewReloader(func() (int, error) {
+		if loadErr != nil {
+			return 0, loadErr
+		}
+		loads++
+		return loads, nil
+	}, files...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes are only picked up after the check interval
+	writeFile(t, files[1], "2")
+	if got := r.Get(); got != 1 {
+		t.Errorf("Get() = %d within the check interval, want 1", got)
+	}
+	r.checked = time.Time{}
+	if got := r.Get(); got != 2 {
+		t.Errorf("Get() = %d after a file changed, want 2", got)
+	}
+
+	// Unchanged files are not loaded again
+	r.checked = time.Time{}
+	if got := r.Get(); got != 2 {
+		t.Errorf("Get() = %d with unchanged files, want 2", got)
+	}
+
+	// A failed load keeps the previous value and is retried
+	loadErr = errors.New("invalid content")
+	writeFile(t, files[0], "3")
+	r.checked = time.Time{}
+	if got := r.Get(); got != 2 {
+		t.Errorf("Get() = %d after a failed load, want 2", got)
+	}
+	loadErr = nil
+	r.checked = time.Time{}
+	if got := r.Get(); got != 3 {
+		t.Errorf("Get() = %d after the load succeeded, want 3", got)
+	}
+
+	if _, err := NewReloader(func() (int, error) { return 0, nil }, filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
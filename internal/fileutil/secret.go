@@ -0,0 +1,34 @@
+package fileutil
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Secret is a value read from a file, such as a password or bearer token,
+// that is re-read when the file changes so credentials can be rotated
+type Secret struct {
+	r *Reloader[string]
+}
+
+// NewSecret reads the secret from the given file. Surrounding whitespace
+// is trimmed.
+func NewSecret(file string) (*Secret, error) {
+	r, err := NewReloader(func() (string, error) {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}, file)
+	if err != nil {
+		return nil, err
+	}
+	return &Secret{r: r}, nil
+}
+
+// Value returns the current secret
+func (s *Secret) Value() string {
+	return s.r.Get()
+}
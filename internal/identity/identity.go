@@ -0,0 +1,54 @@
+package identity
+
+import (
+	"context"
+	"crypto/x509"
+	"net/http"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+type identityKey struct{}
+
+// NewContext returns a copy of ctx carrying the client identity
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// FromContext returns the client identity stored in ctx, if any
+func FromContext(ctx context.Context) string {
+	id, _ := ctx.Value(identityKey{}).(string)
+	return id
+}
+
+// FromRequest returns the identity of the client certificate presented with
+// the request. Only certificates verified against the client CA are used.
+func FromRequest(r *http.Request, field config.IdentityField) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return FromCertificate(r.TLS.VerifiedChains[0][0], field)
+}
+
+// FromCertificate maps a certificate to an identity using the given field
+func FromCertificate(cert *x509.Certificate, field config.IdentityField) string {
+	switch field {
+	case config.IdentityFieldSubject:
+		return cert.Subject.String()
+	case config.IdentityFieldDNSName:
+		if len(cert.DNSNames) > 0 {
+			return cert.DNSNames[0]
+		}
+	case config.IdentityFieldEmail:
+		if len(cert.EmailAddresses) > 0 {
+			return cert.EmailAddresses[0]
+		}
+	case config.IdentityFieldURI:
+		if len(cert.URIs) > 0 {
+			return cert.URIs[0].String()
+		}
+	default:
+		return cert.Subject.CommonName
+	}
+	return ""
+}
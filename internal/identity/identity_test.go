@@ -0,0 +1,95 @@
+package identity
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+func TestFromCertificate(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "grafana", Organization: []string{"Monitoring"}},
+		DNSNames:       []string{"grafana.example.com", "grafana"},
+		EmailAddresses: []string{"grafana@example.com"},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "example.com", Path: "/ns/monitoring/sa/grafana"}},
+	}
+
+	tests := []struct {
+		name  string
+		cert  *x509.Certificate
+		field config.IdentityField
+		want  string
+	}{
+		{name: "default", cert: cert, want: "grafana"},
+		{name: "common name", cert: cert, field: config.IdentityFieldCommonName, want: "grafana"},
+		{name: "subject", cert: cert, field: config.IdentityFieldSubject, want: "CN=grafana,O=Monitoring"},
+		{name: "dns name", cert: cert, field: config.IdentityFieldDNSName, want: "grafana.example.com"},
+		{name: "email", cert: cert, field: config.IdentityFieldEmail, want: "grafana@example.com"},
+		{name: "uri", cert: cert, field: config.IdentityFieldURI, want: "spiffe://example.com/ns/monitoring/sa/grafana"},
+		{name: "missing dns name", cert: &x509.Certificate{}, field: config.IdentityFieldDNSName, want: ""},
+		{name: "missing email", cert: &x509.Certificate{}, field: config.IdentityFieldEmail, want: ""},
+		{name: "missing uri", cert: &x509.Certificate{}, field: config.IdentityFieldURI, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := FromCertificate(tt.cert, tt.field); got != tt.want {
+				t.Errorf("FromCertificate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFromRequest(t *testing.T) {
+	client := &x509.Certificate{Subject: pkix.Name{CommonName: "grafana"}}
+	ca := &x509.Certificate{Subject: pkix.Name{CommonName: "ca"}}
+
+	tests := []struct {
+		name  string
+		state *tls.ConnectionState
+		want  string
+	}{
+		{name: "plain HTTP", state: nil, want: ""},
+		{name: "no client certificate", state: &tls.ConnectionState{}, want: ""},
+		{
+			name:  "unverified certificate",
+			state: &tls.ConnectionState{PeerCertificates: []*x509.Certificate{client}},
+			want:  "",
+		},
+		{
+			name: "verified certificate",
+			state: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{client},
+				VerifiedChains:   [][]*x509.Certificate{{client, ca}},
+			},
+			want: "grafana",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			req.TLS = tt.state
+			if got := FromRequest(req, config.IdentityFieldCommonName); got != tt.want {
+				t.Errorf("FromRequest() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	if got := FromContext(ctx); got != "" {
+		t.Errorf("FromContext() = %q without an identity", got)
+	}
+	if got := FromContext(NewContext(ctx, "grafana")); got != "grafana" {
+		t.Errorf("FromContext() = %q, want grafana", got)
+	}
+}
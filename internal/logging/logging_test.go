@@ -0,0 +1,135 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		level   string
+		want    slog.Level
+		wantErr bool
+	}{
+		{level: "debug", want: slog.LevelDebug},
+		{level: "info", want: slog.LevelInfo},
+		{level: "warn", want: slog.LevelWarn},
+		{level: "error", want: slog.LevelError},
+		{level: "ERROR", want: slog.LevelError},
+		{level: " info ", want: slog.LevelInfo},
+		{level: "verbose", wantErr: true},
+		{level: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			got, err := ParseLevel(tt.level)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseLevel(%q) error = %v, wantErr %v", tt.level, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("ParseLevel(%q) = %v, want %v", tt.level, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  Format
+		level   string
+		wantErr bool
+	}{
+		{name: "text", format: FormatText, level: "info"},
+		{name: "json", format: FormatJSON, level: "debug"},
+		{name: "default format", format: "", level: "warn"},
+		{name: "unknown format", format: "xml", level: "info", wantErr: true},
+		{name: "unknown level", format: FormatText, level: "verbose", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logger, err := New(&bytes.Buffer{}, tt.format, tt.level)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && logger == nil {
+				t.Error("New() returned a nil logger")
+			}
+		})
+	}
+}
+
+func TestContextHandler(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	sc := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID})
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want map[string]string
+	}{
+		{
+			name: "request ID and trace",
+			ctx:  trace.ContextWithSpanContext(WithRequestID(context.Background(), "abc"), sc),
+			want: map[string]string{
+				"request_id": "abc",
+				"trace_id":   "4bf92f3577b34da6a3ce929d0e0e4736",
+				"span_id":    "00f067aa0ba902b7",
+			},
+		},
+		{
+			name: "request ID only",
+			ctx:  WithRequestID(context.Background(), "abc"),
+			want: map[string]string{"request_id": "abc"},
+		},
+		{
+			name: "empty context",
+			ctx:  context.Background(),
+			want: map[string]string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			logger, err := New(&buf, FormatJSON, "info")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Attributes and groups keep the context handler
+			logger.With("component", "test").InfoContext(tt.ctx, "message")
+
+			var record map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+				t.Fatalf("invalid log line %q: %v", buf.String(), err)
+			}
+			for _, key := range []string{"request_id", "trace_id", "span_id"} {
+				got, _ := record[key].(string)
+				if got != tt.want[key] {
+					t.Errorf("%s = %q, want %q", key, got, tt.want[key])
+				}
+			}
+			if record["component"] != "test" {
+				t.Errorf("component = %v, want test", record["component"])
+			}
+		})
+	}
+}
+
+func TestNewRequestID(t *testing.T) {
+	a, b := NewRequestID(), NewRequestID()
+	if len(a) != 16 {
+		t.Errorf("request ID %q has %d characters, want 16", a, len(a))
+	}
+	if a == b {
+		t.Errorf("request IDs are not unique: %q", a)
+	}
+}
@@ -0,0 +1,92 @@
+package promapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// ErrorType is the errorType of a Prometheus API error response
+type ErrorType string
+
+// Error types used by the Prometheus API
+const (
+	ErrorTimeout     ErrorType = "timeout"
+	ErrorExec        ErrorType = "execution"
+	ErrorBadData     ErrorType = "bad_data"
+	ErrorInternal    ErrorType = "internal"
+	ErrorUnavailable ErrorType = "unavailable"
+	ErrorNotFound    ErrorType = "not_found"
+)
+
+// Response is the envelope of Prometheus API responses
+type Response struct {
+	Status    string          `json:"status"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	ErrorType ErrorType       `json:"errorType,omitempty"`
+	Error     string          `json:"error,omitempty"`
+	Warnings  []string        `json:"warnings,omitempty"`
+	Infos     []string        `json:"infos,omitempty"`
+}
+
+// ErrorTypeForStatus returns the error type matching an HTTP status code,
+// following the status codes the Prometheus API uses for each error type
+func ErrorTypeForStatus(status int) ErrorType {
+	switch {
+	case status == http.StatusNotFound:
+		return ErrorNotFound
+	case status == http.StatusUnprocessableEntity:
+		return ErrorExec
+	case status == http.StatusServiceUnavailable, status == http.StatusBadGateway, status == http.StatusTooManyRequests:
+		return ErrorUnavailable
+	case status == http.StatusGatewayTimeout:
+		return ErrorTimeout
+	case status >= 400 && status < 500:
+		return ErrorBadData
+	}
+	return ErrorInternal
+}
+
+// UpstreamErrorStatus returns the status code and error type for an error
+// reaching the upstream: 504 for timeouts, else 502
+func UpstreamErrorStatus(err error) (int, ErrorType) {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout, ErrorTimeout
+	}
+	return http.StatusBadGateway, ErrorUnavailable
+}
+
+// ErrorBody returns the body of an API error response
+func ErrorBody(errorType ErrorType, message string) []byte {
+	body, _ := json.Marshal(Response{Status: "error", ErrorType: errorType, Error: message})
+	return body
+}
+
+// Marshal encodes v as JSON. Unlike json.Marshal, it does not escape HTML
+// characters, which are common in label values and PromQL expressions, so
+// they are returned as Prometheus returns them.
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), nil
+}
+
+// WriteError writes an API error response
+func WriteError(w http.ResponseWriter, status int, errorType ErrorType, message string) {
+	body := ErrorBody(errorType, message)
+
+	// Drop headers meant for the response that is being replaced
+	w.Header().Del("Content-Encoding")
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
@@ -0,0 +1,122 @@
+package promapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestUpstreamErrorStatus(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantStatus    int
+		wantErrorType ErrorType
+	}{
+		{
+			name:          "timeout",
+			err:           fmt.Errorf("round trip: %w", context.DeadlineExceeded),
+			wantStatus:    http.StatusGatewayTimeout,
+			wantErrorType: ErrorTimeout,
+		},
+		{
+			name:          "connection refused",
+			err:           errors.New("dial tcp: connection refused"),
+			wantStatus:    http.StatusBadGateway,
+			wantErrorType: ErrorUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			status, errorType := UpstreamErrorStatus(tt.err)
+			if status != tt.wantStatus || errorType != tt.wantErrorType {
+				t.Errorf("UpstreamErrorStatus() = %d, %s, want %d, %s", status, errorType, tt.wantStatus, tt.wantErrorType)
+			}
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	rec := httptest.NewRecorder()
+	WriteError(rec, http.StatusBadRequest, ErrorTypeForStatus(http.StatusBadRequest), `invalid "query"`)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	want := `{"status":"error","errorType":"bad_data","error":"invalid \"query\""}`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	got, err := Marshal([]string{`up{job=~"a|b"} > 1 & <2>`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `["up{job=~\"a|b\"} > 1 & <2>"]`
+	if string(got) != want {
+		t.Errorf("Marshal() = %s, want %s", got, want)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    time.Time
+		wantErr bool
+	}{
+		{input: "1718000000", want: time.Unix(1718000000, 0)},
+		{input: "1718000000.123", want: time.UnixMilli(1718000000123)},
+		{input: "2024-06-10T06:13:20Z", want: time.Unix(1718000000, 0)},
+		{input: "now", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseTime(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTime(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("ParseTime(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+
+	if got := FormatTime(time.UnixMilli(1718000000123)); got != "1718000000.123" {
+		t.Errorf("FormatTime() = %q, want 1718000000.123", got)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{input: "15", want: 15 * time.Second},
+		{input: "0.5", want: 500 * time.Millisecond},
+		{input: "5m", want: 5 * time.Minute},
+		{input: "1d", want: 24 * time.Hour},
+		{input: "soon", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseDuration(tt.input)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseDuration(%q) error = %v, wantErr %v", tt.input, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseDuration(%q) = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
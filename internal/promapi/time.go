@@ -0,0 +1,47 @@
+package promapi
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+// ParseTime parses a timestamp parameter as Prometheus does: Unix seconds,
+// optionally with a fraction, or RFC 3339
+func ParseTime(s string) (time.Time, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		if math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+			return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+		}
+		sec, frac := math.Modf(seconds)
+		return time.Unix(int64(sec), int64(math.Round(frac*1000))*int64(time.Millisecond)).UTC(), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q to a valid timestamp", s)
+}
+
+// FormatTime formats a timestamp as Unix seconds with millisecond precision
+func FormatTime(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', -1, 64)
+}
+
+// ParseDuration parses a duration parameter as Prometheus does: seconds,
+// optionally with a fraction, or a Prometheus duration such as 5m or 1d
+func ParseDuration(s string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		d := seconds * float64(time.Second)
+		if math.IsNaN(d) || d > math.MaxInt64 || d < math.MinInt64 {
+			return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+		}
+		return time.Duration(d), nil
+	}
+	if d, err := model.ParseDuration(s); err == nil {
+		return time.Duration(d), nil
+	}
+	return 0, fmt.Errorf("cannot parse %q to a valid duration", s)
+}
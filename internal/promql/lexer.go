@@ -0,0 +1,134 @@
+package promql
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// tokenKind represents the kind of a lexical token
+type tokenKind int
+
+const (
+	tokenSpace tokenKind = iota
+	tokenComment
+	tokenIdent
+	tokenNumber
+	tokenString
+	tokenPunct
+)
+
+// token is a lexical token with its position in the query
+type token struct {
+	kind  tokenKind
+	text  string
+	start int
+	end   int
+}
+
+// operators lists multi-character punctuation, longest first
+var operators = []string{"=~", "!~", "!=", "==", "<=", ">=", "=", "<", ">"}
+
+// lex splits a query into tokens. Whitespace and comments are kept so the
+// query can be reassembled byte for byte.
+func lex(query string) ([]token, error) {
+	var tokens []token
+	pos := 0
+
+	for pos < len(query) {
+		r, size := utf8.DecodeRuneInString(query[pos:])
+		start := pos
+
+		switch {
+		case unicode.IsSpace(r):
+			for pos < len(query) {
+				r, size := utf8.DecodeRuneInString(query[pos:])
+				if !unicode.IsSpace(r) {
+					break
+				}
+				pos += size
+			}
+			tokens = append(tokens, token{kind: tokenSpace, text: query[start:pos], start: start, end: pos})
+
+		case r == '#':
+			end := strings.IndexByte(query[pos:], '\n')
+			if end < 0 {
+				pos = len(query)
+			} else {
+				pos += end
+			}
+			tokens = append(tokens, token{kind: tokenComment, text: query[start:pos], start: start, end: pos})
+
+		case r == '"' || r == '\'' || r == '`':
+			end, err := scanString(query, pos)
+			if err != nil {
+				return nil, err
+			}
+			pos = end
+			tokens = append(tokens, token{kind: tokenString, text: query[start:pos], start: start, end: pos})
+
+		case isDigit(r) || (r == '.' && pos+1 < len(query) && isDigit(rune(query[pos+1]))):
+			// Numbers and durations such as 1.5e3, 0x1f, 5m or 1h30m
+			for pos < len(query) && (isAlphaNum(rune(query[pos])) || query[pos] == '.' ||
+				((query[pos] == '+' || query[pos] == '-') && (query[pos-1] == 'e' || query[pos-1] == 'E') && !isHex(query[start:pos]))) {
+				pos++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: query[start:pos], start: start, end: pos})
+
+		case isIdentStart(r):
+			for pos < len(query) && (isAlphaNum(rune(query[pos])) || query[pos] == ':') {
+				pos++
+			}
+			kind := tokenIdent
+			if lower := strings.ToLower(query[start:pos]); lower == "inf" || lower == "nan" {
+				kind = tokenNumber
+			}
+			tokens = append(tokens, token{kind: kind, text: query[start:pos], start: start, end: pos})
+
+		default:
+			pos += size
+			for _, op := range operators {
+				if strings.HasPrefix(query[start:], op) {
+					pos = start + len(op)
+					break
+				}
+			}
+			tokens = append(tokens, token{kind: tokenPunct, text: query[start:pos], start: start, end: pos})
+		}
+	}
+
+	return tokens, nil
+}
+
+// scanString returns the end position of the string literal starting at pos
+func scanString(query string, pos int) (int, error) {
+	quote := query[pos]
+	for i := pos + 1; i < len(query); i++ {
+		switch query[i] {
+		case '\\':
+			if quote != '`' {
+				i++
+			}
+		case quote:
+			return i + 1, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated string at position %d", pos)
+}
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func isIdentStart(r rune) bool {
+	return r == '_' || r == ':' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+func isAlphaNum(r rune) bool {
+	return r == '_' || isDigit(r) || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+}
+
+func isHex(s string) bool {
+	return strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X")
+}
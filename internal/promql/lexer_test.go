@@ -0,0 +1,112 @@
+package promql
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLex(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    string
+		expected []string
+	}{
+		{
+			name:     "Selector",
+			input:    `up{job=~"a.*"}`,
+			expected: []string{`up`, `{`, `job`, `=~`, `"a.*"`, `}`},
+		},
+		{
+			name:     "Double-quoted string escapes",
+			input:    `"a\"}b\\" x`,
+			expected: []string{`"a\"}b\\"`, ` `, `x`},
+		},
+		{
+			name:     "Single-quoted string escapes",
+			input:    `'it\'s {' x`,
+			expected: []string{`'it\'s {'`, ` `, `x`},
+		},
+		{
+			name:     "Raw strings keep backslashes",
+			input:    "`a\\` x",
+			expected: []string{"`a\\`", ` `, `x`},
+		},
+		{
+			name:     "Comments run to the end of the line",
+			input:    "up # {job=\"a\"}\n+ x",
+			expected: []string{`up`, ` `, `# {job="a"}`, "\n", `+`, ` `, `x`},
+		},
+		{
+			name:     "Numbers and durations",
+			input:    `1.5e-3 0x1f 1h30m .5 Inf NaN`,
+			expected: []string{`1.5e-3`, ` `, `0x1f`, ` `, `1h30m`, ` `, `.5`, ` `, `Inf`, ` `, `NaN`},
+		},
+		{
+			name:     "Hex numbers do not take signs",
+			input:    `0x1e-1`,
+			expected: []string{`0x1e`, `-`, `1`},
+		},
+		{
+			name:     "@ and offset modifiers",
+			input:    `x @ start() offset -5m`,
+			expected: []string{`x`, ` `, `@`, ` `, `start`, `(`, `)`, ` `, `offset`, ` `, `-`, `5m`},
+		},
+		{
+			name:     "Comparison operators",
+			input:    `a<=b!=c==d`,
+			expected: []string{`a`, `<=`, `b`, `!=`, `c`, `==`, `d`},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tokens, err := lex(tc.input)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			var texts []string
+			var b strings.Builder
+			for _, tok := range tokens {
+				texts = append(texts, tok.text)
+				if tc.input[tok.start:tok.end] != tok.text {
+					t.Errorf("Token %q has position %d-%d", tok.text, tok.start, tok.end)
+				}
+				b.WriteString(tok.text)
+			}
+			if !reflect.DeepEqual(texts, tc.expected) {
+				t.Errorf("Expected %q, got %q", tc.expected, texts)
+			}
+			if b.String() != tc.input {
+				t.Errorf("Tokens reassemble to %q", b.String())
+			}
+		})
+	}
+}
+
+func TestLexKinds(t *testing.T) {
+	tokens, err := lex(`sum("a") # c`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []tokenKind{tokenIdent, tokenPunct, tokenString, tokenPunct, tokenSpace, tokenComment}
+	var kinds []tokenKind
+	for _, tok := range tokens {
+		kinds = append(kinds, tok.kind)
+	}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("Expected %v, got %v", expected, kinds)
+	}
+}
+
+func TestLexUnterminatedString(t *testing.T) {
+	for _, input := range []string{`up{job="a}`, `"a\"`, `'a`, "`a"} {
+		t.Run(input, func(t *testing.T) {
+			if _, err := lex(input); err == nil {
+				t.Errorf("Expected error for %q", input)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package promql
+
+// UsesRangeBoundaries reports whether the query evaluates selectors or
+// subqueries at the start or end of the query range with the @ start() or
+// @ end() modifiers
+func UsesRangeBoundaries(query string) (bool, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return false, err
+	}
+
+	for i, tok := range tokens {
+		if tok.kind != tokenPunct || tok.text != "@" {
+			continue
+		}
+		fn := nextToken(tokens, i+1)
+		if fn >= len(tokens) || tokens[fn].kind != tokenIdent || (tokens[fn].text != "start" && tokens[fn].text != "end") {
+			continue
+		}
+		if open := nextToken(tokens, fn+1); open < len(tokens) && tokens[open].text == "(" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
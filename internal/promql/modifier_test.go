@@ -0,0 +1,41 @@
+package promql
+
+import "testing"
+
+func TestUsesRangeBoundaries(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected bool
+	}{
+		{input: `up`, expected: false},
+		{input: `up @ 1609746000`, expected: false},
+		{input: `up @ start()`, expected: true},
+		{input: `rate(up[5m] @ end())`, expected: true},
+		{input: `up @ end ( )`, expected: true},
+		{input: `max_over_time(rate(up[1m])[1h:5m] @ start())`, expected: true},
+		{input: `min_over_time(max_over_time(up[5m] @ end())[1h:5m])[1d:1h]`, expected: true},
+		{input: `max_over_time(rate(up[1m])[1h:5m] offset 1h)`, expected: false},
+		{input: `label_replace(up, "a", "@ start()", "", "")`, expected: false},
+		{input: `label_replace(up, "a", '@ end()', "", "")`, expected: false},
+		{input: "up # @ end()", expected: false},
+		{input: `start + end`, expected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			result, err := UsesRangeBoundaries(tc.input)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result != tc.expected {
+				t.Errorf("Expected %v, got %v", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestUsesRangeBoundariesError(t *testing.T) {
+	if _, err := UsesRangeBoundaries(`up{job="a}`); err == nil {
+		t.Error("Expected error for unterminated string")
+	}
+}
@@ -0,0 +1,401 @@
+package promql
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// MatchType represents the operator of a label matcher
+type MatchType string
+
+const (
+	MatchEqual     MatchType = "="
+	MatchNotEqual  MatchType = "!="
+	MatchRegexp    MatchType = "=~"
+	MatchNotRegexp MatchType = "!~"
+)
+
+// Matcher is a label matcher within a vector selector
+type Matcher struct {
+	Name  string
+	Type  MatchType
+	Value string
+}
+
+// String renders the matcher in PromQL syntax
+func (m Matcher) String() string {
+	return quoteName(m.Name) + string(m.Type) + strconv.Quote(m.Value)
+}
+
+// Selector is a vector selector such as up{job="prometheus"}. Matchers are
+// organised in groups separated by "or"; most selectors have a single group.
+type Selector struct {
+	MetricName string
+	Groups     [][]Matcher
+}
+
+// String renders the selector in PromQL syntax
+func (s *Selector) String() string {
+	var b strings.Builder
+	b.WriteString(s.MetricName)
+
+	hasMatchers := false
+	for _, group := range s.Groups {
+		if len(group) > 0 {
+			hasMatchers = true
+		}
+	}
+	if !hasMatchers {
+		if s.MetricName == "" {
+			return "{}"
+		}
+		return b.String()
+	}
+
+	b.WriteByte('{')
+	for i, group := range s.Groups {
+		if i > 0 {
+			b.WriteString(" or ")
+		}
+		for j, m := range group {
+			if j > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(m.String())
+		}
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Matchers returns the matchers of all groups
+func (s *Selector) Matchers() []Matcher {
+	var matchers []Matcher
+	for _, group := range s.Groups {
+		matchers = append(matchers, group...)
+	}
+	return matchers
+}
+
+// clone returns a deep copy of the selector
+func (s *Selector) clone() *Selector {
+	c := &Selector{MetricName: s.MetricName, Groups: make([][]Matcher, len(s.Groups))}
+	for i, group := range s.Groups {
+		c.Groups[i] = append([]Matcher(nil), group...)
+	}
+	return c
+}
+
+// binaryKeywords are keywords that follow an operand. In any other
+// position PromQL parses them as metric names.
+var binaryKeywords = map[string]bool{
+	"and": true, "or": true, "unless": true, "atan2": true, "offset": true,
+}
+
+// aggregators are aggregation operators, which may be followed by a
+// grouping clause before their arguments
+var aggregators = map[string]bool{
+	"sum": true, "avg": true, "count": true, "min": true, "max": true,
+	"group": true, "stddev": true, "stdvar": true, "topk": true, "bottomk": true,
+	"count_values": true, "quantile": true, "limitk": true, "limit_ratio": true,
+}
+
+// labelListKeywords are followed by a parenthesised list of label names
+var labelListKeywords = map[string]bool{
+	"by": true, "without": true, "on": true, "ignoring": true,
+	"group_left": true, "group_right": true,
+}
+
+// comparisonOperators may be followed by the bool modifier
+var comparisonOperators = map[string]bool{
+	"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true,
+}
+
+// Selectors returns all vector selectors in the query
+func Selectors(query string) ([]*Selector, error) {
+	var selectors []*Selector
+	_, err := RewriteSelectors(query, func(s *Selector) error {
+		selectors = append(selectors, s.clone())
+		return nil
+	})
+	return selectors, err
+}
+
+// RewriteSelectors calls fn for every vector selector in the query. Selectors
+// modified by fn are replaced in the query; the rest of the query, including
+// whitespace and comments, is preserved as written.
+func RewriteSelectors(query string, fn func(*Selector) error) (string, error) {
+	tokens, err := lex(query)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	last := 0
+
+	for i := 0; i < len(tokens); i++ {
+		tok := tokens[i]
+
+		switch {
+		case tok.kind == tokenIdent:
+			lower := strings.ToLower(tok.text)
+			next := nextToken(tokens, i+1)
+			prev := prevToken(tokens, i-1)
+			nextText := ""
+			if next < len(tokens) {
+				nextText = strings.ToLower(tokens[next].text)
+			}
+			prevText := ""
+			if prev >= 0 {
+				prevText = tokens[prev].text
+			}
+
+			if labelListKeywords[lower] && nextText == "(" {
+				// Skip the list of label names
+				end, err := skipGroup(tokens, next, "(", ")")
+				if err != nil {
+					return "", err
+				}
+				i = end
+				continue
+			}
+
+			// Keywords are only treated as such in positions where PromQL
+			// expects them, so that selectors are never missed
+			switch {
+			case nextText == "(":
+				// Function calls and aggregations
+				continue
+			case aggregators[lower] && (nextText == "by" || nextText == "without"):
+				continue
+			case binaryKeywords[lower] && prev >= 0 && endsOperand(tokens[prev]):
+				continue
+			case lower == "bool" && comparisonOperators[prevText]:
+				continue
+			case (lower == "group_left" || lower == "group_right") && prevText == ")":
+				continue
+			case (lower == "smoothed" || lower == "anchored") && prevText == "]":
+				continue
+			}
+
+			sel := &Selector{MetricName: tok.text}
+			end := i
+			if next < len(tokens) && tokens[next].text == "{" {
+				end, err = parseMatchers(tokens, next, sel)
+				if err != nil {
+					return "", err
+				}
+			}
+
+			if err := replaceSelector(&b, query, &last, tokens[i].start, tokens[end].end, sel, fn); err != nil {
+				return "", err
+			}
+			i = end
+
+		case tok.text == "{":
+			sel := &Selector{}
+			end, err := parseMatchers(tokens, i, sel)
+			if err != nil {
+				return "", err
+			}
+			if err := replaceSelector(&b, query, &last, tok.start, tokens[end].end, sel, fn); err != nil {
+				return "", err
+			}
+			i = end
+
+		case tok.text == "[":
+			// Range and subquery durations contain no selectors
+			end, err := skipGroup(tokens, i, "[", "]")
+			if err != nil {
+				return "", err
+			}
+			i = end
+
+		case tok.text == "}" || tok.text == "]":
+			return "", fmt.Errorf("unexpected %q at position %d", tok.text, tok.start)
+		}
+	}
+
+	b.WriteString(query[last:])
+	return b.String(), nil
+}
+
+// replaceSelector calls fn for the selector spanning query[start:end] and
+// writes the query up to and including the (possibly rewritten) selector
+func replaceSelector(b *strings.Builder, query string, last *int, start, end int, sel *Selector, fn func(*Selector) error) error {
+	original := sel.clone()
+	if err := fn(sel); err != nil {
+		return err
+	}
+
+	b.WriteString(query[*last:start])
+	if reflect.DeepEqual(original, sel) {
+		b.WriteString(query[start:end])
+	} else {
+		b.WriteString(sel.String())
+	}
+	*last = end
+	return nil
+}
+
+// parseMatchers parses the matchers between the brace at tokens[open] and
+// the closing brace, and returns the index of the closing brace
+func parseMatchers(tokens []token, open int, sel *Selector) (int, error) {
+	group := []Matcher{}
+	i := nextToken(tokens, open+1)
+
+	for {
+		if i >= len(tokens) {
+			return 0, fmt.Errorf("unterminated label matchers at position %d", tokens[open].start)
+		}
+
+		tok := tokens[i]
+		switch {
+		case tok.text == "}":
+			sel.Groups = append(sel.Groups, group)
+			return i, nil
+
+		case tok.text == ",":
+			i = nextToken(tokens, i+1)
+			continue
+
+		case tok.kind == tokenIdent && strings.ToLower(tok.text) == "or" && len(group) > 0 && isMatcherEnd(tokens, i):
+			sel.Groups = append(sel.Groups, group)
+			group = []Matcher{}
+			i = nextToken(tokens, i+1)
+			continue
+
+		case tok.kind != tokenIdent && tok.kind != tokenString:
+			return 0, fmt.Errorf("unexpected %q in label matchers at position %d", tok.text, tok.start)
+		}
+
+		name := tok.text
+		if tok.kind == tokenString {
+			unquoted, err := unquote(tok.text)
+			if err != nil {
+				return 0, fmt.Errorf("invalid label name at position %d: %w", tok.start, err)
+			}
+			name = unquoted
+		}
+
+		op := nextToken(tokens, i+1)
+		if op >= len(tokens) {
+			return 0, fmt.Errorf("unterminated label matchers at position %d", tokens[open].start)
+		}
+
+		// A quoted name without an operator is the metric name
+		if tok.kind == tokenString && (tokens[op].text == "," || tokens[op].text == "}") {
+			group = append(group, Matcher{Name: "__name__", Type: MatchEqual, Value: name})
+			i = op
+			continue
+		}
+
+		matchType := MatchType(tokens[op].text)
+		switch matchType {
+		case MatchEqual, MatchNotEqual, MatchRegexp, MatchNotRegexp:
+		default:
+			return 0, fmt.Errorf("unexpected %q in label matchers at position %d", tokens[op].text, tokens[op].start)
+		}
+
+		val := nextToken(tokens, op+1)
+		if val >= len(tokens) || tokens[val].kind != tokenString {
+			return 0, fmt.Errorf("expected string after %q at position %d", matchType, tokens[op].start)
+		}
+		value, err := unquote(tokens[val].text)
+		if err != nil {
+			return 0, fmt.Errorf("invalid label value at position %d: %w", tokens[val].start, err)
+		}
+
+		group = append(group, Matcher{Name: name, Type: matchType, Value: value})
+		i = nextToken(tokens, val+1)
+		if i < len(tokens) && tokens[i].text != "," && tokens[i].text != "}" && strings.ToLower(tokens[i].text) != "or" {
+			return 0, fmt.Errorf("unexpected %q in label matchers at position %d", tokens[i].text, tokens[i].start)
+		}
+	}
+}
+
+// isMatcherEnd reports whether the "or" at tokens[i] separates matcher
+// groups rather than being a label name
+func isMatcherEnd(tokens []token, i int) bool {
+	next := nextToken(tokens, i+1)
+	if next >= len(tokens) {
+		return false
+	}
+	switch MatchType(tokens[next].text) {
+	case MatchEqual, MatchNotEqual, MatchRegexp, MatchNotRegexp:
+		return false
+	}
+	return true
+}
+
+// skipGroup returns the index of the token closing the group opened at
+// tokens[open], honouring nesting
+func skipGroup(tokens []token, open int, openText, closeText string) (int, error) {
+	depth := 0
+	for i := open; i < len(tokens); i++ {
+		switch tokens[i].text {
+		case openText:
+			depth++
+		case closeText:
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("unterminated %q at position %d", openText, tokens[open].start)
+}
+
+// prevToken returns the index of the previous token at or before i that is
+// not whitespace or a comment, or -1
+func prevToken(tokens []token, i int) int {
+	for i >= 0 && (tokens[i].kind == tokenSpace || tokens[i].kind == tokenComment) {
+		i--
+	}
+	return i
+}
+
+// endsOperand reports whether the token can be the last token of an operand
+func endsOperand(tok token) bool {
+	switch tok.kind {
+	case tokenIdent, tokenNumber, tokenString:
+		return true
+	}
+	return tok.text == ")" || tok.text == "}" || tok.text == "]"
+}
+
+// nextToken returns the index of the next token at or after i that is not
+// whitespace or a comment
+func nextToken(tokens []token, i int) int {
+	for i < len(tokens) && (tokens[i].kind == tokenSpace || tokens[i].kind == tokenComment) {
+		i++
+	}
+	return i
+}
+
+// unquote unquotes a PromQL string literal
+func unquote(s string) (string, error) {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		// Convert to a double-quoted string for strconv
+		inner := s[1 : len(s)-1]
+		inner = strings.ReplaceAll(inner, `\'`, `'`)
+		inner = strings.ReplaceAll(inner, `"`, `\"`)
+		s = `"` + inner + `"`
+	}
+	return strconv.Unquote(s)
+}
+
+// quoteName returns the label name, quoted if it is not a valid identifier
+func quoteName(name string) string {
+	if name == "" {
+		return strconv.Quote(name)
+	}
+	for i, r := range name {
+		if !(r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (i > 0 && isDigit(r))) {
+			return strconv.Quote(name)
+		}
+	}
+	return name
+}
@@ -0,0 +1,156 @@
+package promql
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestRewriteSelectors(t *testing.T) {
+	tenant := Matcher{Name: "tenant", Type: MatchEqual, Value: "a"}
+	addTenant := func(sel *Selector) error {
+		if len(sel.Groups) == 0 {
+			sel.Groups = [][]Matcher{{}}
+		}
+		for i := range sel.Groups {
+			sel.Groups[i] = append(sel.Groups[i], tenant)
+		}
+		return nil
+	}
+
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "Bare metric",
+			input:    `up`,
+			expected: `up{tenant="a"}`,
+		},
+		{
+			name:     "Matcher groups",
+			input:    `{job="a" or job="b",env="c"}`,
+			expected: `{job="a",tenant="a" or job="b",env="c",tenant="a"}`,
+		},
+		{
+			name:     "Label named or",
+			input:    `up{or="a"}`,
+			expected: `up{or="a",tenant="a"}`,
+		},
+		{
+			name:     "@ and offset modifiers",
+			input:    `x @ 1609746000 offset 5m + rate(y[5m] @ end() offset -1h)`,
+			expected: `x{tenant="a"} @ 1609746000 offset 5m + rate(y{tenant="a"}[5m] @ end() offset -1h)`,
+		},
+		{
+			name:     "Nested subqueries",
+			input:    `min_over_time(max_over_time(rate(x{a="1"}[1m])[1h:5m] @ start())[1d:1h] offset 1d)`,
+			expected: `min_over_time(max_over_time(rate(x{a="1",tenant="a"}[1m])[1h:5m] @ start())[1d:1h] offset 1d)`,
+		},
+		{
+			name:     "String escapes",
+			input:    `label_replace(x{a="\"}"}, "dst", "{y}", "src", '{z=\'1\'}')`,
+			expected: `label_replace(x{a="\"}",tenant="a"}, "dst", "{y}", "src", '{z=\'1\'}')`,
+		},
+		{
+			name:     "Comments",
+			input:    "x # y{z=\"1\"}\n + w",
+			expected: "x{tenant=\"a\"} # y{z=\"1\"}\n + w{tenant=\"a\"}",
+		},
+		{
+			name:     "Grouping label lists",
+			input:    `sum by (job) (x) / ignoring(code) group_left(team) count without (z) (y)`,
+			expected: `sum by (job) (x{tenant="a"}) / ignoring(code) group_left(team) count without (z) (y{tenant="a"})`,
+		},
+		{
+			name:     "Metric names matching keywords",
+			input:    `sum + offset - by / and`,
+			expected: `sum{tenant="a"} + offset{tenant="a"} - by{tenant="a"} / and{tenant="a"}`,
+		},
+		{
+			name:     "Keywords in operator positions",
+			input:    `x and on(a) y > bool group`,
+			expected: `x{tenant="a"} and on(a) y{tenant="a"} > bool group{tenant="a"}`,
+		},
+		{
+			name:     "Quoted metric name",
+			input:    `{"up", job="a"}`,
+			expected: `{__name__="up",job="a",tenant="a"}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := RewriteSelectors(tc.input, addTenant)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestRewriteSelectorsUnchanged(t *testing.T) {
+	// Selectors left alone by fn keep their original bytes
+	input := "sum by (job) (rate(x{ a = \"1\" }[5m])) # comment\n"
+	result, err := RewriteSelectors(input, func(*Selector) error { return nil })
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if result != input {
+		t.Errorf("Expected %q, got %q", input, result)
+	}
+}
+
+func TestRewriteSelectorsError(t *testing.T) {
+	errReject := errors.New("rejected")
+	if _, err := RewriteSelectors(`x + y`, func(*Selector) error { return errReject }); !errors.Is(err, errReject) {
+		t.Errorf("Expected %v, got %v", errReject, err)
+	}
+
+	for _, input := range []string{`up{a="1"`, `up{a="1}`, `up{a}`, `up{a=1}`, `rate(up[5m)`, `up}`} {
+		t.Run(input, func(t *testing.T) {
+			if _, err := RewriteSelectors(input, func(*Selector) error { return nil }); err == nil {
+				t.Errorf("Expected error for %q", input)
+			}
+		})
+	}
+}
+
+func TestSelectors(t *testing.T) {
+	testCases := []struct {
+		input    string
+		expected []*Selector
+	}{
+		{
+			input:    `up`,
+			expected: []*Selector{{MetricName: "up", Groups: [][]Matcher{}}},
+		},
+		{
+			input: `rate(http_requests_total{code=~"5..",job!="x"}[5m]) / on(job) group_left {__name__="up" or job!~"y"}`,
+			expected: []*Selector{
+				{MetricName: "http_requests_total", Groups: [][]Matcher{{{Name: "code", Type: MatchRegexp, Value: "5.."}, {Name: "job", Type: MatchNotEqual, Value: "x"}}}},
+				{Groups: [][]Matcher{{{Name: "__name__", Type: MatchEqual, Value: "up"}}, {{Name: "job", Type: MatchNotRegexp, Value: "y"}}}},
+			},
+		},
+		{
+			input:    `label_replace(vector(1), "a", "{b=\"c\"}", "", "") # d{e="f"}`,
+			expected: nil,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			result, err := Selectors(tc.input)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(result, tc.expected) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, result)
+			}
+		})
+	}
+}
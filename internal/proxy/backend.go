@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/codec"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/upstream"
+)
+
+// errUnavailable is returned for requests to an unhealthy backend
+var errUnavailable = errors.New("upstream unavailable")
+
+// backend is an upstream Prometheus server and the reverse proxy for it
+type backend struct {
+	name           string
+	url            *url.URL
+	profile        string
+	externalLabels map[string]string
+	failover       string
+	proxy          *httputil.ReverseProxy
+	transport      http.RoundTripper
+
+	// checker and breaker are nil unless health checks and circuit
+	// breaking are enabled
+	checker *upstream.Checker
+	breaker *upstream.Breaker
+}
+
+// available reports whether requests should be sent to the backend. It does
+// not affect the circuit breaker: a half-open breaker lets the probing
+// request through when it is sent.
+func (b *backend) available() bool {
+	return b.checker.Healthy() && b.breaker.State() != upstream.BreakerOpen
+}
+
+// newBackend creates the reverse proxy for an upstream server
+func (p *PrometheusProxy) newBackend(u config.UpstreamServer, health config.HealthCheck, breakerCfg config.CircuitBreaker) (*backend, error) {
+	targetURL, err := url.Parse(u.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := upstream.NewTransport(u.Upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	var checker *upstream.Checker
+	if health.Enabled {
+		checker = upstream.NewChecker(u.Name, targetURL, transport, health, p.logger)
+	}
+
+	var breaker *upstream.Breaker
+	if breakerCfg.Enabled {
+		breaker = upstream.NewBreaker(breakerCfg.FailureThreshold, breakerCfg.OpenDuration)
+	}
+	transport = breaker.Transport(transport)
+
+	// Trace the upstream round-trip and propagate the trace context to it
+	transport = otelhttp.NewTransport(transport,
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			return "upstream " + r.Method
+		}),
+	)
+
+	// Create the reverse proxy
+	reverseProxy := httputil.NewSingleHostReverseProxy(targetURL)
+	reverseProxy.Transport = transport
+
+	// Request the encodings the proxy can decode, independently of the
+	// client, which is sent the encoding it accepts
+	director := reverseProxy.Director
+	reverseProxy.Director = func(req *http.Request) {
+		director(req)
+		req.Header.Set("Accept-Encoding", codec.AcceptEncoding())
+	}
+
+	// Add a response modifier
+	reverseProxy.ModifyResponse = p.rewriteResponse
+	reverseProxy.ErrorHandler = p.handleProxyError
+	reverseProxy.ErrorLog = slog.NewLogLogger(p.logger.Handler(), slog.LevelError)
+
+	return &backend{
+		name:           u.Name,
+		url:            targetURL,
+		profile:        u.Profile,
+		externalLabels: u.ExternalLabels,
+		failover:       u.Failover,
+		proxy:          reverseProxy,
+		transport:      transport,
+		checker:        checker,
+		breaker:        breaker,
+	}, nil
+}
+
+// newBackends creates the reverse proxies for all upstream servers
+func (p *PrometheusProxy) newBackends(cfg *config.Config) (map[string]*backend, error) {
+	upstreams := cfg.GetUpstreams()
+	health := cfg.GetHealthCheck()
+	breaker := cfg.GetCircuitBreaker()
+
+	backends := make(map[string]*backend, len(upstreams))
+	for _, u := range upstreams {
+		b, err := p.newBackend(u, health, breaker)
+		if err != nil {
+			return nil, err
+		}
+		backends[u.Name] = b
+	}
+	return backends, nil
+}
+
+// failover returns the backend that serves read requests for b: b itself if
+// it is available, else the first available backend in its failover chain.
+// If no backend is available, b is returned.
+func (p *PrometheusProxy) failover(b *backend) *backend {
+	seen := make(map[string]bool)
+	for cur := b; cur != nil && !seen[cur.name]; cur = p.backends[cur.failover] {
+		seen[cur.name] = true
+		if cur.available() {
+			return cur
+		}
+	}
+	return b
+}
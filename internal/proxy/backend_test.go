@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+func TestCircuitBreakerOpen(t *testing.T) {
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		TargetPrometheus: upstream.URL,
+		CircuitBreaker: config.CircuitBreaker{
+			Enabled:          true,
+			FailureThreshold: 1,
+			OpenDuration:     time.Minute,
+		},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+
+	// The failure opens the breaker
+	serve(http.MethodGet, "/api/v1/query?query=up")
+
+	want := `{"status":"error","errorType":"unavailable","error":"upstream unavailable: default"}`
+	for _, target := range []string{"/api/v1/query?query=up", "/api/v1/status/buildinfo"} {
+		rec := serve(http.MethodGet, target)
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s: status = %d, want 503", target, rec.Code)
+		}
+		if got := rec.Body.String(); got != want {
+			t.Errorf("%s: body = %s, want %s", target, got, want)
+		}
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("upstream received %d requests, want 1", got)
+	}
+}
+
+// healthUpstream is an upstream whose health check fails while down is set
+type healthUpstream struct {
+	*httptest.Server
+	down     atomic.Bool
+	requests atomic.Int32
+}
+
+func newHealthUpstream(name string) *healthUpstream {
+	u := &healthUpstream{}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/-/ready" {
+			if u.down.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		u.requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":["` + name + `"]}`))
+	}))
+	return u
+}
+
+func TestFailover(t *testing.T) {
+	primary, secondary, tertiary := newHealthUpstream("primary"), newHealthUpstream("secondary"), newHealthUpstream("tertiary")
+	defer primary.Close()
+	defer secondary.Close()
+	defer tertiary.Close()
+	primary.down.Store(true)
+	secondary.down.Store(true)
+
+	cfg := &config.Config{
+		Upstreams: []config.UpstreamServer{
+			{Name: "primary", URL: primary.URL, Failover: "secondary"},
+			{Name: "secondary", URL: secondary.URL, Failover: "tertiary"},
+			{Name: "tertiary", URL: tertiary.URL},
+		},
+		HealthCheck: config.HealthCheck{Enabled: true, Interval: 10 * time.Millisecond},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(p)
+	scrape := func() string {
+		rec := httptest.NewRecorder()
+		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return rec.Body.String()
+	}
+	assertMetrics := func(want ...string) {
+		t.Helper()
+		metrics := scrape()
+		for _, line := range want {
+			if !strings.Contains(metrics, line+"\n") {
+				t.Errorf("metrics do not contain %s", line)
+			}
+		}
+	}
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+		return rec
+	}
+
+	// Wait for the first health checks
+	time.Sleep(50 * time.Millisecond)
+
+	// Read requests fail over along the chain to the first healthy upstream
+	rec := serve(http.MethodGet, "/api/v1/labels")
+	if body, _ := io.ReadAll(rec.Body); rec.Code != http.StatusOK || !strings.Contains(string(body), "tertiary") {
+		t.Errorf("read request: response = %d %s, want 200 from tertiary", rec.Code, body)
+	}
+	assertMetrics(
+		`prom_relabel_proxy_upstream_failovers_total{failover="tertiary",upstream="primary"} 1`,
+		`prom_relabel_proxy_upstream_active{upstream="primary"} 0`,
+		`prom_relabel_proxy_upstream_active{upstream="secondary"} 0`,
+		`prom_relabel_proxy_upstream_active{upstream="tertiary"} 1`,
+		`prom_relabel_proxy_upstream_up{upstream="primary"} 0`,
+	)
+
+	// Other requests do not fail over
+	for _, target := range []string{"/api/v1/status/buildinfo", "/api/v1/admin/tsdb/snapshot"} {
+		method := http.MethodGet
+		if strings.Contains(target, "admin") {
+			method = http.MethodPost
+		}
+		if rec := serve(method, target); rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%s %s: status = %d, want 503", method, target, rec.Code)
+		}
+	}
+	if got := primary.requests.Load() + secondary.requests.Load(); got != 0 {
+		t.Errorf("unhealthy upstreams received %d requests, want 0", got)
+	}
+
+	// The secondary takes over once it is healthy again
+	secondary.down.Store(false)
+	time.Sleep(50 * time.Millisecond)
+	if rec := serve(http.MethodGet, "/api/v1/labels"); !strings.Contains(rec.Body.String(), "secondary") {
+		t.Errorf("read request: response = %s, want secondary", rec.Body.String())
+	}
+	assertMetrics(
+		`prom_relabel_proxy_upstream_failovers_total{failover="secondary",upstream="primary"} 1`,
+		`prom_relabel_proxy_upstream_active{upstream="secondary"} 1`,
+		`prom_relabel_proxy_upstream_active{upstream="tertiary"} 0`,
+	)
+
+	// Requests return to the primary once it recovers
+	primary.down.Store(false)
+	time.Sleep(50 * time.Millisecond)
+	if rec := serve(http.MethodGet, "/api/v1/labels"); !strings.Contains(rec.Body.String(), "primary") {
+		t.Errorf("read request: response = %s, want primary", rec.Body.String())
+	}
+	assertMetrics(
+		`prom_relabel_proxy_upstream_active{upstream="primary"} 1`,
+		`prom_relabel_proxy_upstream_active{upstream="secondary"} 0`,
+		`prom_relabel_proxy_upstream_up{upstream="primary"} 1`,
+	)
+}
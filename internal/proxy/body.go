@@ -0,0 +1,253 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/textproto"
+	"net/url"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/promapi"
+)
+
+// Media types of request bodies whose parameters are rewritten
+const (
+	mediaTypeForm      = "application/x-www-form-urlencoded"
+	mediaTypeMultipart = "multipart/form-data"
+	mediaTypeJSON      = "application/json"
+)
+
+// requestBody is a parsed request body with parameters that can be
+// rewritten
+type requestBody interface {
+	// params returns the parameters of the body. They are changed in place
+	// to rewrite the body.
+	params() url.Values
+	// encode returns the body with the current parameter values
+	encode() ([]byte, error)
+}
+
+// parseBody parses a request body of the given media type. It returns nil
+// if the media type is not supported.
+func parseBody(mediaType string, mediaParams map[string]string, body []byte) (requestBody, error) {
+	switch mediaType {
+	case mediaTypeForm:
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse form data: %w", err)
+		}
+		return formBody(values), nil
+	case mediaTypeMultipart:
+		return parseMultipartBody(body, mediaParams["boundary"])
+	case mediaTypeJSON:
+		return parseJSONBody(body)
+	}
+	return nil, nil
+}
+
+// formBody is a URL encoded form
+type formBody url.Values
+
+func (b formBody) params() url.Values {
+	return url.Values(b)
+}
+
+func (b formBody) encode() ([]byte, error) {
+	return []byte(url.Values(b).Encode()), nil
+}
+
+// multipartBody is a multipart form. Parts are kept in order; only the
+// values of form fields are replaced when it is encoded.
+type multipartBody struct {
+	boundary string
+	parts    []multipartPart
+	values   url.Values
+}
+
+// multipartPart is a part of a multipart form
+type multipartPart struct {
+	header textproto.MIMEHeader
+	// name is the form field name, or empty for files and unnamed parts
+	name string
+	data []byte
+}
+
+func parseMultipartBody(body []byte, boundary string) (*multipartBody, error) {
+	if boundary == "" {
+		return nil, errors.New("failed to parse multipart form: missing boundary")
+	}
+
+	mb := &multipartBody{boundary: boundary, values: make(url.Values)}
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return mb, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse multipart form: %w", err)
+		}
+
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse multipart form: %w", err)
+		}
+
+		// Prometheus only reads parameters from fields, not files
+		name := part.FormName()
+		if part.FileName() != "" {
+			name = ""
+		}
+		if name != "" {
+			mb.values.Add(name, string(data))
+		}
+		mb.parts = append(mb.parts, multipartPart{header: part.Header, name: name, data: data})
+	}
+}
+
+func (b *multipartBody) params() url.Values {
+	return b.values
+}
+
+func (b *multipartBody) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	if err := writer.SetBoundary(b.boundary); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]int)
+	for _, part := range b.parts {
+		data := part.data
+		if part.name != "" {
+			data = []byte(b.values[part.name][seen[part.name]])
+			seen[part.name]++
+		}
+
+		w, err := writer.CreatePart(part.header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonBody is a JSON object with parameters as string or string array
+// fields. Fields are kept in order with their original encoding unless
+// their value is rewritten.
+type jsonBody struct {
+	fields []jsonField
+	values url.Values
+}
+
+// jsonField is a field of a JSON object body
+type jsonField struct {
+	name string
+	raw  json.RawMessage
+	// values are the original values of string or string array fields,
+	// which are parameters
+	values       []string
+	param, array bool
+}
+
+func parseJSONBody(body []byte) (*jsonBody, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, errors.New("failed to parse JSON body: not an object")
+	}
+
+	jb := &jsonBody{values: make(url.Values)}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse JSON body: %w", err)
+		}
+		name, _ := tok.(string)
+
+		field := jsonField{name: name}
+		if err := dec.Decode(&field.raw); err != nil {
+			return nil, fmt.Errorf("failed to parse JSON body: %w", err)
+		}
+
+		var value string
+		if err := json.Unmarshal(field.raw, &value); err == nil {
+			field.param, field.values = true, []string{value}
+		} else if err := json.Unmarshal(field.raw, &field.values); err == nil {
+			field.param, field.array = true, true
+		}
+		jb.values[name] = append(jb.values[name], field.values...)
+		jb.fields = append(jb.fields, field)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON body: %w", err)
+	}
+	return jb, nil
+}
+
+func (b *jsonBody) params() url.Values {
+	return b.values
+}
+
+func (b *jsonBody) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+
+	seen := make(map[string]int)
+	for i, field := range b.fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, err := promapi.Marshal(field.name)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+
+		raw := field.raw
+		if field.param {
+			start := seen[field.name]
+			values := b.values[field.name][start : start+len(field.values)]
+			seen[field.name] += len(field.values)
+
+			if !equalStrings(values, field.values) {
+				if field.array {
+					raw, err = promapi.Marshal(values)
+				} else {
+					raw, err = promapi.Marshal(values[0])
+				}
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		buf.Write(raw)
+	}
+
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// equalStrings reports whether a and b contain the same strings
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
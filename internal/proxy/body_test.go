@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestFormBody(t *testing.T) {
+	body, err := parseBody(mediaTypeForm, nil, []byte("query=up%7Bhost%3D%22a%22%7D&time=1"))
+	if err != nil {
+		t.Fatalf("parseBody() error = %v", err)
+	}
+
+	body.params()["query"][0] = `up{instance="a"}`
+	encoded, err := body.encode()
+	if err != nil {
+		t.Fatalf("encode() error = %v", err)
+	}
+
+	want := url.Values{"query": {`up{instance="a"}`}, "time": {"1"}}.Encode()
+	if string(encoded) != want {
+		t.Errorf("encode() = %s, want %s", encoded, want)
+	}
+}
+
+func TestMultipartBody(t *testing.T) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	writer.WriteField("match[]", `up{host="a"}`)
+	writer.WriteField("match[]", `node_load1{host="a"}`)
+	file, _ := writer.CreateFormFile("query", "query.txt")
+	file.Write([]byte("file content"))
+	writer.WriteField("start", "1")
+	writer.Close()
+
+	body, err := parseBody(mediaTypeMultipart, map[string]string{"boundary": writer.Boundary()}, buf.Bytes())
+	if err != nil {
+		t.Fatalf("parseBody() error = %v", err)
+	}
+
+	params := body.params()
+	if want := (url.Values{"match[]": {`up{host="a"}`, `node_load1{host="a"}`}, "start": {"1"}}); !reflect.DeepEqual(params, want) {
+		t.Fatalf("params() = %v, want %v", params, want)
+	}
+	params["match[]"][1] = `node_load1{instance="a"}`
+
+	encoded, err := body.encode()
+	if err != nil {
+		t.Fatalf("encode() error = %v", err)
+	}
+
+	form, err := multipart.NewReader(bytes.NewReader(encoded), writer.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatalf("invalid multipart body: %v", err)
+	}
+	if want := []string{`up{host="a"}`, `node_load1{instance="a"}`}; !reflect.DeepEqual(form.Value["match[]"], want) {
+		t.Errorf("match[] = %v, want %v", form.Value["match[]"], want)
+	}
+	if len(form.File["query"]) != 1 {
+		t.Errorf("file part was not kept")
+	}
+}
+
+func TestJSONBody(t *testing.T) {
+	body, err := parseBody(mediaTypeJSON, nil, []byte(`{"query": "up{host=\"a\"} > 0", "match[]": ["a", "b"], "limit": 10}`))
+	if err != nil {
+		t.Fatalf("parseBody() error = %v", err)
+	}
+
+	params := body.params()
+	params["query"][0] = `up{instance="a"} > 0`
+	params["match[]"][1] = "c"
+
+	encoded, err := body.encode()
+	if err != nil {
+		t.Fatalf("encode() error = %v", err)
+	}
+
+	want := `{"query":"up{instance=\"a\"} > 0","match[]":["a","c"],"limit":10}`
+	if string(encoded) != want {
+		t.Errorf("encode() = %s, want %s", encoded, want)
+	}
+
+	if _, err := parseBody(mediaTypeJSON, nil, []byte(`["up"]`)); err == nil {
+		t.Errorf("parseBody() accepted a JSON array")
+	}
+}
@@ -0,0 +1,388 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/cache"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/fanout"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/promapi"
+)
+
+// cacheHeader tells clients whether a response was served from the cache
+const cacheHeader = "X-Prom-Relabel-Proxy-Cache"
+
+// Results of a cache lookup
+const (
+	cacheHit  = "hit"
+	cacheMiss = "miss"
+	// cacheCoalesced is a miss that shared the response of a concurrent
+	// identical request
+	cacheCoalesced = "coalesced"
+)
+
+// Endpoints whose responses are cached
+var (
+	queryCacheEndpoints = []string{
+		"/api/v1/query",
+		"/api/v1/query_range",
+	}
+	labelsCacheEndpoints = []string{
+		"/api/v1/labels",
+		"/api/v1/label/*/values",
+	}
+)
+
+// queryCache caches the rewritten responses of some endpoints
+type queryCache struct {
+	// name identifies the cache in metrics
+	name      string
+	endpoints []string
+	cfg       config.Cache
+	lru       *cache.LRU
+	// flights coalesces concurrent requests that miss the cache, if set
+	flights *flightGroup
+}
+
+// newCaches creates the enabled caches
+func newCaches(cfg config.Cache) []*queryCache {
+	var caches []*queryCache
+	if cfg.Enabled {
+		caches = append(caches, &queryCache{
+			name:      "query",
+			endpoints: queryCacheEndpoints,
+			cfg:       cfg,
+			lru:       cache.NewLRU(int64(cfg.MaxSizeMB) << 20),
+		})
+	}
+	if cfg.Labels.Enabled {
+		caches = append(caches, &queryCache{
+			name:      "labels",
+			endpoints: labelsCacheEndpoints,
+			cfg:       cfg,
+			lru:       cache.NewLRU(int64(cfg.Labels.MaxSizeMB) << 20),
+			flights:   &flightGroup{},
+		})
+	}
+	return caches
+}
+
+// cacheFor returns the cache of the endpoint at the path, if any
+func (p *PrometheusProxy) cacheFor(urlPath string) *queryCache {
+	for _, c := range p.caches {
+		if matchesEndpoint(urlPath, c.endpoints) {
+			return c
+		}
+	}
+	return nil
+}
+
+// request decides whether the response to a rewritten request can be
+// cached. If so, it aligns the time range of the request, so that
+// refreshes of a dashboard share cache entries, and returns the cache key
+// and the TTL of the response.
+func (c *queryCache) request(req *http.Request, info *requestInfo, query, form url.Values) (string, time.Duration) {
+	if c == nil || info.fanout {
+		return "", 0
+	}
+	if hasBody(req) && form == nil {
+		// The parameters of the body are unknown
+		return "", 0
+	}
+
+	now := time.Now()
+	end := now
+	switch req.URL.Path {
+	case "/api/v1/query_range":
+		start, err := promapi.ParseTime(formValue(query, form, "start"))
+		if err != nil {
+			return "", 0
+		}
+		end, err = promapi.ParseTime(formValue(query, form, "end"))
+		if err != nil {
+			return "", 0
+		}
+		step, err := promapi.ParseDuration(formValue(query, form, "step"))
+		if err != nil || step < time.Millisecond || end.Before(start) {
+			// Let the upstream report invalid parameters
+			return "", 0
+		}
+
+		if aligned := alignTime(start, step); !aligned.Equal(start) {
+			setFormValue(query, form, "start", promapi.FormatTime(aligned))
+		}
+		if aligned := alignTime(end, step); !aligned.Equal(end) {
+			end = aligned
+			setFormValue(query, form, "end", promapi.FormatTime(aligned))
+		}
+	case "/api/v1/query":
+		// Without a time, instant queries are evaluated at the current time
+		if value := formValue(query, form, "time"); value != "" {
+			t, err := promapi.ParseTime(value)
+			if err != nil {
+				return "", 0
+			}
+			end = t
+		}
+	default:
+		// Label names and values hardly change within the alignment, so
+		// the time range is widened to it
+		alignment := c.cfg.Labels.TimeAlignment
+		if value := formValue(query, form, "start"); value != "" {
+			start, err := promapi.ParseTime(value)
+			if err != nil {
+				return "", 0
+			}
+			if aligned := alignTime(start, alignment); !aligned.Equal(start) {
+				setFormValue(query, form, "start", promapi.FormatTime(aligned))
+			}
+		}
+		if value := formValue(query, form, "end"); value != "" {
+			end, err := promapi.ParseTime(value)
+			if err != nil {
+				return "", 0
+			}
+			if aligned := alignTime(end, alignment); !aligned.Equal(end) {
+				setFormValue(query, form, "end", promapi.FormatTime(aligned.Add(alignment)))
+			}
+		}
+		return requestKey(req, info, query, form, c.cfg.KeyHeaders), c.cfg.Labels.TTL
+	}
+
+	// Recent data may still change, so it is cached for a shorter time
+	ttl := c.cfg.TTL
+	if end.Before(now.Add(-c.cfg.RecentWindow)) {
+		ttl = c.cfg.HistoricalTTL
+	}
+
+	return requestKey(req, info, query, form, c.cfg.KeyHeaders), ttl
+}
+
+// requestKey identifies a rewritten request to the upstream with the given
+// parameters. The parameters are merged as Prometheus reads them, so GET and
+// POST requests share a key. The values of the key headers, such as the
+// credentials and tenant passed through to the upstream, are part of the
+// key, so clients only share responses they may read.
+func requestKey(req *http.Request, info *requestInfo, query, form url.Values, keyHeaders []string) string {
+	params := copyValues(form)
+	if params == nil {
+		params = make(url.Values, len(query))
+	}
+	for name, values := range query {
+		params[name] = append(params[name], values...)
+	}
+
+	h := sha256.New()
+	parts := []string{
+		info.backend.name,
+		info.profile,
+		req.URL.Path,
+		params.Encode(),
+	}
+	for _, name := range keyHeaders {
+		parts = append(parts, http.CanonicalHeaderKey(name), strings.Join(req.Header.Values(name), "\n"))
+	}
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// forward sends the rewritten request to its upstream, unless the response
+// is cached or shared with a concurrent identical request
+func (p *PrometheusProxy) forward(w http.ResponseWriter, req *http.Request, info *requestInfo) {
+	if info.cacheKey != "" {
+		if body, ok := info.cache.lru.Get(info.cacheKey); ok {
+			info.cacheResult = cacheHit
+			p.metrics.cacheRequests.WithLabelValues(info.cache.name, cacheHit).Inc()
+			serveCached(w, info, body)
+			return
+		}
+	}
+
+	if info.cacheKey != "" {
+		if info.cache.flights != nil {
+			p.serveCoalesced(w, req, info)
+			return
+		}
+		info.cacheResult = cacheMiss
+		p.metrics.cacheRequests.WithLabelValues(info.cache.name, cacheMiss).Inc()
+		w.Header().Set(cacheHeader, cacheMiss)
+		info.capture = &bodyCapture{max: info.cache.cfg.MaxEntrySizeMB << 20}
+	}
+
+	if info.coalesceKey != "" {
+		p.serveShared(w, req, info)
+	} else {
+		p.send(w, req, info)
+	}
+
+	if info.cacheKey == "" {
+		return
+	}
+	// Only the request that was sent caches its response
+	status, body, ok := info.capture.result()
+	if ok && status == http.StatusOK && len(body) <= info.cache.cfg.MaxEntrySizeMB<<20 {
+		info.cache.lru.Set(info.cacheKey, body, info.cacheTTL)
+	}
+}
+
+// send sends the rewritten request to its upstream, split into sub-queries
+// if enabled. Only requests sent to the upstream count towards the
+// concurrency limits, split requests once for each sub-query.
+func (p *PrometheusProxy) send(w http.ResponseWriter, req *http.Request, info *requestInfo) {
+	if ranges, params, ok := p.splitRange(req, info); ok {
+		p.serveSplit(w, req, info, ranges, params)
+		return
+	}
+
+	release, err := p.acquire(info)
+	if err != nil {
+		p.rejectRequest(w, req, err)
+		return
+	}
+	defer release()
+	info.backend.proxy.ServeHTTP(w, req)
+}
+
+// serveCoalesced sends a request that missed the cache to the upstream and
+// caches the response. Concurrent identical requests wait for the response
+// instead of sending their own, unless it could not be shared.
+func (p *PrometheusProxy) serveCoalesced(w http.ResponseWriter, req *http.Request, info *requestInfo) {
+	c := info.cache
+	fetch := func() fanout.Response {
+		release, err := p.acquire(info)
+		if err != nil {
+			return fanout.Response{Err: err}
+		}
+		defer release()
+
+		// Finish the request for the others if its client goes away
+		ctx := context.WithoutCancel(req.Context())
+		resp := p.roundTrip(subRequest(ctx, req, info, req.URL.Query(), nil))
+		if resp.Err == nil && resp.StatusCode == http.StatusOK && len(resp.Body) <= c.cfg.MaxEntrySizeMB<<20 {
+			c.lru.Set(info.cacheKey, resp.Body, info.cacheTTL)
+		}
+		return resp
+	}
+
+	var own fanout.Response
+	resp, shared := c.flights.do(req.Context(), info.cacheKey, func() fanout.Response {
+		own = fetch()
+		if own.Err != nil || !successful(own.StatusCode) {
+			return fanout.Response{Err: errNotShared}
+		}
+		return own
+	})
+	switch {
+	case !shared:
+		resp = own
+	case errors.Is(resp.Err, errNotShared):
+		resp, shared = fetch(), false
+	}
+
+	info.cacheResult = cacheMiss
+	if shared {
+		info.cacheResult = cacheCoalesced
+	}
+	p.metrics.cacheRequests.WithLabelValues(c.name, info.cacheResult).Inc()
+	w.Header().Set(cacheHeader, info.cacheResult)
+
+	var reqErr *requestError
+	if errors.As(resp.Err, &reqErr) {
+		p.rejectRequest(w, req, resp.Err)
+		return
+	}
+	if resp.Err != nil {
+		p.handleProxyError(w, req, resp.Err)
+		return
+	}
+	writeShared(w, info.acceptEncoding, resp)
+}
+
+// serveCached writes a cached response body
+func serveCached(w http.ResponseWriter, info *requestInfo, body []byte) {
+	w.Header().Set(cacheHeader, cacheHit)
+	writeBody(w, info.acceptEncoding, http.StatusOK, body)
+}
+
+// formValue returns the first value of a parameter, preferring the body
+// as Prometheus does
+func formValue(query, form url.Values, name string) string {
+	if values := form[name]; len(values) > 0 {
+		return values[0]
+	}
+	return query.Get(name)
+}
+
+// setFormValue replaces the first value of a parameter wherever it is set
+func setFormValue(query, form url.Values, name, value string) {
+	for _, params := range []url.Values{query, form} {
+		if values := params[name]; len(values) > 0 {
+			values[0] = value
+		}
+	}
+}
+
+// alignTime rounds t down to a multiple of step since the Unix epoch. Steps
+// under a millisecond leave t at millisecond precision.
+func alignTime(t time.Time, step time.Duration) time.Time {
+	ms := t.UnixMilli()
+	stepMs := step.Milliseconds()
+	if stepMs <= 0 {
+		return time.UnixMilli(ms).UTC()
+	}
+	offset := ms % stepMs
+	if offset < 0 {
+		offset += stepMs
+	}
+	return time.UnixMilli(ms - offset).UTC()
+}
+
+// bodyCapture keeps a copy of the rewritten response body sent to the
+// client. Bodies larger than max are dropped, but writes never fail.
+type bodyCapture struct {
+	buf      bytes.Buffer
+	max      int
+	overflow bool
+	// status and header are set once the whole body was rewritten
+	status int
+	header http.Header
+}
+
+func (c *bodyCapture) Write(p []byte) (int, error) {
+	if c.overflow {
+		return len(p), nil
+	}
+	if c.buf.Len()+len(p) > c.max {
+		c.overflow = true
+		c.buf = bytes.Buffer{}
+		return len(p), nil
+	}
+	return c.buf.Write(p)
+}
+
+// finish marks the body of a response with the status code and headers as
+// complete
+func (c *bodyCapture) finish(status int, header http.Header) {
+	c.status = status
+	c.header = sharedHeader(header)
+}
+
+// result returns the status code and body of the response if the whole
+// body was kept
+func (c *bodyCapture) result() (int, []byte, bool) {
+	if c == nil || c.status == 0 || c.overflow {
+		return 0, nil, false
+	}
+	return c.status, c.buf.Bytes(), true
+}
@@ -0,0 +1,305 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+func TestQueryCache(t *testing.T) {
+	var upstreamQueries []url.Values
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamQueries = append(upstreamQueries, r.URL.Query())
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("query") == "fail" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"status":"error","errorType":"execution","error":"failed"}`))
+			return
+		}
+		w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"host":"a"},"values":[[1718000000,"1"]]}]}}`))
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		TargetPrometheus: upstream.URL,
+		Mappings: []config.Mapping{
+			{
+				Direction: config.DirectionResult,
+				Rules:     []config.Rule{{SourceLabel: "host", TargetLabel: "instance"}},
+			},
+		},
+		Cache: config.Cache{Enabled: true},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	get := func(rawQuery string) (*http.Response, string) {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query_range?"+rawQuery, nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		resp := rec.Result()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	want := `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"instance":"a"},"values":[[1718000000,"1"]]}]}}`
+
+	// Refreshes within the same step share the aligned time range
+	resp, body := get("query=up&start=1718000005&end=1718003605&step=60")
+	if body != want || resp.Header.Get(cacheHeader) != cacheMiss {
+		t.Fatalf("first response = %s (cache %q), want %s (cache miss)", body, resp.Header.Get(cacheHeader), want)
+	}
+	resp, body = get("query=up&start=1718000010&end=1718003610&step=60")
+	if body != want || resp.Header.Get(cacheHeader) != cacheHit {
+		t.Fatalf("second response = %s (cache %q), want %s (cache hit)", body, resp.Header.Get(cacheHeader), want)
+	}
+	if len(upstreamQueries) != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", len(upstreamQueries))
+	}
+	if start, end := upstreamQueries[0].Get("start"), upstreamQueries[0].Get("end"); start != "1717999980" || end != "1718003580" {
+		t.Errorf("upstream range = %s to %s, want 1717999980 to 1718003580", start, end)
+	}
+
+	// Cached responses are encoded as accepted by the client
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query_range?query=up&start=1718000005&end=1718003605&step=60", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Errorf("Content-Encoding = %q, want gzip", encoding)
+	}
+
+	// Errors are not cached
+	get("query=fail&start=1718000000&end=1718003600&step=60")
+	get("query=fail&start=1718000000&end=1718003600&step=60")
+	if len(upstreamQueries) != 3 {
+		t.Errorf("expected errors to reach the upstream each time, got %d upstream requests", len(upstreamQueries))
+	}
+}
+
+func TestQueryCacheKeyHeaders(t *testing.T) {
+	var requests int
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+
+	tests := []struct {
+		name       string
+		keyHeaders []string
+		header     string
+		values     []string
+		wantSent   int
+	}{
+		{name: "tenant header", header: "X-Scope-OrgID", values: []string{"a", "b", "a"}, wantSent: 2},
+		{name: "cookie", header: "Cookie", values: []string{"session=a", "session=b"}, wantSent: 2},
+		{name: "configured header", keyHeaders: []string{"x-tenant"}, header: "X-Tenant", values: []string{"a", "b"}, wantSent: 2},
+		{name: "header not in key", keyHeaders: []string{"X-Tenant"}, header: "X-Scope-OrgID", values: []string{"a", "b"}, wantSent: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				TargetPrometheus: upstream.URL,
+				Cache:            config.Cache{Enabled: true, KeyHeaders: tt.keyHeaders},
+			}
+			p, err := New(cfg, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+
+			requests = 0
+			for _, value := range tt.values {
+				req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&time=1718000000", nil)
+				req.Header.Set(tt.header, value)
+				p.ServeHTTP(httptest.NewRecorder(), req)
+			}
+			if requests != tt.wantSent {
+				t.Errorf("expected %d upstream requests, got %d", tt.wantSent, requests)
+			}
+		})
+	}
+}
+
+func TestQueryCacheTTL(t *testing.T) {
+	c := newCaches(config.Cache{
+		Enabled:       true,
+		MaxSizeMB:     1,
+		TTL:           time.Minute,
+		HistoricalTTL: time.Hour,
+		RecentWindow:  10 * time.Minute,
+	})[0]
+	info := &requestInfo{backend: &backend{name: "default"}}
+	now := time.Now()
+
+	tests := []struct {
+		name  string
+		path  string
+		query url.Values
+		want  time.Duration
+	}{
+		{
+			name:  "recent range",
+			path:  "/api/v1/query_range",
+			query: url.Values{"query": {"up"}, "start": {unix(now.Add(-time.Hour))}, "end": {unix(now)}, "step": {"15s"}},
+			want:  time.Minute,
+		},
+		{
+			name:  "historical range",
+			path:  "/api/v1/query_range",
+			query: url.Values{"query": {"up"}, "start": {unix(now.Add(-48 * time.Hour))}, "end": {unix(now.Add(-24 * time.Hour))}, "step": {"15s"}},
+			want:  time.Hour,
+		},
+		{
+			name:  "instant query at the current time",
+			path:  "/api/v1/query",
+			query: url.Values{"query": {"up"}},
+			want:  time.Minute,
+		},
+		{
+			name:  "historical instant query",
+			path:  "/api/v1/query",
+			query: url.Values{"query": {"up"}, "time": {unix(now.Add(-time.Hour))}},
+			want:  time.Hour,
+		},
+		{
+			name:  "invalid range",
+			path:  "/api/v1/query_range",
+			query: url.Values{"query": {"up"}, "start": {"yesterday"}, "end": {unix(now)}, "step": {"15s"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			key, ttl := c.request(req, info, tt.query, nil)
+			if ttl != tt.want || (key != "") != (tt.want != 0) {
+				t.Errorf("request() = %q, %v, want TTL %v", key, ttl, tt.want)
+			}
+		})
+	}
+}
+
+// unix formats t as Unix seconds
+func unix(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
+func TestLabelsCache(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []url.Values
+	)
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.URL.Query())
+		mu.Unlock()
+		<-release
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":["__name__","host","job"]}`))
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		TargetPrometheus: upstream.URL,
+		Mappings: []config.Mapping{
+			{
+				Direction: config.DirectionResult,
+				Rules:     []config.Rule{{SourceLabel: "host", TargetLabel: "instance"}},
+			},
+		},
+		Cache: config.Cache{Labels: config.LabelsCache{Enabled: true}},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	get := func(rawQuery string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/labels?"+rawQuery, nil)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Concurrent identical requests share one upstream request
+	recs := make([]*httptest.ResponseRecorder, 5)
+	var wg sync.WaitGroup
+	for i := range recs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			recs[i] = get("match[]=up&start=1718000005&end=1718003605")
+		}(i)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	want := `{"status":"success","data":["__name__","instance","job"]}`
+	results := make(map[string]int)
+	for _, rec := range recs {
+		if body := rec.Body.String(); body != want {
+			t.Errorf("response = %s, want %s", body, want)
+		}
+		results[rec.Header().Get(cacheHeader)]++
+	}
+	if results[cacheMiss] != 1 || results[cacheCoalesced] != 4 {
+		t.Errorf("cache results = %v, want 1 miss and 4 coalesced", results)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("expected 1 upstream request, got %d", len(requests))
+	}
+	if start, end := requests[0].Get("start"), requests[0].Get("end"); start != "1717999980" || end != "1718003640" {
+		t.Errorf("upstream range = %s to %s, want 1717999980 to 1718003640", start, end)
+	}
+
+	// Requests within the same minute are served from the cache
+	rec := get("match[]=up&start=1718000010&end=1718003610")
+	if rec.Header().Get(cacheHeader) != cacheHit || rec.Body.String() != want {
+		t.Errorf("response = %s (cache %q), want %s (cache hit)", rec.Body.String(), rec.Header().Get(cacheHeader), want)
+	}
+
+	// Other selectors are not
+	get("match[]=node_load1&start=1718000010&end=1718003610")
+	if len(requests) != 2 {
+		t.Errorf("expected 2 upstream requests, got %d", len(requests))
+	}
+}
+
+func TestAlignTime(t *testing.T) {
+	tests := []struct {
+		t    time.Time
+		step time.Duration
+		want time.Time
+	}{
+		{t: time.Unix(1718000005, 0), step: time.Minute, want: time.Unix(1717999980, 0)},
+		{t: time.Unix(1718000040, 0), step: time.Minute, want: time.Unix(1718000040, 0)},
+		{t: time.Unix(-5, 0), step: time.Minute, want: time.Unix(-60, 0)},
+		// Steps under a millisecond do not align
+		{t: time.UnixMilli(1718000000123), step: 500 * time.Microsecond, want: time.UnixMilli(1718000000123)},
+		{t: time.UnixMilli(1718000000123), step: 0, want: time.UnixMilli(1718000000123)},
+	}
+
+	for _, tt := range tests {
+		if got := alignTime(tt.t, tt.step); !got.Equal(tt.want) {
+			t.Errorf("alignTime(%s, %s) = %s, want %s", tt.t, tt.step, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/fanout"
+)
+
+// errNotShared is the error of a flight whose response could not be
+// shared, e.g. because it was too large or its client went away
+var errNotShared = errors.New("response not shared")
+
+// coalescer shares the responses of upstream requests with concurrent
+// identical requests
+type coalescer struct {
+	maxSize int
+	// keyHeaders are the request headers that must be identical, as for
+	// the cache
+	keyHeaders []string
+	flights    flightGroup
+}
+
+// newCoalescer creates a coalescer if coalescing is enabled
+func newCoalescer(cfg config.Coalesce, keyHeaders []string) *coalescer {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &coalescer{maxSize: cfg.MaxResponseSizeMB << 20, keyHeaders: keyHeaders}
+}
+
+// coalesceKey returns the key that identifies identical rewritten read
+// requests, or an empty string if the request is not coalesced
+func (p *PrometheusProxy) coalesceKey(req *http.Request, info *requestInfo, query, form url.Values) string {
+	if p.coalescer == nil || info.fanout {
+		return ""
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		return ""
+	}
+	if !matchesEndpoint(req.URL.Path, readEndpoints) {
+		return ""
+	}
+	if hasBody(req) && form == nil {
+		// The parameters of the body are unknown
+		return ""
+	}
+	return requestKey(req, info, query, form, p.coalescer.keyHeaders)
+}
+
+// serveShared sends a rewritten request to its upstream and shares the
+// response with concurrent identical requests, which wait for it instead of
+// sending their own. The response is streamed to the client of the first
+// request while a copy is kept. Waiting requests get its status, body and
+// shared headers. If the upstream did not answer with success or no copy
+// could be kept, the waiting requests are sent after all.
+func (p *PrometheusProxy) serveShared(w http.ResponseWriter, req *http.Request, info *requestInfo) {
+	co := p.coalescer
+	resp, shared := co.flights.do(req.Context(), info.coalesceKey, func() fanout.Response {
+		if info.capture == nil {
+			info.capture = &bodyCapture{max: co.maxSize}
+		} else if info.capture.max < co.maxSize {
+			info.capture.max = co.maxSize
+		}
+		p.send(w, req, info)
+
+		// Errors may be transient, so the waiting requests retry them
+		status, body, ok := info.capture.result()
+		if !ok || !successful(status) || len(body) > co.maxSize {
+			return fanout.Response{Err: errNotShared}
+		}
+		return fanout.Response{StatusCode: status, Header: info.capture.header, Body: body}
+	})
+	if !shared {
+		return
+	}
+
+	if errors.Is(resp.Err, errNotShared) {
+		p.send(w, req, info)
+		return
+	}
+	if resp.Err != nil {
+		// The client went away while waiting
+		return
+	}
+	info.coalesced = true
+	p.metrics.coalescedRequests.Inc()
+	writeShared(w, info.acceptEncoding, resp)
+}
+
+// successful reports whether a response with the status code can be shared
+func successful(status int) bool {
+	return status >= 200 && status < 300
+}
+
+// flightGroup coalesces concurrent identical upstream requests
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is an upstream request in flight
+type flight struct {
+	done chan struct{}
+	resp fanout.Response
+}
+
+// do calls fn and returns its response, unless a call with the same key is
+// in flight, in which case it waits for that call and returns its response
+// instead. shared reports whether the response came from another call.
+func (g *flightGroup) do(ctx context.Context, key string, fn func() fanout.Response) (resp fanout.Response, shared bool) {
+	g.mu.Lock()
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.resp, true
+		case <-ctx.Done():
+			return fanout.Response{Err: ctx.Err()}, true
+		}
+	}
+
+	// The waiters are not sent a response if fn panics, e.g. when the
+	// reverse proxy aborts a response
+	f := &flight{done: make(chan struct{}), resp: fanout.Response{Err: errNotShared}}
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.flights, key)
+		g.mu.Unlock()
+		close(f.done)
+	}()
+	f.resp = fn()
+	return f.resp, false
+}
@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+func TestCoalesce(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		release  chan struct{}
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		wait := release
+		mu.Unlock()
+		<-wait
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"host":"a"},"values":[[1718000000,"1"]]}]}}`))
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		TargetPrometheus: upstream.URL,
+		Mappings: []config.Mapping{
+			{
+				Direction: config.DirectionResult,
+				Rules:     []config.Rule{{SourceLabel: "host", TargetLabel: "instance"}},
+			},
+		},
+		Coalesce: config.Coalesce{Enabled: true},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	const params = "query=up&start=1718000000&end=1718003600&step=60"
+	newRequest := func(i int) *http.Request {
+		// GET and POST requests with the same parameters are identical
+		if i%2 == 0 {
+			return httptest.NewRequest(http.MethodGet, "/api/v1/query_range?"+params, nil)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/query_range", strings.NewReader(params))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req
+	}
+
+	// run serves n concurrent requests while the upstream is blocked and
+	// returns the number of upstream requests
+	run := func(n int, newRequest func(i int) *http.Request) ([]*httptest.ResponseRecorder, int) {
+		mu.Lock()
+		requests = 0
+		release = make(chan struct{})
+		mu.Unlock()
+
+		recs := make([]*httptest.ResponseRecorder, n)
+		var wg sync.WaitGroup
+		for i := range recs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				recs[i] = httptest.NewRecorder()
+				p.ServeHTTP(recs[i], newRequest(i))
+			}(i)
+		}
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		mu.Lock()
+		defer mu.Unlock()
+		return recs, requests
+	}
+
+	want := `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"instance":"a"},"values":[[1718000000,"1"]]}]}}`
+
+	recs, sent := run(5, newRequest)
+	if sent != 1 {
+		t.Errorf("expected 1 upstream request, got %d", sent)
+	}
+	for _, rec := range recs {
+		if rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("response = %d %s, want 200 %s", rec.Code, rec.Body.String(), want)
+		}
+	}
+
+	// Requests with different credentials do not share responses
+	_, sent = run(2, func(i int) *http.Request {
+		req := newRequest(0)
+		req.Header.Set("Authorization", "Bearer token"+string(rune('a'+i)))
+		return req
+	})
+	if sent != 2 {
+		t.Errorf("expected 2 upstream requests for different credentials, got %d", sent)
+	}
+
+	// Requests for different tenants do not share responses
+	_, sent = run(2, func(i int) *http.Request {
+		req := newRequest(0)
+		req.Header.Set("X-Scope-OrgID", "tenant"+string(rune('a'+i)))
+		return req
+	})
+	if sent != 2 {
+		t.Errorf("expected 2 upstream requests for different tenants, got %d", sent)
+	}
+
+	// Waiting requests send their own if the response is too large to share
+	p.coalescer.maxSize = 10
+	recs, sent = run(3, newRequest)
+	if sent != 3 {
+		t.Errorf("expected 3 upstream requests for large responses, got %d", sent)
+	}
+	for _, rec := range recs {
+		if rec.Code != http.StatusOK || rec.Body.String() != want {
+			t.Errorf("response = %d %s, want 200 %s", rec.Code, rec.Body.String(), want)
+		}
+	}
+}
+
+func TestCoalesceErrors(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		status   int
+		release  chan struct{}
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		code, wait := status, release
+		mu.Unlock()
+		<-wait
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Warning", `199 - "partial response"`)
+		w.WriteHeader(code)
+		if code == http.StatusOK {
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		} else {
+			w.Write([]byte(`{"status":"error","errorType":"timeout","error":"query timed out"}`))
+		}
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		TargetPrometheus: upstream.URL,
+		Coalesce:         config.Coalesce{Enabled: true},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	run := func(code int) ([]*httptest.ResponseRecorder, int) {
+		mu.Lock()
+		requests, status = 0, code
+		release = make(chan struct{})
+		mu.Unlock()
+
+		recs := make([]*httptest.ResponseRecorder, 3)
+		var wg sync.WaitGroup
+		for i := range recs {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				recs[i] = httptest.NewRecorder()
+				p.ServeHTTP(recs[i], httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil))
+			}(i)
+		}
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		mu.Lock()
+		defer mu.Unlock()
+		return recs, requests
+	}
+
+	// The headers of shared responses are passed on
+	recs, sent := run(http.StatusOK)
+	if sent != 1 {
+		t.Errorf("expected 1 upstream request, got %d", sent)
+	}
+	for _, rec := range recs {
+		if got := rec.Header().Get("Content-Type"); got != "application/json; charset=utf-8" {
+			t.Errorf("Content-Type = %q", got)
+		}
+		if got := rec.Header().Get("Warning"); got != `199 - "partial response"` {
+			t.Errorf("Warning = %q", got)
+		}
+	}
+
+	// Errors are not shared, the waiting requests are retried
+	recs, sent = run(http.StatusServiceUnavailable)
+	if sent != 3 {
+		t.Errorf("expected 3 upstream requests for errors, got %d", sent)
+	}
+	for _, rec := range recs {
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("status = %d, want 503", rec.Code)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"errors"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/promapi"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/ratelimit"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/upstream"
+)
+
+// requestError is an error that rejects the request with a status code
+type requestError struct {
+	status int
+	err    error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func (e *requestError) Unwrap() error {
+	return e.err
+}
+
+// errorStatus returns the HTTP status code for an error rejecting a request
+func errorStatus(err error) int {
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		return reqErr.status
+	}
+	return http.StatusInternalServerError
+}
+
+// writeError writes a Prometheus API error response for an error rejecting
+// a request
+func writeError(w http.ResponseWriter, err error) {
+	// Tell rate limited clients when to retry, in whole seconds
+	var limitErr *ratelimit.Error
+	if errors.As(err, &limitErr) {
+		seconds := math.Max(1, math.Ceil(limitErr.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(int(seconds)))
+	}
+
+	status := errorStatus(err)
+	promapi.WriteError(w, status, promapi.ErrorTypeForStatus(status), err.Error())
+}
+
+// handleProxyError is the ErrorHandler of the reverse proxies. It handles
+// errors reaching the upstream and errors rewriting its response.
+func (p *PrometheusProxy) handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	ctx := r.Context()
+	trace.SpanFromContext(ctx).RecordError(err)
+
+	var reqErr *requestError
+	if errors.As(err, &reqErr) {
+		p.logger.WarnContext(ctx, "failed to rewrite response", slog.Any("error", err))
+		writeError(w, err)
+		return
+	}
+
+	if errors.Is(err, upstream.ErrBreakerOpen) {
+		p.logger.WarnContext(ctx, "upstream request rejected", slog.Any("error", err))
+		promapi.WriteError(w, http.StatusServiceUnavailable, promapi.ErrorUnavailable, "upstream unavailable: "+err.Error())
+		return
+	}
+
+	status, errorType := promapi.UpstreamErrorStatus(err)
+	p.logger.ErrorContext(ctx, "upstream request failed", slog.Any("error", err))
+	promapi.WriteError(w, status, errorType, "upstream request failed: "+err.Error())
+}
@@ -0,0 +1,195 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/fanout"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/tracing"
+)
+
+// fanoutRequest is the request sent to one upstream of a fan-out
+type fanoutRequest struct {
+	backend *backend
+	req     *http.Request
+	info    *requestInfo
+}
+
+// fanoutEndpoint returns the fan-out endpoint of the request if fan-out is
+// enabled and supported for it
+func (p *PrometheusProxy) fanoutEndpoint(req *http.Request) (fanout.Endpoint, bool) {
+	if len(p.fanout) == 0 {
+		return 0, false
+	}
+
+	return fanout.EndpointFor(p.apiPath(req))
+}
+
+// apiPath returns the API path of the request without a profile path prefix
+func (p *PrometheusProxy) apiPath(req *http.Request) string {
+	urlPath := req.URL.Path
+	if p.profileSelection.PathPrefix && strings.HasPrefix(urlPath, profilePathPrefix) {
+		_, remainder, _ := strings.Cut(strings.TrimPrefix(urlPath, profilePathPrefix), "/")
+		urlPath = "/" + remainder
+	}
+	return urlPath
+}
+
+// serveFanout sends the request to all fan-out upstreams concurrently and
+// writes their merged results. The request to each upstream counts
+// separately towards the concurrency limits.
+func (p *PrometheusProxy) serveFanout(w http.ResponseWriter, req *http.Request, endpoint fanout.Endpoint) {
+	ctx := req.Context()
+	info := requestInfoFromContext(ctx)
+
+	var body []byte
+	if hasBody(req) {
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		if err != nil {
+			writeError(w, &requestError{status: http.StatusBadRequest, err: fmt.Errorf("failed to read request body: %w", err)})
+			return
+		}
+	}
+
+	requests, err := p.fanoutRequests(req, body)
+	if err != nil {
+		p.logger.WarnContext(ctx, "rejected request", slog.Any("error", err))
+		trace.SpanFromContext(ctx).RecordError(err)
+		writeError(w, err)
+		return
+	}
+
+	info.profile = requests[0].info.profile
+	info.originalQueries = requests[0].info.originalQueries
+	for _, fr := range requests {
+		info.upstreams = append(info.upstreams, fr.backend.name)
+		info.rewrittenQueries = append(info.rewrittenQueries, fr.info.rewrittenQueries...)
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.StringSlice("upstreams", info.upstreams))
+
+	responses := make([]fanout.Response, len(requests))
+	var wg sync.WaitGroup
+	for i, fr := range requests {
+		wg.Add(1)
+		go func(i int, fr fanoutRequest) {
+			defer wg.Done()
+			release, err := p.acquire(info)
+			if err != nil {
+				responses[i] = fanout.Response{Upstream: fr.backend.name, Err: err}
+				return
+			}
+			defer release()
+			responses[i] = p.roundTrip(fr)
+		}(i, fr)
+	}
+	wg.Wait()
+
+	// Upstream requests rejected by the limiter reject the whole request
+	for _, resp := range responses {
+		var reqErr *requestError
+		if errors.As(resp.Err, &reqErr) {
+			p.rejectRequest(w, req, resp.Err)
+			return
+		}
+	}
+
+	_, span := tracing.Tracer().Start(ctx, "merge responses",
+		trace.WithAttributes(attribute.Int("upstreams", len(responses))),
+	)
+	merger := &fanout.Merger{Endpoint: endpoint, ReplicaLabel: p.replicaLabel}
+	if endpoint == fanout.EndpointLabelValues {
+		// The label name as requested by the client, before rewriting
+		merger.LabelName = fanout.LabelNameFromPath(p.apiPath(req))
+	}
+	status, merged := merger.Merge(responses)
+	span.End()
+
+	for _, resp := range responses {
+		if resp.Err != nil {
+			p.logger.WarnContext(ctx, "fan-out upstream failed",
+				slog.String("upstream", resp.Upstream),
+				slog.Any("error", resp.Err),
+			)
+		}
+	}
+
+	writeBody(w, info.acceptEncoding, status, merged)
+}
+
+// fanoutRequests rewrites a copy of the request for each fan-out upstream.
+// Upstreams whose external labels exclude all series selected by the query
+// are skipped, unless none remain.
+func (p *PrometheusProxy) fanoutRequests(req *http.Request, body []byte) ([]fanoutRequest, error) {
+	var requests, skipped []fanoutRequest
+	for _, b := range p.fanout {
+		info := &requestInfo{rewriter: p.rewriter, fanout: true}
+		outReq := req.Clone(context.WithValue(req.Context(), requestInfoKey{}, info))
+		if body != nil {
+			outReq.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+
+		if err := p.rewriteRequest(outReq, b); err != nil {
+			return nil, err
+		}
+
+		fr := fanoutRequest{backend: b, req: outReq, info: info}
+		if info.noMatch {
+			skipped = append(skipped, fr)
+		} else {
+			requests = append(requests, fr)
+		}
+	}
+
+	// Query one upstream anyway to return an empty result of the right type
+	if len(requests) == 0 {
+		requests = skipped[:1]
+	}
+	return requests, nil
+}
+
+// roundTrip sends a fan-out request to its upstream and returns the
+// rewritten response
+func (p *PrometheusProxy) roundTrip(fr fanoutRequest) fanout.Response {
+	result := fanout.Response{
+		Upstream:       fr.backend.name,
+		ExternalLabels: fr.backend.externalLabels,
+	}
+
+	if !fr.backend.available() {
+		result.Err = errUnavailable
+		return result
+	}
+
+	req := fr.req
+	fr.backend.proxy.Director(req)
+	req.RequestURI = ""
+
+	resp, err := fr.backend.transport.RoundTrip(req)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+
+	if err := p.rewriteResponse(resp); err != nil {
+		resp.Body.Close()
+		result.Err = err
+		return result
+	}
+	defer resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+	result.Header = sharedHeader(resp.Header)
+	result.Body, result.Err = ioutil.ReadAll(resp.Body)
+	return result
+}
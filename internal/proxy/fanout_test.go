@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+func TestFanoutEncoding(t *testing.T) {
+	newUpstream := func(host string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"host":"` + host + `"},"value":[1718000000,"1"]}]}}`))
+		}))
+	}
+	eu, us := newUpstream("a"), newUpstream("b")
+	defer eu.Close()
+	defer us.Close()
+
+	cfg := &config.Config{
+		Upstreams: []config.UpstreamServer{
+			{Name: "eu", URL: eu.URL},
+			{Name: "us", URL: us.URL},
+		},
+		Fanout: config.Fanout{Enabled: true},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q, want gzip", got)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"host":"a"},"value":[1718000000,"1"]},{"metric":{"host":"b"},"value":[1718000000,"1"]}]}}`
+	if string(body) != want {
+		t.Errorf("body = %s, want %s", body, want)
+	}
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics are the metrics exported by the proxy
+type metrics struct {
+	failovers     *prometheus.CounterVec
+	cacheRequests *prometheus.CounterVec
+	// coalescedRequests counts requests that shared another's response
+	coalescedRequests prometheus.Counter
+	rateLimited       *prometheus.CounterVec
+
+	upstreamUp     *prometheus.Desc
+	breakerState   *prometheus.Desc
+	upstreamActive *prometheus.Desc
+
+	cacheEntries   *prometheus.Desc
+	cacheSize      *prometheus.Desc
+	cacheEvictions *prometheus.Desc
+
+	rateLimitClients *prometheus.Desc
+	requestsInFlight *prometheus.Desc
+}
+
+// newMetrics creates the proxy metrics
+func newMetrics() *metrics {
+	return &metrics{
+		failovers: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prom_relabel_proxy_upstream_failovers_total",
+			Help: "Total number of read requests sent to a failover upstream because the routed upstream was unavailable.",
+		}, []string{"upstream", "failover"}),
+		cacheRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prom_relabel_proxy_cache_requests_total",
+			Help: "Total number of cacheable requests by cache and result (hit, miss or coalesced).",
+		}, []string{"cache", "result"}),
+		coalescedRequests: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prom_relabel_proxy_coalesced_requests_total",
+			Help: "Total number of requests served with the upstream response of a concurrent identical request.",
+		}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "prom_relabel_proxy_rate_limited_requests_total",
+			Help: "Total number of requests rejected by a rate or concurrency limit, by scope (client or global) and reason (rate or concurrency).",
+		}, []string{"scope", "reason"}),
+		upstreamUp: prometheus.NewDesc(
+			"prom_relabel_proxy_upstream_up",
+			"Whether the last health check of the upstream succeeded.",
+			[]string{"upstream"}, nil,
+		),
+		breakerState: prometheus.NewDesc(
+			"prom_relabel_proxy_upstream_circuit_breaker_state",
+			"State of the upstream's circuit breaker (0 closed, 1 half-open, 2 open).",
+			[]string{"upstream"}, nil,
+		),
+		upstreamActive: prometheus.NewDesc(
+			"prom_relabel_proxy_upstream_active",
+			"Whether the upstream currently serves read requests, either routed to it or failed over to it.",
+			[]string{"upstream"}, nil,
+		),
+		cacheEntries: prometheus.NewDesc(
+			"prom_relabel_proxy_cache_entries",
+			"Number of responses in the cache.",
+			[]string{"cache"}, nil,
+		),
+		cacheSize: prometheus.NewDesc(
+			"prom_relabel_proxy_cache_size_bytes",
+			"Total size of the responses in the cache.",
+			[]string{"cache"}, nil,
+		),
+		cacheEvictions: prometheus.NewDesc(
+			"prom_relabel_proxy_cache_evictions_total",
+			"Total number of responses evicted from the cache to make room for others.",
+			[]string{"cache"}, nil,
+		),
+		rateLimitClients: prometheus.NewDesc(
+			"prom_relabel_proxy_rate_limit_clients",
+			"Number of clients tracked by the rate limiter.",
+			nil, nil,
+		),
+		requestsInFlight: prometheus.NewDesc(
+			"prom_relabel_proxy_upstream_requests_in_flight",
+			"Number of requests in flight to the upstreams, as counted by the concurrency limits.",
+			nil, nil,
+		),
+	}
+}
+
+// Describe implements the prometheus.Collector interface
+func (p *PrometheusProxy) Describe(ch chan<- *prometheus.Desc) {
+	p.metrics.failovers.Describe(ch)
+	p.metrics.cacheRequests.Describe(ch)
+	p.metrics.coalescedRequests.Describe(ch)
+	p.metrics.rateLimited.Describe(ch)
+	ch <- p.metrics.upstreamUp
+	ch <- p.metrics.breakerState
+	ch <- p.metrics.upstreamActive
+	ch <- p.metrics.cacheEntries
+	ch <- p.metrics.cacheSize
+	ch <- p.metrics.cacheEvictions
+	ch <- p.metrics.rateLimitClients
+	ch <- p.metrics.requestsInFlight
+}
+
+// Collect implements the prometheus.Collector interface
+func (p *PrometheusProxy) Collect(ch chan<- prometheus.Metric) {
+	p.metrics.failovers.Collect(ch)
+	p.metrics.cacheRequests.Collect(ch)
+	p.metrics.coalescedRequests.Collect(ch)
+	p.metrics.rateLimited.Collect(ch)
+
+	// Upstreams that requests are only failed over to, not routed to, are
+	// active while an upstream fails over to them
+	routed := map[string]bool{p.defaultBackend: true}
+	for _, rt := range p.routes {
+		routed[rt.Upstream] = true
+	}
+	for _, b := range p.backends {
+		if b.failover != "" && !routed[b.failover] {
+			routed[b.failover] = false
+		}
+	}
+	active := make(map[string]bool)
+	for _, b := range p.backends {
+		if isRouted, ok := routed[b.name]; isRouted || !ok {
+			active[p.failover(b).name] = true
+		}
+	}
+
+	for _, b := range p.backends {
+		ch <- prometheus.MustNewConstMetric(p.metrics.upstreamUp, prometheus.GaugeValue, boolValue(b.checker.Healthy()), b.name)
+		ch <- prometheus.MustNewConstMetric(p.metrics.breakerState, prometheus.GaugeValue, float64(b.breaker.State()), b.name)
+		ch <- prometheus.MustNewConstMetric(p.metrics.upstreamActive, prometheus.GaugeValue, boolValue(active[b.name]), b.name)
+	}
+
+	for _, c := range p.caches {
+		entries, size, evictions := c.lru.Stats()
+		ch <- prometheus.MustNewConstMetric(p.metrics.cacheEntries, prometheus.GaugeValue, float64(entries), c.name)
+		ch <- prometheus.MustNewConstMetric(p.metrics.cacheSize, prometheus.GaugeValue, float64(size), c.name)
+		ch <- prometheus.MustNewConstMetric(p.metrics.cacheEvictions, prometheus.CounterValue, float64(evictions), c.name)
+	}
+
+	if p.limiter != nil {
+		clients, inFlight := p.limiter.Stats()
+		ch <- prometheus.MustNewConstMetric(p.metrics.rateLimitClients, prometheus.GaugeValue, float64(clients))
+		ch <- prometheus.MustNewConstMetric(p.metrics.requestsInFlight, prometheus.GaugeValue, float64(inFlight))
+	}
+}
+
+// boolValue returns 1 for true and 0 for false
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
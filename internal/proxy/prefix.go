@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type listenerPathPrefixKey struct{}
+
+// pathPrefix returns the path prefix the request was sent under: the
+// listener's if it has one, else the server's
+func (p *PrometheusProxy) pathPrefix(ctx context.Context) string {
+	if prefix, ok := ctx.Value(listenerPathPrefixKey{}).(string); ok && prefix != "" {
+		return strings.TrimSuffix(prefix, "/")
+	}
+	return p.serverPathPrefix
+}
+
+// stripPathPrefix removes the path prefix the proxy is served under from
+// the request URL. Requests outside of the prefix are rejected.
+func (p *PrometheusProxy) stripPathPrefix(req *http.Request) error {
+	prefix := p.pathPrefix(req.Context())
+	if prefix == "" {
+		return nil
+	}
+
+	rest, ok := trimPathPrefix(req.URL.Path, prefix)
+	if !ok {
+		return &requestError{status: http.StatusNotFound, err: fmt.Errorf("path %s is not under %s", req.URL.Path, prefix)}
+	}
+	req.URL.Path = rest
+	if req.URL.RawPath != "" {
+		req.URL.RawPath, _ = trimPathPrefix(req.URL.RawPath, prefix)
+	}
+	return nil
+}
+
+// trimPathPrefix removes a prefix of whole path segments from urlPath. The
+// result is an absolute path.
+func trimPathPrefix(urlPath, prefix string) (string, bool) {
+	if !strings.HasPrefix(urlPath, prefix) {
+		return urlPath, false
+	}
+	rest := urlPath[len(prefix):]
+	if rest != "" && !strings.HasPrefix(rest, "/") {
+		return urlPath, false
+	}
+	return "/" + strings.TrimPrefix(rest, "/"), true
+}
+
+// externalPrefix returns the part of the client's request path that was
+// stripped before the request was forwarded, such as path prefixes of the
+// proxy, profiles and routes
+func externalPrefix(original, forwarded string) string {
+	if forwarded == "/" {
+		return strings.TrimSuffix(original, "/")
+	}
+	if strings.HasSuffix(original, forwarded) {
+		return original[:len(original)-len(forwarded)]
+	}
+	return ""
+}
+
+// rewriteLocation rewrites a Location header pointing to the upstream so it
+// points to the same resource through the proxy. Redirects of Prometheus
+// served under a route prefix, such as to /prometheus/graph, thus work for
+// clients.
+func rewriteLocation(resp *http.Response, info *requestInfo) {
+	location := resp.Header.Get("Location")
+	if location == "" || info == nil || info.backend == nil {
+		return
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return
+	}
+
+	upstream := info.backend.url
+	if u.IsAbs() {
+		if u.Scheme != upstream.Scheme || u.Host != upstream.Host {
+			// A redirect to another server
+			return
+		}
+		u.Scheme, u.Host, u.User = "", "", nil
+	}
+	if !strings.HasPrefix(u.Path, "/") {
+		// Relative references resolve against the proxied path as is
+		resp.Header.Set("Location", u.String())
+		return
+	}
+
+	rest, ok := trimPathPrefix(u.Path, strings.TrimSuffix(upstream.Path, "/"))
+	if !ok {
+		return
+	}
+	u.Path = info.externalPrefix + rest
+	u.RawPath = ""
+	resp.Header.Set("Location", u.String())
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestTrimPathPrefix(t *testing.T) {
+	tests := []struct {
+		path, prefix string
+		want         string
+		ok           bool
+	}{
+		{path: "/prom/api/v1/query", prefix: "/prom", want: "/api/v1/query", ok: true},
+		{path: "/prom", prefix: "/prom", want: "/", ok: true},
+		{path: "/prom/", prefix: "/prom", want: "/", ok: true},
+		{path: "/prometheus/graph", prefix: "/prom", want: "/prometheus/graph", ok: false},
+		{path: "/api/v1/query", prefix: "", want: "/api/v1/query", ok: true},
+	}
+
+	for _, tt := range tests {
+		got, ok := trimPathPrefix(tt.path, tt.prefix)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("trimPathPrefix(%q, %q) = %q, %v, want %q, %v", tt.path, tt.prefix, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestExternalPrefix(t *testing.T) {
+	tests := []struct {
+		original, forwarded string
+		want                string
+	}{
+		{original: "/api/v1/query", forwarded: "/api/v1/query", want: ""},
+		{original: "/prom/api/v1/query", forwarded: "/api/v1/query", want: "/prom"},
+		{original: "/prom/", forwarded: "/", want: "/prom"},
+		{original: "/prom", forwarded: "/", want: "/prom"},
+	}
+
+	for _, tt := range tests {
+		if got := externalPrefix(tt.original, tt.forwarded); got != tt.want {
+			t.Errorf("externalPrefix(%q, %q) = %q, want %q", tt.original, tt.forwarded, got, tt.want)
+		}
+	}
+}
+
+func TestRewriteLocation(t *testing.T) {
+	upstream, _ := url.Parse("http://prometheus:9090/prometheus")
+	info := &requestInfo{backend: &backend{url: upstream}, externalPrefix: "/prom"}
+
+	tests := []struct {
+		location string
+		want     string
+	}{
+		{location: "/prometheus/graph", want: "/prom/graph"},
+		{location: "http://prometheus:9090/prometheus/graph?g0.expr=up", want: "/prom/graph?g0.expr=up"},
+		{location: "https://example.com/login", want: "https://example.com/login"},
+		{location: "/other", want: "/other"},
+		{location: "graph", want: "graph"},
+	}
+
+	for _, tt := range tests {
+		resp := &http.Response{Header: http.Header{"Location": {tt.location}}}
+		rewriteLocation(resp, info)
+		if got := resp.Header.Get("Location"); got != tt.want {
+			t.Errorf("rewriteLocation(%q) = %q, want %q", tt.location, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/rewriter"
+)
+
+// profilePathPrefix starts request paths that select a mapping profile,
+// e.g. /profile/legacy/api/v1/query
+const profilePathPrefix = "/profile/"
+
+type listenerProfileKey struct{}
+
+// ListenerHandler returns a handler for an additional listener that applies
+// the listener's mapping profile unless the request selects another one,
+// and its path prefix if it has one
+func (p *PrometheusProxy) ListenerHandler(listener config.Listener) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), listenerProfileKey{}, listener.Profile)
+		ctx = context.WithValue(ctx, listenerPathPrefixKey{}, listener.PathPrefix)
+		p.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// selectProfile determines the mapping profile of the request and returns
+// its name and rewriter. A profile path prefix is stripped from the request
+// URL. The path prefix takes precedence over the header, which takes
+// precedence over the listener.
+func (p *PrometheusProxy) selectProfile(req *http.Request) (string, *rewriter.Rewriter, error) {
+	name, _ := req.Context().Value(listenerProfileKey{}).(string)
+
+	if p.profileSelection.Header != "" {
+		if header := req.Header.Get(p.profileSelection.Header); header != "" {
+			name = header
+		}
+	}
+
+	if p.profileSelection.PathPrefix && strings.HasPrefix(req.URL.Path, profilePathPrefix) {
+		rest := strings.TrimPrefix(req.URL.Path, profilePathPrefix)
+		prefixName, remainder, _ := strings.Cut(rest, "/")
+		name = prefixName
+
+		req.URL.Path = "/" + remainder
+		if req.URL.RawPath != "" {
+			req.URL.RawPath = strings.TrimPrefix(req.URL.RawPath, profilePathPrefix+url.PathEscape(prefixName))
+		}
+	}
+
+	rw, ok := p.rewriter.Profile(name)
+	if !ok {
+		return "", nil, &requestError{status: http.StatusNotFound, err: fmt.Errorf("unknown mapping profile %q", name)}
+	}
+	return name, rw, nil
+}
@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+func TestProfileSelection(t *testing.T) {
+	var received *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+
+	// Each profile renames a different label to host
+	queryRule := func(source string) []config.Mapping {
+		return []config.Mapping{{
+			Direction: config.DirectionQuery,
+			Rules:     []config.Rule{{SourceLabel: source, TargetLabel: "host"}},
+		}}
+	}
+	cfg := &config.Config{
+		TargetPrometheus: upstream.URL,
+		Mappings:         queryRule("instance"),
+		Profiles: map[string]config.Profile{
+			"legacy":  {Mappings: queryRule("node")},
+			"grafana": {Mappings: queryRule("server")},
+		},
+		ProfileSelection: config.ProfileSelection{Header: "X-Mapping-Profile", PathPrefix: true},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	const query = `up{instance="a",node="b",server="c"}`
+	tests := []struct {
+		name     string
+		path     string
+		header   string
+		listener string
+		want     string
+	}{
+		{name: "default mappings", path: "/api/v1/query", want: `up{host="a",node="b",server="c"}`},
+		{name: "header", path: "/api/v1/query", header: "legacy", want: `up{instance="a",host="b",server="c"}`},
+		{name: "path prefix", path: "/profile/legacy/api/v1/query", want: `up{instance="a",host="b",server="c"}`},
+		{name: "listener", path: "/api/v1/query", listener: "grafana", want: `up{instance="a",node="b",host="c"}`},
+		{name: "header over listener", path: "/api/v1/query", header: "legacy", listener: "grafana", want: `up{instance="a",host="b",server="c"}`},
+		{name: "path prefix over header", path: "/profile/grafana/api/v1/query", header: "legacy", want: `up{instance="a",node="b",host="c"}`},
+		{name: "path prefix over listener", path: "/profile/legacy/api/v1/query", listener: "grafana", want: `up{instance="a",host="b",server="c"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			received = nil
+			req := httptest.NewRequest(http.MethodGet, tt.path+"?query="+url.QueryEscape(query), nil)
+			if tt.header != "" {
+				req.Header.Set("X-Mapping-Profile", tt.header)
+			}
+			var handler http.Handler = p
+			if tt.listener != "" {
+				handler = p.ListenerHandler(config.Listener{Profile: tt.listener})
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK || received == nil {
+				t.Fatalf("status = %d, want 200 from the upstream: %s", rec.Code, rec.Body.String())
+			}
+			if got := received.URL.Query().Get("query"); got != tt.want {
+				t.Errorf("upstream query = %s, want %s", got, tt.want)
+			}
+			// The profile prefix is stripped before forwarding
+			if received.URL.Path != "/api/v1/query" {
+				t.Errorf("upstream path = %s, want /api/v1/query", received.URL.Path)
+			}
+		})
+	}
+}
+
+func TestProfileUnknown(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("request for an unknown profile reached the upstream: %s", r.URL)
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		TargetPrometheus: upstream.URL,
+		Profiles:         map[string]config.Profile{"legacy": {}},
+		ProfileSelection: config.ProfileSelection{Header: "X-Mapping-Profile", PathPrefix: true},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		header   string
+		listener string
+	}{
+		{name: "header", path: "/api/v1/query?query=up", header: "unknown"},
+		{name: "path prefix", path: "/profile/unknown/api/v1/query?query=up"},
+		{name: "listener", path: "/api/v1/query?query=up", listener: "unknown"},
+	}
+
+	want := `{"status":"error","errorType":"not_found","error":"unknown mapping profile \"unknown\""}`
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("X-Mapping-Profile", tt.header)
+			}
+			var handler http.Handler = p
+			if tt.listener != "" {
+				handler = p.ListenerHandler(config.Listener{Profile: tt.listener})
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("status = %d, want 404", rec.Code)
+			}
+			if got := rec.Body.String(); got != want {
+				t.Errorf("body = %s, want %s", got, want)
+			}
+		})
+	}
+}
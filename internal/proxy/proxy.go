@@ -1,247 +1,462 @@
 package proxy
 
 import (
-	"bytes"
-	"compress/gzip"
-	"io/ioutil"
-	"log"
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
+	"net/netip"
 	"strconv"
 	"strings"
+	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/accesslog"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/codec"
 	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/identity"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/logging"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/ratelimit"
 	"github.com/zwo-bot/prom-relabel-proxy/internal/rewriter"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/tracing"
 )
 
+// warningHeader carries diagnostics for responses whose body could not be
+// rewritten
+const warningHeader = "X-Prom-Relabel-Proxy-Warning"
+
 // PrometheusProxy is a reverse proxy for Prometheus that rewrites labels
 type PrometheusProxy struct {
-	targetURL *url.URL
-	proxy     *httputil.ReverseProxy
-	rewriter  *rewriter.Rewriter
-	debug     bool
+	backends       map[string]*backend
+	defaultBackend string
+	routes         []route
+	fanout         []*backend
+	replicaLabel   string
+	endpoints      []config.Endpoint
+	rewriter       *rewriter.Rewriter
+	logger         *slog.Logger
+	accessLog      *accesslog.Logger
+
+	// identityField selects the client certificate field used as identity
+	identityField    config.IdentityField
+	tenant           config.Tenant
+	profileSelection config.ProfileSelection
+	diagnostics      config.Diagnostics
+	// serverPathPrefix is the path prefix of the main listener
+	serverPathPrefix string
+	// caches are the enabled response caches
+	caches     []*queryCache
+	querySplit config.QuerySplit
+	coalescer  *coalescer
+	rateLimit  config.RateLimit
+	// trustedProxies are the load balancers whose X-Forwarded-For header
+	// identifies the client of rate limited requests
+	trustedProxies []netip.Prefix
+	// limiter limits the requests of clients, if set
+	limiter *ratelimit.Limiter
+
+	metrics *metrics
+}
+
+// requestInfo collects details about a request while it is being proxied
+type requestInfo struct {
+	profile          string
+	rewriter         *rewriter.Rewriter
+	backend          *backend
+	endpoint         config.Endpoint
+	originalQueries  []string
+	rewrittenQueries []string
+
+	// fanout is set on the requests sent to each upstream of a fan-out,
+	// noMatch if the query cannot match any of the upstream's series
+	fanout    bool
+	noMatch   bool
+	upstreams []string
+
+	// acceptEncoding is the Accept-Encoding header sent by the client
+	acceptEncoding string
+	// externalPrefix is the path prefix stripped from the client's request
+	externalPrefix string
+
+	// cacheKey is set if the response can be cached for cacheTTL, and
+	// cacheResult tells whether it was found in the cache
+	cache       *queryCache
+	cacheKey    string
+	cacheTTL    time.Duration
+	cacheResult string
+
+	// coalesceKey is set if the response can be shared with concurrent
+	// identical requests, and coalesced tells whether it was
+	coalesceKey string
+	coalesced   bool
+	// capture keeps a copy of the rewritten response body, if set
+	capture *bodyCapture
+
+	// client identifies the client for rate limiting
+	client string
+}
+
+type requestInfoKey struct{}
+
+// upstreamName returns the name of the upstream the request was routed to
+func (info *requestInfo) upstreamName() string {
+	if len(info.upstreams) > 0 {
+		return strings.Join(info.upstreams, ",")
+	}
+	if info.backend == nil {
+		return ""
+	}
+	return info.backend.name
+}
+
+// requestInfoFromContext returns the requestInfo attached to ctx, if any
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
 }
 
 // New creates a new PrometheusProxy
-func New(cfg *config.Config, debug bool) (*PrometheusProxy, error) {
-	targetURL, err := url.Parse(cfg.GetTargetPrometheus())
-	if err != nil {
-		return nil, err
+func New(cfg *config.Config, logger *slog.Logger) (*PrometheusProxy, error) {
+	if logger == nil {
+		logger = slog.Default()
 	}
 
-	rw := rewriter.New(cfg)
-	
 	proxy := &PrometheusProxy{
-		targetURL: targetURL,
-		rewriter:  rw,
-		debug:     debug,
-	}
-	
-	// Create the reverse proxy
-	reverseProxy := httputil.NewSingleHostReverseProxy(targetURL)
-	
-	// Customize the director function to modify the request
-	originalDirector := reverseProxy.Director
-	reverseProxy.Director = func(req *http.Request) {
-		originalDirector(req)
-		proxy.rewriteRequest(req)
-	}
-	
-	// Add a response modifier
-	reverseProxy.ModifyResponse = proxy.rewriteResponse
-	
-	proxy.proxy = reverseProxy
-	
+		rewriter: rewriter.New(cfg),
+		logger:   logger,
+		metrics:  newMetrics(),
+	}
+
+	if err := proxy.UpdateConfig(cfg); err != nil {
+		return nil, err
+	}
+
+	if accessLogCfg := cfg.GetAccessLog(); accessLogCfg.Enabled {
+		var err error
+		proxy.accessLog, err = accesslog.New(accessLogCfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return proxy, nil
 }
 
 // UpdateConfig updates the proxy with new configuration
 func (p *PrometheusProxy) UpdateConfig(cfg *config.Config) error {
-	targetURL, err := url.Parse(cfg.GetTargetPrometheus())
+	backends, err := p.newBackends(cfg)
 	if err != nil {
 		return err
 	}
-	
-	p.targetURL = targetURL
+
+	routes, err := compileRoutes(cfg.GetRoutes())
+	if err != nil {
+		return err
+	}
+
+	rateLimit := cfg.GetRateLimit()
+	trustedProxies, err := parseTrustedProxies(rateLimit.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	var fanoutBackends []*backend
+	fanoutCfg := cfg.GetFanout()
+	if fanoutCfg.Enabled {
+		names := fanoutCfg.Upstreams
+		if len(names) == 0 {
+			for _, u := range cfg.GetUpstreams() {
+				names = append(names, u.Name)
+			}
+		}
+		for _, name := range names {
+			b, ok := backends[name]
+			if !ok {
+				return fmt.Errorf("unknown upstream in fanout: %s", name)
+			}
+			fanoutBackends = append(fanoutBackends, b)
+		}
+	}
+
+	// Replace the health checks of the previous backends
+	p.stopHealthChecks()
+	for _, b := range backends {
+		b.checker.Start()
+	}
+
+	p.backends = backends
+	p.fanout = fanoutBackends
+	p.replicaLabel = fanoutCfg.ReplicaLabel
+	p.defaultBackend = cfg.GetDefaultUpstream()
+	p.routes = routes
+	p.endpoints = cfg.GetEndpoints()
+	p.serverPathPrefix = strings.TrimSuffix(cfg.GetServer().PathPrefix, "/")
+	// Cached responses may have been rewritten with the previous mappings
+	cacheCfg := cfg.GetCache()
+	p.caches = newCaches(cacheCfg)
+	p.querySplit = cfg.GetQuerySplit()
+	p.coalescer = newCoalescer(cfg.GetCoalesce(), cacheCfg.KeyHeaders)
+	// The limits start over with the new configuration
+	p.rateLimit = rateLimit
+	p.trustedProxies = trustedProxies
+	p.limiter = newLimiter(p.rateLimit)
 	p.rewriter.UpdateConfig(cfg)
-	
+	p.identityField = cfg.GetServer().TLS.ClientIdentity
+	p.tenant = cfg.GetTenant()
+	p.profileSelection = cfg.GetProfileSelection()
+	p.diagnostics = cfg.GetDiagnostics()
+
 	return nil
 }
 
+// ReopenAccessLog reopens the access log file, e.g. after it has been rotated
+func (p *PrometheusProxy) ReopenAccessLog() error {
+	if p.accessLog == nil {
+		return nil
+	}
+	return p.accessLog.Reopen()
+}
+
+// Close releases resources held by the proxy
+func (p *PrometheusProxy) Close() error {
+	p.stopHealthChecks()
+	if p.accessLog == nil {
+		return nil
+	}
+	return p.accessLog.Close()
+}
+
+// stopHealthChecks stops the health checks of all backends
+func (p *PrometheusProxy) stopHealthChecks() {
+	for _, b := range p.backends {
+		b.checker.Stop()
+	}
+}
+
 // ServeHTTP implements the http.Handler interface
 func (p *PrometheusProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	p.proxy.ServeHTTP(w, r)
+	start := time.Now()
+
+	// Reuse the caller's request ID if present so logs can be correlated
+	// across services, and forward it to the upstream
+	requestID := r.Header.Get(logging.RequestIDHeader)
+	if requestID == "" {
+		requestID = logging.NewRequestID()
+		r.Header.Set(logging.RequestIDHeader, requestID)
+	}
+	w.Header().Set(logging.RequestIDHeader, requestID)
+
+	// Continue the caller's trace, if any
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracing.Tracer().Start(ctx, "proxy "+r.Method,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("request.id", requestID),
+		),
+	)
+	defer span.End()
+
+	info := &requestInfo{
+		rewriter:       p.rewriter,
+		acceptEncoding: strings.Join(r.Header.Values("Accept-Encoding"), ", "),
+	}
+	ctx = logging.WithRequestID(ctx, requestID)
+	ctx = context.WithValue(ctx, requestInfoKey{}, info)
+
+	// Identify the client by its verified certificate, if any
+	if id := identity.FromRequest(r, p.identityField); id != "" {
+		ctx = identity.NewContext(ctx, id)
+		span.SetAttributes(attribute.String("client.identity", id))
+	}
+	r = r.WithContext(ctx)
+
+	sw := &statusWriter{ResponseWriter: w}
+
+	// Rewrite a copy of the request so the original is kept for logging
+	outReq := r.WithContext(ctx)
+	outURL := *r.URL
+	outReq.URL = &outURL
+	if err := p.checkRateLimit(outReq, info); err != nil {
+		p.logger.WarnContext(ctx, "rejected request", slog.Any("error", err))
+		span.RecordError(err)
+		writeError(sw, err)
+	} else if err := p.stripPathPrefix(outReq); err != nil {
+		p.logger.WarnContext(ctx, "rejected request", slog.Any("error", err))
+		span.RecordError(err)
+		writeError(sw, err)
+	} else if endpoint, ok := p.fanoutEndpoint(outReq); ok {
+		p.serveFanout(sw, outReq, endpoint)
+	} else if err := p.rewriteRequest(outReq, nil); err != nil {
+		p.logger.WarnContext(ctx, "rejected request", slog.Any("error", err))
+		span.RecordError(err)
+		writeError(sw, err)
+	} else {
+		info.externalPrefix = externalPrefix(r.URL.Path, outReq.URL.Path)
+		span.SetAttributes(attribute.String("upstream", info.backend.name))
+		p.forward(sw, outReq, info)
+	}
+	duration := time.Since(start)
+
+	span.SetAttributes(attribute.Int("http.response.status_code", sw.Status()))
+	if sw.Status() >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(sw.Status()))
+	}
+
+	p.logger.InfoContext(ctx, "proxied request",
+		slog.String("method", r.Method),
+		slog.String("endpoint", r.URL.Path),
+		slog.String("profile", info.profile),
+		slog.String("upstream", info.upstreamName()),
+		slog.Any("original_query", info.originalQueries),
+		slog.Any("rewritten_query", info.rewrittenQueries),
+		slog.String("cache", info.cacheResult),
+		slog.Bool("coalesced", info.coalesced),
+		slog.String("identity", identity.FromContext(ctx)),
+		slog.Int("status", sw.Status()),
+		slog.Duration("duration", duration),
+	)
+
+	if p.accessLog != nil {
+		p.accessLog.Log(accesslog.Entry{
+			Time:             start,
+			RequestID:        requestID,
+			Method:           r.Method,
+			Path:             r.URL.Path,
+			RawQuery:         r.URL.RawQuery,
+			Proto:            r.Proto,
+			ClientIP:         clientIP(r),
+			User:             requestUser(r),
+			Status:           sw.Status(),
+			Bytes:            sw.bytes,
+			Duration:         duration,
+			Referer:          r.Referer(),
+			UserAgent:        r.UserAgent(),
+			Profile:          info.profile,
+			Upstream:         info.upstreamName(),
+			OriginalQueries:  info.originalQueries,
+			RewrittenQueries: info.rewrittenQueries,
+		})
+	}
 }
 
-// debugLog logs a message if debug mode is enabled
-func (p *PrometheusProxy) debugLog(format string, v ...interface{}) {
-	if p.debug {
-		log.Printf(format, v...)
+// clientIP returns the IP address of the client that sent the request
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
 	}
+	return host
 }
 
-// rewriteRequest modifies the request before it's sent to Prometheus
-func (p *PrometheusProxy) rewriteRequest(req *http.Request) {
-	p.debugLog("Rewriting request: %s %s", req.Method, req.URL.String())
-	
-	// Rewrite the URL query parameters
-	originalURL := req.URL.String()
-	req.URL = p.rewriter.RewriteQueryURL(req.URL)
-	p.debugLog("Rewrote URL from %s to %s", originalURL, req.URL.String())
-	
-	// If it's a POST request with form data, we need to handle that too
-	if req.Method == http.MethodPost && req.Body != nil {
-		contentType := req.Header.Get("Content-Type")
-		p.debugLog("POST request with Content-Type: %s", contentType)
-		
-		if contentType == "application/x-www-form-urlencoded" {
-			// Read the body
-			body, err := ioutil.ReadAll(req.Body)
-			if err != nil {
-				p.debugLog("Error reading request body: %v", err)
-				return
-			}
-			p.debugLog("Original request body: %s", string(body))
-			
-			// Parse the form data
-			form, err := url.ParseQuery(string(body))
-			if err != nil {
-				p.debugLog("Error parsing form data: %v", err)
-				return
-			}
-			
-			// Rewrite the query parameters
-			for param, values := range form {
-				if param == "query" || param == "match[]" {
-					for i, value := range values {
-						originalValue := value
-						form[param][i] = p.rewriter.RewriteQuery(value)
-						p.debugLog("Rewrote query param %s from %s to %s", param, originalValue, form[param][i])
-					}
-				}
-			}
-			
-			// Encode the form data back to the body
-			newBody := form.Encode()
-			p.debugLog("New request body: %s", newBody)
-			req.Body = ioutil.NopCloser(bytes.NewBufferString(newBody))
-			req.ContentLength = int64(len(newBody))
-			
-			// Use strconv.Itoa instead of string(rune()) for proper string conversion
-			contentLengthStr := strconv.Itoa(len(newBody))
-			p.debugLog("Setting Content-Length header to: %s", contentLengthStr)
-			req.Header.Set("Content-Length", contentLengthStr)
-		}
+// requestUser returns the identity the client authenticated with, if any
+func requestUser(r *http.Request) string {
+	if id := identity.FromContext(r.Context()); id != "" {
+		return id
 	}
+	if user, _, ok := r.BasicAuth(); ok {
+		return user
+	}
+	return ""
 }
 
 // rewriteResponse modifies the response before it's sent back to the client
 func (p *PrometheusProxy) rewriteResponse(resp *http.Response) error {
-	p.debugLog("Rewriting response from %s", resp.Request.URL.String())
-	
-	// Only process JSON responses
-	contentType := resp.Header.Get("Content-Type")
-	p.debugLog("Response Content-Type: %s", contentType)
-	
-	if !strings.Contains(contentType, "application/json") {
-		p.debugLog("Skipping non-JSON response")
-		return nil
+	ctx := resp.Request.Context()
+
+	// Rewrite the JSON with the request's mapping profile and encode it as
+	// accepted by the client
+	info := requestInfoFromContext(ctx)
+	rewriteLocation(resp, info)
+
+	rw := p.rewriter
+	var acceptEncoding string
+	response := config.DefaultEndpoint.Response
+	if info != nil {
+		rw = info.rewriter
+		acceptEncoding = info.acceptEncoding
+		if info.endpoint.Response != "" {
+			response = info.endpoint.Response
+		}
 	}
-	
+	resp.Header.Add("Vary", "Accept-Encoding")
+
 	// Check for compression
 	contentEncoding := resp.Header.Get("Content-Encoding")
-	p.debugLog("Response Content-Encoding: %s", contentEncoding)
-	
-	// Read the response body
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		p.debugLog("Error reading response body: %v", err)
-		return err
-	}
-	
-	// Close the original body
-	resp.Body.Close()
-	
-	// Decompress if needed
-	var decompressedBody []byte
-	if contentEncoding == "gzip" {
-		reader, err := gzip.NewReader(bytes.NewReader(body))
-		if err != nil {
-			p.debugLog("Error creating gzip reader: %v", err)
-			// If we can't decompress, return the original body
-			resp.Body = ioutil.NopCloser(bytes.NewBuffer(body))
-			return nil
+	decoder, ok := codec.Lookup(contentEncoding)
+	if !ok {
+		// The upstream ignored the encodings the proxy accepts, so the body
+		// can only be passed through
+		p.logger.WarnContext(ctx, "unsupported response content encoding", slog.String("content_encoding", contentEncoding))
+		if p.diagnostics.Warnings {
+			resp.Header.Add(warningHeader, "prom-relabel-proxy: response could not be parsed, labels were not rewritten: unsupported content encoding "+strconv.Quote(contentEncoding))
 		}
-		decompressedBody, err = ioutil.ReadAll(reader)
-		reader.Close()
-		if err != nil {
-			p.debugLog("Error decompressing response: %v", err)
-			// If we can't decompress, return the original body
-			resp.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+		return nil
+	}
+	encoder := codec.Negotiate(acceptEncoding)
+
+	// Only process JSON responses of endpoints with a response rewriter
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.Contains(contentType, "application/json") || response == config.ResponseRewriterNone {
+		p.logger.DebugContext(ctx, "skipping response",
+			slog.String("content_type", contentType),
+			slog.String("response_rewriter", response),
+		)
+		if codec.Acceptable(acceptEncoding, contentEncoding) {
 			return nil
 		}
-		
-		// Log a sample of the decompressed body
-		if p.debug {
-			bodyPreview := string(decompressedBody)
-			if len(bodyPreview) > 200 {
-				bodyPreview = bodyPreview[:200] + "..."
-			}
-			p.debugLog("Decompressed response body (sample): %s", bodyPreview)
-		}
-	} else {
-		decompressedBody = body
-		
-		// Log a sample of the response body
-		if p.debug {
-			bodyPreview := string(body)
-			if len(bodyPreview) > 200 {
-				bodyPreview = bodyPreview[:200] + "..."
-			}
-			p.debugLog("Original response body (sample): %s", bodyPreview)
+
+		// The client does not accept the encoding the upstream chose
+		if err := decodeBody(resp, decoder); err != nil {
+			return err
 		}
+		p.streamBody(resp, bufio.NewReader(resp.Body), encoder, "transcode response", func(dst io.Writer, src io.Reader) error {
+			_, err := io.Copy(dst, src)
+			return err
+		})
+		return nil
+	}
+
+	if err := decodeBody(resp, decoder); err != nil {
+		// The labels of the upstream body cannot be rewritten
+		return err
+	}
+
+	// The headers are sent before the body is rewritten, so diagnostics
+	// can only be added to them for bodies that are not JSON objects
+	br := bufio.NewReader(resp.Body)
+	if c, err := firstByte(br); c != '{' && err == nil && p.diagnostics.Warnings {
+		resp.Header.Add(warningHeader, "prom-relabel-proxy: response could not be parsed, labels were not rewritten: response is not a JSON object")
 	}
-	
-	// Rewrite the JSON
-	newBody := p.rewriter.RewriteResultJSON(decompressedBody)
-	
-	// Log a sample of the new response body
-	if p.debug {
-		newBodyPreview := string(newBody)
-		if len(newBodyPreview) > 200 {
-			newBodyPreview = newBodyPreview[:200] + "..."
+
+	// Keep a copy of the rewritten body for the cache and for concurrent
+	// identical requests
+	var capture *bodyCapture
+	if info != nil {
+		capture = info.capture
+	}
+
+	p.streamBody(resp, br, encoder, "rewrite response", func(dst io.Writer, src io.Reader) error {
+		if capture != nil {
+			dst = io.MultiWriter(dst, capture)
 		}
-		p.debugLog("Rewritten response body (sample): %s", newBodyPreview)
-	}
-	
-	// Re-compress if the original was compressed
-	var finalBody []byte
-	if contentEncoding == "gzip" {
-		var buf bytes.Buffer
-		gzipWriter := gzip.NewWriter(&buf)
-		_, err := gzipWriter.Write(newBody)
-		gzipWriter.Close()
-		if err != nil {
-			p.debugLog("Error compressing response: %v", err)
-			// If we can't compress, use uncompressed and remove the encoding header
-			finalBody = newBody
-			resp.Header.Del("Content-Encoding")
-		} else {
-			finalBody = buf.Bytes()
+		report, err := rw.RewriteResponseStream(dst, src, response, p.diagnostics.Warnings)
+		if report.ParseError != nil {
+			p.logger.WarnContext(ctx, "failed to parse JSON response", slog.Any("error", report.ParseError))
 		}
-	} else {
-		finalBody = newBody
-	}
-	
-	// Set the new body
-	resp.Body = ioutil.NopCloser(bytes.NewBuffer(finalBody))
-	resp.ContentLength = int64(len(finalBody))
-	
-	// Use strconv.Itoa for proper string conversion
-	contentLengthStr := strconv.Itoa(len(finalBody))
-	p.debugLog("Setting response Content-Length header to: %s", contentLengthStr)
-	resp.Header.Set("Content-Length", contentLengthStr)
-	
+		if capture != nil && err == nil && report.ParseError == nil {
+			capture.finish(resp.StatusCode, resp.Header)
+		}
+		return err
+	})
 	return nil
 }
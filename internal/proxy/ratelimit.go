@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/identity"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/ratelimit"
+)
+
+// newLimiter creates a limiter if rate limiting is enabled
+func newLimiter(cfg config.RateLimit) *ratelimit.Limiter {
+	if !cfg.Enabled {
+		return nil
+	}
+	return ratelimit.New(limits(cfg.PerClient), limits(cfg.Global))
+}
+
+// limits converts configured limits for the limiter
+func limits(cfg config.Limits) ratelimit.Limits {
+	return ratelimit.Limits{
+		Rate:          cfg.RequestsPerSecond,
+		Burst:         cfg.Burst,
+		MaxConcurrent: cfg.MaxConcurrent,
+	}
+}
+
+// rateLimitClient returns the identity of the client a request is limited
+// by, falling back to its IP address
+func (p *PrometheusProxy) rateLimitClient(r *http.Request) string {
+	var client string
+	switch p.rateLimit.Client {
+	case config.ClientSourceHeader:
+		client = r.Header.Get(p.rateLimit.Header)
+	case config.ClientSourceTenant:
+		if p.tenant.Source == config.TenantSourceQueryParam {
+			// Leave the parameter for rewriteRequest to remove
+			client = r.URL.Query().Get(p.tenant.QueryParam)
+		} else {
+			client = p.requestTenant(r)
+		}
+	case config.ClientSourceClientCert:
+		client = identity.FromContext(r.Context())
+	}
+	if client == "" {
+		return "ip:" + p.forwardedClientIP(r)
+	}
+	return client
+}
+
+// parseTrustedProxies parses the addresses and CIDR ranges of trusted
+// proxies
+func parseTrustedProxies(proxies []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(proxies))
+	for _, proxy := range proxies {
+		prefix, err := config.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// forwardedClientIP returns the IP address of the client of a request. For
+// requests from trusted proxies, it is the last address in X-Forwarded-For
+// that was not added by a trusted proxy.
+func (p *PrometheusProxy) forwardedClientIP(r *http.Request) string {
+	ip, err := netip.ParseAddr(clientIP(r))
+	if err != nil {
+		return clientIP(r)
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0 && p.trustedProxy(ip); i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		ip = hop
+	}
+	return ip.Unmap().String()
+}
+
+// trustedProxy reports whether an address belongs to a trusted proxy
+func (p *PrometheusProxy) trustedProxy(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, prefix := range p.trustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRateLimit takes a token for the request from the rate limits of its
+// client and of all clients
+func (p *PrometheusProxy) checkRateLimit(r *http.Request, info *requestInfo) error {
+	if p.limiter == nil {
+		return nil
+	}
+	info.client = p.rateLimitClient(r)
+	return p.limitError(p.limiter.Allow(info.client))
+}
+
+// acquire counts a request to the upstreams as in flight until release is
+// called, unless its client or all clients have too many in flight
+func (p *PrometheusProxy) acquire(info *requestInfo) (release func(), err error) {
+	release, err = p.limiter.Acquire(info.client)
+	if err != nil {
+		return nil, p.limitError(err)
+	}
+	return release, nil
+}
+
+// rejectRequest writes the error of a request rejected by the limiter
+func (p *PrometheusProxy) rejectRequest(w http.ResponseWriter, req *http.Request, err error) {
+	p.logger.WarnContext(req.Context(), "rejected request", slog.Any("error", err))
+	writeError(w, err)
+}
+
+// limitError counts a request rejected by the limiter and returns the error
+// to reject it with
+func (p *PrometheusProxy) limitError(err error) error {
+	var limitErr *ratelimit.Error
+	if !errors.As(err, &limitErr) {
+		return err
+	}
+	p.metrics.rateLimited.WithLabelValues(limitErr.Scope, limitErr.Reason).Inc()
+	return &requestError{status: http.StatusTooManyRequests, err: err}
+}
@@ -0,0 +1,298 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+func TestRateLimit(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("query") == "slow" {
+			<-release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		TargetPrometheus: upstream.URL,
+		RateLimit: config.RateLimit{
+			Enabled:   true,
+			Client:    config.ClientSourceHeader,
+			PerClient: config.Limits{RequestsPerSecond: 0.5, Burst: 2, MaxConcurrent: 1},
+		},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	query := func(client, q string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query="+q, nil)
+		req.Header.Set("X-Client-ID", client)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The burst is allowed, further requests wait for the rate
+	for i := 0; i < 2; i++ {
+		if rec := query("a", "up"); rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i, rec.Code)
+		}
+	}
+	rec := query("a", "up")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+	want := `{"status":"error","errorType":"unavailable","error":"too many requests (client limit)"}`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+
+	// Other clients have their own limits
+	if rec := query("b", "up"); rec.Code != http.StatusOK {
+		t.Errorf("other client: status = %d, want 200", rec.Code)
+	}
+
+	// A client may only have one request in flight
+	done := make(chan int)
+	go func() { done <- query("c", "slow").Code }()
+	time.Sleep(100 * time.Millisecond)
+	rec = query("c", "up")
+	close(release)
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("concurrent request: status = %d, Retry-After = %q, want 429 and 1", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("first request: status = %d, want 200", code)
+	}
+}
+
+func TestRateLimitCoalesced(t *testing.T) {
+	var requests atomic.Int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		TargetPrometheus: upstream.URL,
+		Coalesce:         config.Coalesce{Enabled: true},
+		RateLimit: config.RateLimit{
+			Enabled: true,
+			Global:  config.Limits{MaxConcurrent: 2},
+		},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Requests waiting for a coalesced response do not take a slot
+	codes := make([]int, 5)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil))
+			codes[i] = rec.Code
+		}(i)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, active := p.limiter.Stats(); active != 1 {
+		t.Errorf("requests in flight = %d, want 1", active)
+	}
+	close(release)
+	wg.Wait()
+
+	if got := requests.Load(); got != 1 {
+		t.Errorf("upstream received %d requests, want 1", got)
+	}
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request %d: status = %d, want 200", i, code)
+		}
+	}
+}
+
+func TestRateLimitSplit(t *testing.T) {
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"matrix","result":[]}}`))
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		TargetPrometheus: upstream.URL,
+		QuerySplit:       config.QuerySplit{Enabled: true, MaxParallel: 3},
+		RateLimit: config.RateLimit{
+			Enabled:   true,
+			PerClient: config.Limits{MaxConcurrent: 2},
+		},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Each sub-query of the three days takes a slot of the client
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query_range?query=up&start=1717977600&end=1718164800&step=3600", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want 429", rec.Code)
+	}
+	if _, active := p.limiter.Stats(); active != 0 {
+		t.Errorf("requests in flight = %d, want 0", active)
+	}
+}
+
+func TestRateLimitFanout(t *testing.T) {
+	release := make(chan struct{})
+	newUpstream := func() *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+		}))
+	}
+	eu, us, ap := newUpstream(), newUpstream(), newUpstream()
+	defer eu.Close()
+	defer us.Close()
+	defer ap.Close()
+
+	cfg := &config.Config{
+		Upstreams: []config.UpstreamServer{
+			{Name: "eu", URL: eu.URL},
+			{Name: "us", URL: us.URL},
+			{Name: "ap", URL: ap.URL},
+		},
+		Fanout: config.Fanout{Enabled: true},
+		RateLimit: config.RateLimit{
+			Enabled:   true,
+			PerClient: config.Limits{MaxConcurrent: 2},
+		},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// The request to each of the three upstreams takes a slot of the client
+	time.AfterFunc(100*time.Millisecond, func() { close(release) })
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil))
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("status = %d, want 429", rec.Code)
+	}
+	if _, active := p.limiter.Stats(); active != 0 {
+		t.Errorf("requests in flight = %d, want 0", active)
+	}
+}
+
+func TestRateLimitClientIP(t *testing.T) {
+	p := &PrometheusProxy{}
+	var err error
+	p.trustedProxies, err = parseTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		wantClient   string
+	}{
+		{name: "direct", remoteAddr: "203.0.113.1:1234", wantClient: "ip:203.0.113.1"},
+		{name: "untrusted proxy", remoteAddr: "203.0.113.1:1234", forwardedFor: []string{"198.51.100.1"}, wantClient: "ip:203.0.113.1"},
+		{name: "trusted proxy", remoteAddr: "10.1.2.3:1234", forwardedFor: []string{"198.51.100.1"}, wantClient: "ip:198.51.100.1"},
+		{name: "chain of trusted proxies", remoteAddr: "10.1.2.3:1234", forwardedFor: []string{"198.51.100.1, 192.168.1.1", "10.0.0.1"}, wantClient: "ip:198.51.100.1"},
+		{name: "spoofed address", remoteAddr: "10.1.2.3:1234", forwardedFor: []string{"10.9.9.9, 198.51.100.1"}, wantClient: "ip:198.51.100.1"},
+		{name: "only trusted proxies", remoteAddr: "10.1.2.3:1234", forwardedFor: []string{"10.0.0.1"}, wantClient: "ip:10.0.0.1"},
+		{name: "invalid address", remoteAddr: "10.1.2.3:1234", forwardedFor: []string{"unknown"}, wantClient: "ip:10.1.2.3"},
+		{name: "no header", remoteAddr: "10.1.2.3:1234", wantClient: "ip:10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			if got := p.rateLimitClient(req); got != tt.wantClient {
+				t.Errorf("rateLimitClient() = %q, want %q", got, tt.wantClient)
+			}
+		})
+	}
+}
+
+func TestRateLimitGlobal(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		TargetPrometheus: upstream.URL,
+		RateLimit: config.RateLimit{
+			Enabled:   true,
+			Client:    config.ClientSourceHeader,
+			PerClient: config.Limits{RequestsPerSecond: 10, Burst: 10},
+			Global:    config.Limits{RequestsPerSecond: 0.5, Burst: 3},
+		},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// The clients share the global burst, although each is within its own
+	query := func(client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+		req.Header.Set("X-Client-ID", client)
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, client := range []string{"a", "b", "c"} {
+		if rec := query(client); rec.Code != http.StatusOK {
+			t.Fatalf("client %s: status = %d, want 200", client, rec.Code)
+		}
+	}
+	rec := query("d")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", rec.Code)
+	}
+	want := `{"status":"error","errorType":"unavailable","error":"too many requests (global limit)"}`
+	if got := rec.Body.String(); got != want {
+		t.Errorf("body = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/fanout"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/rewriter"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/tracing"
+)
+
+// readEndpoints only read data, so they can fail over to another upstream
+var readEndpoints = []string{
+	"/api/v1/query",
+	"/api/v1/query_range",
+	"/api/v1/query_exemplars",
+	"/api/v1/series",
+	"/api/v1/labels",
+	"/api/v1/label/*/values",
+	"/api/v1/metadata",
+	"/api/v1/targets/metadata",
+	"/api/v1/format_query",
+	"/api/v1/parse_query",
+	"/federate",
+}
+
+// rewriteRequest modifies the request before it's sent to Prometheus. The
+// upstream is chosen by the routing rules unless a backend is given. An
+// error is returned if the request must be rejected.
+func (p *PrometheusProxy) rewriteRequest(req *http.Request, forced *backend) error {
+	ctx := req.Context()
+	info := requestInfoFromContext(ctx)
+	if info == nil {
+		info = &requestInfo{}
+	}
+
+	profile, rw, err := p.selectProfile(req)
+	if err != nil {
+		return err
+	}
+
+	tenant := p.requestTenant(req)
+
+	// If it's a POST request with form data, we need to handle that too
+	query := req.URL.Query()
+	var body requestBody
+	var form url.Values
+	var originalBodySize int
+	mediaType, mediaParams, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if hasBody(req) && supportedMediaType(mediaType) {
+		_, span := tracing.Tracer().Start(ctx, "parse request body",
+			trace.WithAttributes(attribute.String("media_type", mediaType)),
+		)
+
+		// Read the body
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			span.RecordError(err)
+			span.End()
+			return &requestError{status: http.StatusBadRequest, err: fmt.Errorf("failed to read request body: %w", err)}
+		}
+		originalBodySize = len(data)
+
+		// Parse the parameters
+		body, err = parseBody(mediaType, mediaParams, data)
+		if err != nil {
+			span.RecordError(err)
+			span.End()
+			return &requestError{status: http.StatusBadRequest, err: err}
+		}
+		form = body.params()
+		span.End()
+	}
+
+	// Route the request based on the client's query, then rewrite it with
+	// the mapping profile requested by the client or else the upstream's
+	if forced != nil {
+		info.backend = forced
+	} else {
+		info.backend = p.selectBackend(req, tenant, p.endpoint(req.URL.Path), query, form)
+		if matchesEndpoint(req.URL.Path, readEndpoints) {
+			if b := p.failover(info.backend); b != info.backend {
+				p.logger.WarnContext(ctx, "failing over to another upstream",
+					slog.String("upstream", info.backend.name),
+					slog.String("failover", b.name),
+				)
+				p.metrics.failovers.WithLabelValues(info.backend.name, b.name).Inc()
+				info.backend = b
+			}
+		}
+		if !info.backend.available() {
+			return &requestError{status: http.StatusServiceUnavailable, err: fmt.Errorf("%w: %s", errUnavailable, info.backend.name)}
+		}
+	}
+	if profile == "" && info.backend.profile != "" {
+		profile = info.backend.profile
+		rw, _ = p.rewriter.Profile(profile)
+	}
+	info.profile = profile
+	info.rewriter = rw
+	// Routes may have stripped a path prefix
+	info.endpoint = p.endpoint(req.URL.Path)
+	if info.endpoint.PathLabel {
+		rewritePathLabel(req, info.endpoint.Path, rw)
+	}
+
+	enforced := ""
+	if p.tenant.Enabled {
+		if err := p.checkTenant(req, tenant); err != nil {
+			return err
+		}
+		if hasBody(req) && body == nil {
+			// Prometheus may read parameters from bodies we cannot rewrite
+			return &requestError{status: http.StatusUnsupportedMediaType, err: fmt.Errorf("unsupported request body content type %q", req.Header.Get("Content-Type"))}
+		}
+		enforced = tenant
+	}
+
+	// Rewrite the URL query parameters
+	if err := p.rewriteParams(ctx, query, enforced, info); err != nil {
+		return err
+	}
+
+	if body != nil {
+		if err := p.rewriteParams(ctx, form, enforced, info); err != nil {
+			return err
+		}
+	}
+
+	if enforced != "" {
+		p.restrictToTenant(req, query, form, enforced)
+	}
+
+	// Queries may be served from the cache, which may align their time
+	// range before the parameters are encoded
+	info.cache = p.cacheFor(req.URL.Path)
+	info.cacheKey, info.cacheTTL = info.cache.request(req, info, query, form)
+	info.coalesceKey = p.coalesceKey(req, info, query, form)
+
+	if body != nil {
+		// Encode the parameters back to the body
+		newBody, err := body.encode()
+		if err != nil {
+			return fmt.Errorf("failed to encode request body: %w", err)
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(newBody))
+		req.ContentLength = int64(len(newBody))
+		req.Header.Set("Content-Length", strconv.Itoa(len(newBody)))
+		p.logger.DebugContext(ctx, "rewrote request body",
+			slog.Int("original_bytes", originalBodySize),
+			slog.Int("rewritten_bytes", len(newBody)),
+		)
+	}
+
+	req.URL.RawQuery = query.Encode()
+	p.logger.DebugContext(ctx, "rewrote request URL",
+		slog.String("method", req.Method),
+		slog.String("endpoint", req.URL.Path),
+	)
+
+	return nil
+}
+
+// rewriteParams rewrites the PromQL parameters in params and, if a tenant is
+// given, enforces the tenant label on them
+func (p *PrometheusProxy) rewriteParams(ctx context.Context, params url.Values, tenant string, info *requestInfo) error {
+	_, span := tracing.Tracer().Start(ctx, "rewrite query")
+	defer span.End()
+
+	for _, param := range info.endpoint.LabelParams {
+		for i, value := range params[param] {
+			params[param][i] = info.rewriter.RewriteLabelName(value)
+		}
+	}
+
+	queryParams := info.endpoint.QueryParams
+	if tenant != "" {
+		// Whatever the endpoint configuration, never let selectors through
+		// without the tenant label
+		queryParams = appendMissing(queryParams, config.DefaultEndpoint.QueryParams...)
+	}
+
+	for _, param := range queryParams {
+		values := params[param]
+		scopedMatches := false
+		for i, value := range values {
+			info.originalQueries = append(info.originalQueries, value)
+
+			// Restrict fanned out queries to the upstream's external labels
+			if info.fanout {
+				scoped, matches, err := fanout.ScopeQuery(value, info.backend.externalLabels)
+				if err != nil {
+					return &requestError{status: http.StatusBadRequest, err: fmt.Errorf("invalid %s parameter: %w", param, err)}
+				}
+				value = scoped
+				scopedMatches = scopedMatches || matches
+			}
+
+			rewritten := info.rewriter.RewriteQuery(value)
+			if tenant != "" {
+				var err error
+				rewritten, err = rewriter.EnforceLabel(rewritten, p.tenant.Label, tenant)
+				if errors.Is(err, rewriter.ErrLabelConflict) {
+					return &requestError{status: http.StatusForbidden, err: err}
+				}
+				if err != nil {
+					return &requestError{status: http.StatusBadRequest, err: fmt.Errorf("invalid %s parameter: %w", param, err)}
+				}
+			}
+
+			params[param][i] = rewritten
+			info.rewrittenQueries = append(info.rewrittenQueries, rewritten)
+		}
+
+		if info.fanout && len(values) > 0 && !scopedMatches {
+			info.noMatch = true
+		}
+	}
+
+	return nil
+}
+
+// endpoint returns the endpoint configuration that applies to requests to
+// the path
+func (p *PrometheusProxy) endpoint(urlPath string) config.Endpoint {
+	for _, ep := range p.endpoints {
+		if ok, _ := path.Match(ep.Path, urlPath); ok {
+			return ep
+		}
+	}
+	return config.DefaultEndpoint
+}
+
+// rewritePathLabel rewrites the label name in the request path that is
+// matched by the last wildcard of the endpoint's path pattern
+func rewritePathLabel(req *http.Request, pattern string, rw *rewriter.Rewriter) {
+	patternSegments := strings.Split(pattern, "/")
+	segments := strings.Split(req.URL.Path, "/")
+	if len(segments) != len(patternSegments) {
+		return
+	}
+
+	for i := len(patternSegments) - 1; i >= 0; i-- {
+		if strings.Contains(patternSegments[i], "*") {
+			segments[i] = rw.RewriteLabelName(segments[i])
+			req.URL.Path = strings.Join(segments, "/")
+			req.URL.RawPath = ""
+			return
+		}
+	}
+}
+
+// appendMissing appends the values that are not in list yet
+func appendMissing(list []string, values ...string) []string {
+	result := append([]string(nil), list...)
+	for _, v := range values {
+		found := false
+		for _, existing := range result {
+			if existing == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// supportedMediaType reports whether parameters are read from and rewritten
+// in request bodies of the media type
+func supportedMediaType(mediaType string) bool {
+	switch mediaType {
+	case mediaTypeForm, mediaTypeMultipart, mediaTypeJSON:
+		return true
+	}
+	return false
+}
+
+// hasBody reports whether the request has a body that Prometheus would read
+// form parameters from
+func hasBody(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch:
+		return req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+func TestPathLabel(t *testing.T) {
+	var upstreamPath string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamPath = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":["a","b"]}`))
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		TargetPrometheus: upstream.URL,
+		Mappings: []config.Mapping{
+			{
+				Direction: config.DirectionQuery,
+				Rules:     []config.Rule{{SourceLabel: "instance", TargetLabel: "host"}},
+			},
+		},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/label/instance/values", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", rec.Code)
+	}
+	if want := "/api/v1/label/host/values"; upstreamPath != want {
+		t.Errorf("upstream path = %s, want %s", upstreamPath, want)
+	}
+}
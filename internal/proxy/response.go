@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/codec"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/fanout"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/tracing"
+)
+
+// decodeBody replaces the body of a compressed response with its
+// decompressed content. A nil codec leaves the body unchanged.
+func decodeBody(resp *http.Response, dec codec.Codec) error {
+	if dec == nil {
+		return nil
+	}
+
+	raw := &countingReader{r: resp.Body}
+	reader, err := dec.NewReader(raw)
+	if err != nil {
+		resp.Body.Close()
+		return &requestError{status: http.StatusBadGateway, err: fmt.Errorf("failed to decompress response: %w", err)}
+	}
+	resp.Body = &decodedBody{ReadCloser: reader, upstream: resp.Body, raw: raw}
+	return nil
+}
+
+// streamBody replaces the response body with the output of fn, encoded with
+// enc, or not at all if enc is nil. fn reads the decoded upstream body from
+// src and runs while the response is sent to the client, so the length of
+// the new body is not known in advance.
+//
+// The decode, rewrite and encode stages are interleaved on the same stream,
+// so they share one span. Their byte counts and the time spent in each are
+// recorded as span attributes instead.
+func (p *PrometheusProxy) streamBody(resp *http.Response, src io.Reader, enc codec.Codec, name string, fn func(dst io.Writer, src io.Reader) error) {
+	ctx := resp.Request.Context()
+	upstream := resp.Body
+
+	upstreamEncoding := resp.Header.Get("Content-Encoding")
+	encoding := codec.Identity
+	if enc != nil {
+		encoding = enc.Name()
+		resp.Header.Set("Content-Encoding", encoding)
+	} else {
+		resp.Header.Del("Content-Encoding")
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer upstream.Close()
+
+		_, span := tracing.Tracer().Start(ctx, name,
+			trace.WithAttributes(
+				attribute.String("upstream.content_encoding", upstreamEncoding),
+				attribute.String("content_encoding", encoding),
+			),
+		)
+
+		start := time.Now()
+		in := &countingReader{r: src}
+		out := &countingWriter{w: pw}
+		rewritten := &countingWriter{}
+		var rewrite time.Duration
+		err := encode(out, enc, func(dst io.Writer) error {
+			rewritten.w = dst
+			defer func(start time.Time) { rewrite = time.Since(start) }(time.Now())
+			return fn(rewritten, in)
+		})
+		total := time.Since(start)
+
+		// Decoding includes waiting for the upstream and encoding includes
+		// waiting for the client
+		attrs := []attribute.KeyValue{
+			attribute.Int64("body.size", in.n),
+			attribute.Int64("body.rewritten_size", rewritten.n),
+			attribute.Int64("body.encoded_size", out.n),
+			attribute.Float64("decode.duration_ms", milliseconds(in.d)),
+			attribute.Float64("rewrite.duration_ms", milliseconds(rewrite-in.d-rewritten.d)),
+			attribute.Float64("encode.duration_ms", milliseconds(total-rewrite+rewritten.d)),
+		}
+		if body, ok := upstream.(*decodedBody); ok {
+			attrs = append(attrs, attribute.Int64("body.upstream_size", body.raw.n))
+		}
+		span.SetAttributes(attrs...)
+
+		if err != nil {
+			span.RecordError(err)
+			p.logger.WarnContext(ctx, "failed to stream response body", slog.String("step", name), slog.Any("error", err))
+		} else {
+			p.logger.DebugContext(ctx, "streamed response body",
+				slog.String("step", name),
+				slog.String("upstream_content_encoding", upstreamEncoding),
+				slog.String("content_encoding", encoding),
+				slog.Int64("original_bytes", in.n),
+				slog.Int64("encoded_bytes", out.n),
+			)
+		}
+		// End the span before the client sees the end of the body
+		span.End()
+		pw.CloseWithError(err)
+	}()
+
+	resp.Body = &rewrittenBody{PipeReader: pr, upstream: upstream}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+}
+
+// sharedHeaders are the upstream response headers passed on to requests
+// sharing the response of another
+var sharedHeaders = []string{"Content-Type", "Retry-After", "Warning", warningHeader}
+
+// sharedHeader returns the headers of an upstream response passed on to
+// requests sharing it
+func sharedHeader(src http.Header) http.Header {
+	header := make(http.Header)
+	for _, name := range sharedHeaders {
+		if values := src.Values(name); len(values) > 0 {
+			header[name] = append([]string(nil), values...)
+		}
+	}
+	return header
+}
+
+// writeShared writes an upstream response shared with the request
+func writeShared(w http.ResponseWriter, acceptEncoding string, resp fanout.Response) {
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	writeBody(w, acceptEncoding, resp.StatusCode, resp.Body)
+}
+
+// writeBody writes a JSON response body, encoded as accepted by the client
+func writeBody(w http.ResponseWriter, acceptEncoding string, status int, body []byte) {
+	enc := codec.Negotiate(acceptEncoding)
+
+	header := w.Header()
+	if header.Get("Content-Type") == "" {
+		// Shared upstream responses keep their own
+		header.Set("Content-Type", "application/json")
+	}
+	header.Add("Vary", "Accept-Encoding")
+	if enc != nil {
+		header.Set("Content-Encoding", enc.Name())
+	} else {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	w.WriteHeader(status)
+
+	encode(w, enc, func(dst io.Writer) error {
+		_, err := dst.Write(body)
+		return err
+	})
+}
+
+// encode calls fn with a writer that compresses to w using enc
+func encode(w io.Writer, enc codec.Codec, fn func(dst io.Writer) error) error {
+	if enc == nil {
+		return fn(w)
+	}
+
+	encoder, err := enc.NewWriter(w)
+	if err != nil {
+		return err
+	}
+	if err := fn(encoder); err != nil {
+		encoder.Close()
+		return err
+	}
+	return encoder.Close()
+}
+
+// firstByte returns the first non-whitespace byte of r without consuming it
+func firstByte(r *bufio.Reader) (byte, error) {
+	for n := 1; ; n++ {
+		b, err := r.Peek(n)
+		if len(b) < n {
+			return 0, err
+		}
+		switch c := b[n-1]; c {
+		case ' ', '\t', '\n', '\r':
+		default:
+			return c, nil
+		}
+	}
+}
+
+// decodedBody is a response body decompressed while it is read
+type decodedBody struct {
+	io.ReadCloser
+	upstream io.Closer
+	raw      *countingReader
+}
+
+// Close closes the decompressor and the upstream body
+func (b *decodedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.upstream.Close()
+}
+
+// rewrittenBody is a response body that is rewritten while it is read
+type rewrittenBody struct {
+	*io.PipeReader
+	upstream io.Closer
+}
+
+// Close stops the rewriting and closes the upstream body
+func (b *rewrittenBody) Close() error {
+	b.PipeReader.Close()
+	return b.upstream.Close()
+}
+
+// countingReader counts the bytes read from r and the time spent reading
+type countingReader struct {
+	r io.Reader
+	n int64
+	d time.Duration
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := c.r.Read(p)
+	c.d += time.Since(start)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written to w and the time spent writing
+type countingWriter struct {
+	w io.Writer
+	n int64
+	d time.Duration
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	start := time.Now()
+	n, err := c.w.Write(p)
+	c.d += time.Since(start)
+	c.n += int64(n)
+	return n, err
+}
+
+// milliseconds returns d in fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+func TestCorruptResponseEncoding(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(`{"status":"success","data":{"resultType":"vector","result":[]}}`))
+	zw.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		// The body ends within the gzip header
+		w.Write(buf.Bytes()[:5])
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		TargetPrometheus: upstream.URL,
+		Mappings: []config.Mapping{
+			{
+				Direction: config.DirectionResult,
+				Rules:     []config.Rule{{SourceLabel: "host", TargetLabel: "instance"}},
+			},
+		},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+
+	// The upstream response is at fault, not the query
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("Content-Encoding = %q, want none", got)
+	}
+	if body := rec.Body.String(); !strings.Contains(body, `"errorType":"unavailable"`) || !strings.Contains(body, "failed to decompress response") {
+		t.Errorf("body = %s, want unavailable error", body)
+	}
+}
+
+func TestStreamSpanAttributes(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	body := `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"host":"a"},"value":[1,"1"]}]}}`
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(body))
+	zw.Close()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(buf.Bytes())
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		TargetPrometheus: upstream.URL,
+		Mappings: []config.Mapping{
+			{
+				Direction: config.DirectionResult,
+				Rules:     []config.Rule{{SourceLabel: "host", TargetLabel: "instance"}},
+			},
+		},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+
+	encodedSize := int64(rec.Body.Len())
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewritten, _ := io.ReadAll(zr)
+
+	var attrs map[attribute.Key]attribute.Value
+	for _, span := range recorder.Ended() {
+		if span.Name() == "rewrite response" {
+			attrs = make(map[attribute.Key]attribute.Value)
+			for _, kv := range span.Attributes() {
+				attrs[kv.Key] = kv.Value
+			}
+		}
+	}
+	if attrs == nil {
+		t.Fatal("no rewrite response span")
+	}
+
+	sizes := map[attribute.Key]int64{
+		"body.upstream_size":  int64(buf.Len()),
+		"body.size":           int64(len(body)),
+		"body.rewritten_size": int64(len(rewritten)),
+		"body.encoded_size":   encodedSize,
+	}
+	for key, want := range sizes {
+		if got := attrs[key].AsInt64(); got != want {
+			t.Errorf("%s = %d, want %d", key, got, want)
+		}
+	}
+	for _, key := range []attribute.Key{"decode.duration_ms", "rewrite.duration_ms", "encode.duration_ms"} {
+		if v, ok := attrs[key]; !ok || v.Type() != attribute.FLOAT64 {
+			t.Errorf("%s = %v, want a duration", key, v.Emit())
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/promql"
+)
+
+// route is a routing rule with its query matchers compiled
+type route struct {
+	config.Route
+	matchers []routeMatcher
+}
+
+// routeMatcher is a label matcher that selects queries by their selectors
+type routeMatcher struct {
+	promql.Matcher
+	re *regexp.Regexp
+}
+
+// compileRoutes parses the query matchers of the routing rules
+func compileRoutes(routes []config.Route) ([]route, error) {
+	compiled := make([]route, 0, len(routes))
+	for i, r := range routes {
+		rt := route{Route: r}
+		for _, m := range r.Matchers {
+			selectors, err := promql.Selectors("{" + m + "}")
+			if err != nil || len(selectors) != 1 || len(selectors[0].Groups) != 1 || len(selectors[0].Groups[0]) != 1 {
+				return nil, fmt.Errorf("invalid matcher in route %d: %s", i, m)
+			}
+
+			rm := routeMatcher{Matcher: selectors[0].Groups[0][0]}
+			if rm.Type == promql.MatchRegexp || rm.Type == promql.MatchNotRegexp {
+				rm.re, err = regexp.Compile("^(?:" + rm.Value + ")$")
+				if err != nil {
+					return nil, fmt.Errorf("invalid regular expression in route %d: %w", i, err)
+				}
+			}
+			rt.matchers = append(rt.matchers, rm)
+		}
+		compiled = append(compiled, rt)
+	}
+	return compiled, nil
+}
+
+// trimPathPrefix removes the route's path prefix from a path if the path
+// starts with it as whole segments
+func (rt *route) trimPathPrefix(urlPath string) (string, bool) {
+	return trimPathPrefix(urlPath, strings.TrimSuffix(rt.PathPrefix, "/"))
+}
+
+// matches reports whether the request satisfies all conditions of the route
+func (rt *route) matches(req *http.Request, tenant string, selectors []*promql.Selector) bool {
+	if rt.PathPrefix != "" {
+		if _, ok := rt.trimPathPrefix(req.URL.Path); !ok {
+			return false
+		}
+	}
+	for name, value := range rt.Headers {
+		if req.Header.Get(name) != value {
+			return false
+		}
+	}
+	if rt.Tenant != "" && rt.Tenant != tenant {
+		return false
+	}
+	for _, m := range rt.matchers {
+		if !m.matchesAny(selectors) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesAny reports whether any selector has an equality matcher on the
+// label whose value satisfies the route matcher
+func (m *routeMatcher) matchesAny(selectors []*promql.Selector) bool {
+	for _, sel := range selectors {
+		// The metric name is an equality matcher on __name__
+		if m.Name == "__name__" && sel.MetricName != "" && m.matchesValue(sel.MetricName) {
+			return true
+		}
+		for _, sm := range sel.Matchers() {
+			if sm.Name != m.Name || sm.Type != promql.MatchEqual {
+				continue
+			}
+			if m.matchesValue(sm.Value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesValue reports whether a label value satisfies the matcher
+func (m *routeMatcher) matchesValue(value string) bool {
+	switch m.Type {
+	case promql.MatchEqual:
+		return value == m.Value
+	case promql.MatchNotEqual:
+		return value != m.Value
+	case promql.MatchRegexp:
+		return m.re.MatchString(value)
+	case promql.MatchNotRegexp:
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+// selectBackend returns the upstream for the request. The first matching
+// route wins; requests matching no route go to the default upstream. The
+// path prefix of the matching route is stripped if configured.
+func (p *PrometheusProxy) selectBackend(req *http.Request, tenant string, ep config.Endpoint, params ...url.Values) *backend {
+	var selectors []*promql.Selector
+	for _, values := range params {
+		for _, param := range ep.QueryParams {
+			for _, query := range values[param] {
+				// Unparseable queries simply don't match any route matchers
+				parsed, _ := promql.Selectors(query)
+				selectors = append(selectors, parsed...)
+			}
+		}
+		for _, param := range ep.MetricParams {
+			for _, name := range values[param] {
+				selectors = append(selectors, &promql.Selector{MetricName: name})
+			}
+		}
+	}
+
+	for i := range p.routes {
+		rt := &p.routes[i]
+		if !rt.matches(req, tenant, selectors) {
+			continue
+		}
+		if rt.StripPathPrefix && rt.PathPrefix != "" {
+			req.URL.Path, _ = rt.trimPathPrefix(req.URL.Path)
+			req.URL.RawPath = ""
+		}
+		return p.backends[rt.Upstream]
+	}
+
+	return p.backends[p.defaultBackend]
+}
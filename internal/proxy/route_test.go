@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+func TestRoutePathPrefix(t *testing.T) {
+	tests := []struct {
+		prefix string
+		path   string
+		want   string
+		wantOk bool
+	}{
+		{prefix: "/eu", path: "/eu/api/v1/query", want: "/api/v1/query", wantOk: true},
+		{prefix: "/eu/", path: "/eu/api/v1/query", want: "/api/v1/query", wantOk: true},
+		{prefix: "/eu", path: "/eu", want: "/", wantOk: true},
+		{prefix: "/eu", path: "/europe/api/v1/query", want: "/europe/api/v1/query"},
+		{prefix: "/eu", path: "/api/v1/query", want: "/api/v1/query"},
+	}
+
+	for _, tt := range tests {
+		rt := route{Route: config.Route{PathPrefix: tt.prefix}}
+		got, ok := rt.trimPathPrefix(tt.path)
+		if got != tt.want || ok != tt.wantOk {
+			t.Errorf("trimPathPrefix(%q) with prefix %q = %q, %v, want %q, %v", tt.path, tt.prefix, got, ok, tt.want, tt.wantOk)
+		}
+	}
+}
+
+func TestSelectBackend(t *testing.T) {
+	cfg := &config.Config{
+		Upstreams: []config.UpstreamServer{
+			{Name: "us", URL: "http://prometheus-us:9090"},
+			{Name: "eu", URL: "http://prometheus-eu:9090"},
+			{Name: "ap", URL: "http://prometheus-ap:9090"},
+			{Name: "staging", URL: "http://prometheus-staging:9090"},
+		},
+		DefaultUpstream: "us",
+		Routes: []config.Route{
+			{Upstream: "ap", PathPrefix: "/ap", StripPathPrefix: true},
+			{Upstream: "staging", Headers: map[string]string{"X-Env": "staging"}},
+			{Upstream: "ap", Tenant: "team-ap"},
+			{Upstream: "eu", Matchers: []string{`cluster="eu"`}},
+			{Upstream: "ap", Matchers: []string{`cluster=~"ap-.*"`, `env!="dev"`}},
+			{Upstream: "staging", Matchers: []string{`__name__="staging_up"`}},
+		},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		headers  map[string]string
+		tenant   string
+		query    string
+		want     string
+		wantPath string
+	}{
+		{name: "no route matches", path: "/api/v1/query", query: `up{cluster="us"}`, want: "us"},
+		{name: "path prefix", path: "/ap/api/v1/query", query: "up", want: "ap", wantPath: "/api/v1/query"},
+		{name: "path prefix as whole segment", path: "/apac/api/v1/query", query: "up", want: "us", wantPath: "/apac/api/v1/query"},
+		{name: "header", path: "/api/v1/query", headers: map[string]string{"X-Env": "staging"}, query: "up", want: "staging"},
+		{name: "header with other value", path: "/api/v1/query", headers: map[string]string{"X-Env": "prod"}, query: "up", want: "us"},
+		{name: "tenant", path: "/api/v1/query", tenant: "team-ap", query: "up", want: "ap"},
+		{name: "equality matcher", path: "/api/v1/query", query: `sum(rate(http_requests_total{cluster="eu"}[5m]))`, want: "eu"},
+		{name: "matcher in any selector", path: "/api/v1/query", query: `up / on(job) up{cluster="eu"}`, want: "eu"},
+		{name: "matcher in or group", path: "/api/v1/query", query: `{job="a" or cluster="eu"}`, want: "eu"},
+		{name: "regexp matcher", path: "/api/v1/query", query: `up{cluster="ap-south",env="prod"}`, want: "ap"},
+		{name: "all matchers must match", path: "/api/v1/query", query: `up{cluster="ap-south",env="dev"}`, want: "us"},
+		{name: "regexp matches whole value", path: "/api/v1/query", query: `up{cluster="xap-south"}`, want: "us"},
+		{name: "only equality matchers in queries route", path: "/api/v1/query", query: `up{cluster=~"eu"}`, want: "us"},
+		{name: "metric name", path: "/api/v1/query", query: `rate(staging_up[5m])`, want: "staging"},
+		{name: "unparseable query", path: "/api/v1/query", query: `up{cluster="eu"`, want: "us"},
+		{name: "first match wins", path: "/ap/api/v1/query", headers: map[string]string{"X-Env": "staging"}, query: `up{cluster="eu"}`, want: "ap", wantPath: "/api/v1/query"},
+		{name: "earlier route before query matchers", path: "/api/v1/query", tenant: "team-ap", query: `up{cluster="eu"}`, want: "ap"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			for name, value := range tt.headers {
+				req.Header.Set(name, value)
+			}
+			query := url.Values{"query": {tt.query}}
+
+			if b := p.selectBackend(req, tt.tenant, p.endpoint(req.URL.Path), query); b.name != tt.want {
+				t.Errorf("selectBackend() = %s, want %s", b.name, tt.want)
+			}
+			wantPath := tt.wantPath
+			if wantPath == "" {
+				wantPath = tt.path
+			}
+			if req.URL.Path != wantPath {
+				t.Errorf("path = %s, want %s", req.URL.Path, wantPath)
+			}
+		})
+	}
+}
+
+func TestSelectBackendForm(t *testing.T) {
+	cfg := &config.Config{
+		Upstreams: []config.UpstreamServer{
+			{Name: "us", URL: "http://prometheus-us:9090"},
+			{Name: "eu", URL: "http://prometheus-eu:9090"},
+		},
+		Routes: []config.Route{
+			{Upstream: "eu", Matchers: []string{`cluster="eu"`}},
+		},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	// Queries in the body and match[] selectors are routed too
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/series", nil)
+	form := url.Values{"match[]": {`up{cluster="eu"}`}}
+	if b := p.selectBackend(req, "", p.endpoint(req.URL.Path), url.Values{}, form); b.name != "eu" {
+		t.Errorf("selectBackend() = %s, want eu", b.name)
+	}
+
+	// Without routes matching, the first upstream is the default
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/series", nil)
+	if b := p.selectBackend(req, "", p.endpoint(req.URL.Path), url.Values{"match[]": {"up"}}); b.name != "us" {
+		t.Errorf("selectBackend() = %s, want us", b.name)
+	}
+}
@@ -0,0 +1,232 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/fanout"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/promapi"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/promql"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/tracing"
+)
+
+// timeRange is a range of evaluation times of a range query
+type timeRange struct {
+	start, end time.Time
+}
+
+// splitParams are the rewritten parameters of a range query that is split
+type splitParams struct {
+	query, form url.Values
+}
+
+// forRange returns copies of the parameters for a sub-range
+func (s splitParams) forRange(r timeRange) (url.Values, url.Values) {
+	query, form := copyValues(s.query), copyValues(s.form)
+	setFormValue(query, form, "start", promapi.FormatTime(r.start))
+	setFormValue(query, form, "end", promapi.FormatTime(r.end))
+	return query, form
+}
+
+// splitRange decides whether a rewritten range query is split into
+// sub-queries. If so, it returns their time ranges and the parameters of
+// the query.
+func (p *PrometheusProxy) splitRange(req *http.Request, info *requestInfo) ([]timeRange, splitParams, bool) {
+	split := p.querySplit
+	if !split.Enabled || info.fanout || req.URL.Path != "/api/v1/query_range" {
+		return nil, splitParams{}, false
+	}
+
+	params := splitParams{query: req.URL.Query()}
+	if hasBody(req) {
+		// Only form bodies are sent again for each sub-range
+		mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if mediaType != mediaTypeForm {
+			return nil, splitParams{}, false
+		}
+		data, err := ioutil.ReadAll(req.Body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(data))
+		if err != nil {
+			return nil, splitParams{}, false
+		}
+		if params.form, err = url.ParseQuery(string(data)); err != nil {
+			return nil, splitParams{}, false
+		}
+	}
+
+	start, err := promapi.ParseTime(formValue(params.query, params.form, "start"))
+	if err != nil {
+		return nil, splitParams{}, false
+	}
+	end, err := promapi.ParseTime(formValue(params.query, params.form, "end"))
+	if err != nil {
+		return nil, splitParams{}, false
+	}
+	step, err := promapi.ParseDuration(formValue(params.query, params.form, "step"))
+	if err != nil || step < time.Millisecond || step >= split.Interval || end.Before(start) {
+		// Let the upstream report invalid parameters
+		return nil, splitParams{}, false
+	}
+
+	// Selectors at @ start() or @ end() would be evaluated at the start or
+	// end of each sub-range instead of the whole range
+	boundaries, err := promql.UsesRangeBoundaries(formValue(params.query, params.form, "query"))
+	if err != nil || boundaries {
+		return nil, splitParams{}, false
+	}
+
+	ranges := splitTimeRange(start, end, step, split.Interval)
+	return ranges, params, len(ranges) > 1
+}
+
+// splitTimeRange splits the evaluation times start, start+step, ... up to
+// end at multiples of interval since the Unix epoch. Each sub-range starts
+// at an evaluation time of the whole range, so the results of the
+// sub-ranges add up to the result of the whole range.
+func splitTimeRange(start, end time.Time, step, interval time.Duration) []timeRange {
+	var ranges []timeRange
+	for s := start; !s.After(end); {
+		boundary := alignTime(s, interval).Add(interval)
+		next := s.Add((boundary.Sub(s) + step - 1) / step * step)
+		e := next.Add(-step)
+		if e.After(end) {
+			e = end
+		}
+		ranges = append(ranges, timeRange{start: s, end: e})
+		s = next
+	}
+	return ranges
+}
+
+// serveSplit sends a range query as sub-queries over its sub-ranges, at
+// most max_parallel at a time, and writes their concatenated results.
+// Sub-ranges that end before the recent window of the cache no longer
+// change, so their results are cached and reused by later queries that
+// cover them, such as the next refresh of a dashboard.
+func (p *PrometheusProxy) serveSplit(w http.ResponseWriter, req *http.Request, info *requestInfo, ranges []timeRange, params splitParams) {
+	ctx, span := tracing.Tracer().Start(req.Context(), "split query",
+		trace.WithAttributes(attribute.Int("ranges", len(ranges))),
+	)
+
+	var (
+		responses = make([]fanout.Response, len(ranges))
+		keys      = make([]string, len(ranges))
+		cached    int
+		wg        sync.WaitGroup
+		sem       = make(chan struct{}, p.querySplit.MaxParallel)
+		now       = time.Now()
+	)
+	for i, r := range ranges {
+		query, form := params.forRange(r)
+		if info.cache != nil && r.end.Before(now.Add(-info.cache.cfg.RecentWindow)) {
+			key := requestKey(req, info, query, form, info.cache.cfg.KeyHeaders)
+			if body, ok := info.cache.lru.Get(key); ok {
+				p.metrics.cacheRequests.WithLabelValues("query_split", cacheHit).Inc()
+				responses[i] = fanout.Response{Upstream: info.backend.name, StatusCode: http.StatusOK, Body: body}
+				cached++
+				continue
+			}
+			p.metrics.cacheRequests.WithLabelValues("query_split", cacheMiss).Inc()
+			keys[i] = key
+		}
+
+		fr := subRequest(ctx, req, info, query, form)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			release, err := p.acquire(info)
+			if err != nil {
+				responses[i] = fanout.Response{Upstream: info.backend.name, Err: err}
+				return
+			}
+			defer release()
+			responses[i] = p.roundTrip(fr)
+		}(i)
+	}
+	wg.Wait()
+
+	span.SetAttributes(attribute.Int("ranges.cached", cached))
+	span.End()
+
+	// Sub-queries rejected by the limiter reject the whole request
+	for _, resp := range responses {
+		var reqErr *requestError
+		if errors.As(resp.Err, &reqErr) {
+			p.rejectRequest(w, req, resp.Err)
+			return
+		}
+	}
+
+	status, body := fanout.Concat(responses)
+
+	p.logger.DebugContext(ctx, "split range query",
+		slog.Int("ranges", len(ranges)),
+		slog.Int("cached_ranges", cached),
+		slog.Int("status", status),
+	)
+
+	// Only cache results that were all valid query results
+	if status == http.StatusOK && info.cache != nil {
+		maxSize := info.cache.cfg.MaxEntrySizeMB << 20
+		for i, key := range keys {
+			if key != "" && len(responses[i].Body) <= maxSize {
+				info.cache.lru.Set(key, responses[i].Body, info.cache.cfg.HistoricalTTL)
+			}
+		}
+	}
+	if info.capture != nil {
+		info.capture.Write(body)
+		info.capture.finish(status, nil)
+	}
+
+	writeBody(w, info.acceptEncoding, status, body)
+}
+
+// subRequest returns a copy of a rewritten request to send with roundTrip,
+// with the given parameters. The body is only replaced if form is set.
+func subRequest(ctx context.Context, req *http.Request, info *requestInfo, query, form url.Values) fanoutRequest {
+	// The response is rewritten like the request's, but not compressed for
+	// the client or kept by rewriteResponse
+	subInfo := &requestInfo{
+		profile:  info.profile,
+		rewriter: info.rewriter,
+		backend:  info.backend,
+		endpoint: info.endpoint,
+	}
+	subReq := req.Clone(context.WithValue(ctx, requestInfoKey{}, subInfo))
+	subReq.URL.RawQuery = query.Encode()
+	if form != nil {
+		body := form.Encode()
+		subReq.Body = ioutil.NopCloser(strings.NewReader(body))
+		subReq.ContentLength = int64(len(body))
+		subReq.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	return fanoutRequest{backend: info.backend, req: subReq, info: subInfo}
+}
+
+// copyValues returns a deep copy of values
+func copyValues(values url.Values) url.Values {
+	if values == nil {
+		return nil
+	}
+	copied := make(url.Values, len(values))
+	for name, list := range values {
+		copied[name] = append([]string(nil), list...)
+	}
+	return copied
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/promapi"
+)
+
+func TestSplitTimeRange(t *testing.T) {
+	day := 24 * time.Hour
+	midnight := time.Unix(1717977600, 0).UTC() // 2024-06-10T00:00:00Z
+
+	tests := []struct {
+		name       string
+		start, end time.Time
+		step       time.Duration
+		want       []timeRange
+	}{
+		{
+			name:  "within a day",
+			start: midnight.Add(time.Hour),
+			end:   midnight.Add(2 * time.Hour),
+			step:  time.Minute,
+			want:  []timeRange{{midnight.Add(time.Hour), midnight.Add(2 * time.Hour)}},
+		},
+		{
+			name:  "across midnight",
+			start: midnight.Add(-time.Hour),
+			end:   midnight.Add(time.Hour),
+			step:  time.Minute,
+			want: []timeRange{
+				{midnight.Add(-time.Hour), midnight.Add(-time.Minute)},
+				{midnight, midnight.Add(time.Hour)},
+			},
+		},
+		{
+			name:  "step not dividing the day",
+			start: midnight.Add(-10 * time.Minute),
+			end:   midnight.Add(day + time.Hour),
+			step:  7 * time.Minute,
+			want: []timeRange{
+				{midnight.Add(-10 * time.Minute), midnight.Add(-3 * time.Minute)},
+				{midnight.Add(4 * time.Minute), midnight.Add(day - time.Minute)},
+				{midnight.Add(day + 6*time.Minute), midnight.Add(day + time.Hour)},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitTimeRange(tt.start, tt.end, tt.step, day)
+			if len(got) != len(tt.want) {
+				t.Fatalf("splitTimeRange() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if !got[i].start.Equal(tt.want[i].start) || !got[i].end.Equal(tt.want[i].end) {
+					t.Errorf("range %d = %v to %v, want %v to %v", i, got[i].start, got[i].end, tt.want[i].start, tt.want[i].end)
+				}
+			}
+		})
+	}
+}
+
+func TestQuerySplit(t *testing.T) {
+	// The upstream returns a sample at the start and end of each range
+	var (
+		mu     sync.Mutex
+		ranges []string
+	)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		start, end := r.Form.Get("start"), r.Form.Get("end")
+		mu.Lock()
+		ranges = append(ranges, start+"-"+end)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"host":"a"},"values":[[%s,"1"],[%s,"2"]]}]}}`, start, end)
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		TargetPrometheus: upstream.URL,
+		Mappings: []config.Mapping{
+			{
+				Direction: config.DirectionResult,
+				Rules:     []config.Rule{{SourceLabel: "host", TargetLabel: "instance"}},
+			},
+		},
+		Cache:      config.Cache{Enabled: true},
+		QuerySplit: config.QuerySplit{Enabled: true},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	query := func(method, rawQuery string) string {
+		var req *http.Request
+		if method == http.MethodPost {
+			req = httptest.NewRequest(method, "/api/v1/query_range", strings.NewReader(rawQuery))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			req = httptest.NewRequest(method, "/api/v1/query_range?"+rawQuery, nil)
+		}
+		rec := httptest.NewRecorder()
+		p.ServeHTTP(rec, req)
+		body, _ := io.ReadAll(rec.Result().Body)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, body %s", rec.Code, body)
+		}
+		return string(body)
+	}
+
+	// Three days from 2024-06-10T00:00:00Z with a one hour step
+	resp := query(http.MethodGet, "query=up&start=1717977600&end=1718164800&step=3600")
+	want := `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"instance":"a"},"values":[` +
+		`[1717977600,"1"],[1718060400,"2"],[1718064000,"1"],[1718146800,"2"],[1718150400,"1"],[1718164800,"2"]]}]}}`
+	if resp != want {
+		t.Errorf("response = %s, want %s", resp, want)
+	}
+	wantRanges := []string{"1717977600-1718060400", "1718064000-1718146800", "1718150400-1718164800"}
+	if !equalSet(ranges, wantRanges) {
+		t.Errorf("upstream ranges = %v, want %v", ranges, wantRanges)
+	}
+
+	// Extending the range only queries the new last day, also by POST
+	ranges = nil
+	resp = query(http.MethodPost, "query=up&start=1717977600&end=1718168400&step=3600")
+	var parsed promapi.Response
+	if err := json.Unmarshal([]byte(resp), &parsed); err != nil || parsed.Status != "success" {
+		t.Fatalf("invalid response %s", resp)
+	}
+	if want := []string{"1718150400-1718168400"}; !equalSet(ranges, want) {
+		t.Errorf("upstream ranges = %v, want %v", ranges, want)
+	}
+	// Queries evaluated at the start or end of the range are not split
+	for _, q := range []string{"up%20@%20start()", "rate(up[5m]%20@%20end%20(%20))"} {
+		ranges = nil
+		query(http.MethodGet, "query="+q+"&start=1717977600&end=1718164800&step=3600")
+		if want := []string{"1717977600-1718164800"}; !equalSet(ranges, want) {
+			t.Errorf("%s: upstream ranges = %v, want %v", q, ranges, want)
+		}
+	}
+}
+
+// equalSet reports whether a and b contain the same strings in any order
+func equalSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	count := make(map[string]int)
+	for _, s := range a {
+		count[s]++
+	}
+	for _, s := range b {
+		count[s]--
+		if count[s] < 0 {
+			return false
+		}
+	}
+	return true
+}
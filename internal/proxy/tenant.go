@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/identity"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/promql"
+)
+
+// tenantQueryEndpoints take a PromQL expression in the query parameter
+var tenantQueryEndpoints = []string{
+	"/api/v1/query",
+	"/api/v1/query_range",
+	"/api/v1/query_exemplars",
+}
+
+// tenantMatchEndpoints take series selectors in the match[] parameter
+var tenantMatchEndpoints = []string{
+	"/api/v1/series",
+	"/api/v1/labels",
+	"/api/v1/label/*/values",
+	"/federate",
+}
+
+// requestTenant returns the tenant of the request from the configured
+// source, or an empty string if there is none
+func (p *PrometheusProxy) requestTenant(req *http.Request) string {
+	switch p.tenant.Source {
+	case config.TenantSourceHeader:
+		return req.Header.Get(p.tenant.Header)
+	case config.TenantSourceQueryParam:
+		query := req.URL.Query()
+		tenant := query.Get(p.tenant.QueryParam)
+		// The parameter is meant for the proxy only
+		if _, ok := query[p.tenant.QueryParam]; ok {
+			query.Del(p.tenant.QueryParam)
+			req.URL.RawQuery = query.Encode()
+		}
+		return tenant
+	case config.TenantSourceClientCert:
+		return identity.FromContext(req.Context())
+	}
+	return ""
+}
+
+// checkTenant rejects requests that cannot be restricted to a tenant
+func (p *PrometheusProxy) checkTenant(req *http.Request, tenant string) error {
+	if tenant == "" {
+		return &requestError{status: http.StatusForbidden, err: fmt.Errorf("no tenant provided via %s", p.tenant.Source)}
+	}
+
+	if !matchesEndpoint(req.URL.Path, tenantQueryEndpoints) && !matchesEndpoint(req.URL.Path, tenantMatchEndpoints) {
+		return &requestError{status: http.StatusForbidden, err: fmt.Errorf("endpoint %s is not allowed with tenant enforcement", req.URL.Path)}
+	}
+
+	return nil
+}
+
+// restrictToTenant adds a tenant selector to requests on series endpoints
+// that did not provide any match[] selectors, which would otherwise match
+// every series
+func (p *PrometheusProxy) restrictToTenant(req *http.Request, query, form url.Values, tenant string) {
+	if !matchesEndpoint(req.URL.Path, tenantMatchEndpoints) {
+		return
+	}
+	if len(query["match[]"]) > 0 || len(form["match[]"]) > 0 {
+		return
+	}
+	matcher := promql.Matcher{Name: p.tenant.Label, Type: promql.MatchEqual, Value: tenant}
+	query.Set("match[]", "{"+matcher.String()+"}")
+}
+
+// matchesEndpoint reports whether the path matches any of the patterns
+func matchesEndpoint(urlPath string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, urlPath); ok {
+			return true
+		}
+	}
+	return false
+}
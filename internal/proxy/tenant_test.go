@@ -0,0 +1,238 @@
+package proxy
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+// newTenantProxy returns a proxy enforcing the team label on an upstream
+// that records the parameters of the last request it received
+func newTenantProxy(t *testing.T, source config.TenantSource) (*PrometheusProxy, *url.Values) {
+	t.Helper()
+
+	received := &url.Values{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+			t.Errorf("upstream failed to parse request: %v", err)
+		}
+		*received = r.Form
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"status":"success","data":[]}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	cfg := &config.Config{
+		TargetPrometheus: upstream.URL,
+		Mappings: []config.Mapping{
+			{
+				Direction: config.DirectionQuery,
+				Rules:     []config.Rule{{SourceLabel: "instance", TargetLabel: "host"}},
+			},
+		},
+		Tenant: config.Tenant{Enabled: true, Label: "team", Source: source},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p, received
+}
+
+func TestTenantEnforcement(t *testing.T) {
+	p, received := newTenantProxy(t, config.TenantSourceHeader)
+
+	tests := []struct {
+		name       string
+		path       string
+		tenant     string
+		wantStatus int
+		wantParam  string
+		wantValues []string
+	}{
+		{
+			name:       "query",
+			path:       `/api/v1/query?query=` + url.QueryEscape(`up{instance="a"}`),
+			tenant:     "a",
+			wantStatus: http.StatusOK,
+			wantParam:  "query",
+			wantValues: []string{`up{host="a",team="a"}`},
+		},
+		{
+			name:       "match selectors",
+			path:       `/api/v1/series?match[]=up&match[]=` + url.QueryEscape(`{job="b"}`),
+			tenant:     "a",
+			wantStatus: http.StatusOK,
+			wantParam:  "match[]",
+			wantValues: []string{`up{team="a"}`, `{job="b",team="a"}`},
+		},
+		{
+			name:       "series without match",
+			path:       "/api/v1/series",
+			tenant:     "a",
+			wantStatus: http.StatusOK,
+			wantParam:  "match[]",
+			wantValues: []string{`{team="a"}`},
+		},
+		{
+			name:       "labels without match",
+			path:       "/api/v1/labels",
+			tenant:     "a",
+			wantStatus: http.StatusOK,
+			wantParam:  "match[]",
+			wantValues: []string{`{team="a"}`},
+		},
+		{
+			name:       "federate without match",
+			path:       "/federate",
+			tenant:     "a",
+			wantStatus: http.StatusOK,
+			wantParam:  "match[]",
+			wantValues: []string{`{team="a"}`},
+		},
+		{
+			name:       "missing tenant",
+			path:       "/api/v1/query?query=up",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "endpoint not allowed",
+			path:       "/api/v1/status/config",
+			tenant:     "a",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "negative tenant matcher",
+			path:       `/api/v1/query?query=` + url.QueryEscape(`up{team!="a"}`),
+			tenant:     "a",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "regexp tenant matcher",
+			path:       `/api/v1/query?query=` + url.QueryEscape(`up{team=~".*"}`),
+			tenant:     "a",
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "other tenant in match selector",
+			path:       `/api/v1/labels?match[]=` + url.QueryEscape(`up{team="b"}`),
+			tenant:     "a",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*received = nil
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.tenant != "" {
+				req.Header.Set("X-Tenant", tt.tenant)
+			}
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				if *received != nil {
+					t.Errorf("rejected request reached the upstream with %v", *received)
+				}
+				return
+			}
+			if got := (*received)[tt.wantParam]; strings.Join(got, " ") != strings.Join(tt.wantValues, " ") {
+				t.Errorf("upstream %s = %q, want %q", tt.wantParam, got, tt.wantValues)
+			}
+		})
+	}
+}
+
+func TestTenantQueryParam(t *testing.T) {
+	p, received := newTenantProxy(t, config.TenantSourceQueryParam)
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/query?query=up&tenant=a", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body.String())
+	}
+
+	// The tenant parameter is meant for the proxy only
+	if _, ok := (*received)["tenant"]; ok {
+		t.Errorf("tenant parameter reached the upstream: %v", *received)
+	}
+	if got := received.Get("query"); got != `up{team="a"}` {
+		t.Errorf("upstream query = %q, want %q", got, `up{team="a"}`)
+	}
+}
+
+func TestTenantRequestBody(t *testing.T) {
+	p, received := newTenantProxy(t, config.TenantSourceHeader)
+
+	var multipartBody bytes.Buffer
+	mw := multipart.NewWriter(&multipartBody)
+	mw.WriteField("query", "up")
+	mw.Close()
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		wantStatus  int
+	}{
+		{
+			name:        "form",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "query=up",
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "form with charset",
+			contentType: "application/x-www-form-urlencoded; charset=utf-8",
+			body:        "query=up",
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "multipart",
+			contentType: mw.FormDataContentType(),
+			body:        multipartBody.String(),
+			wantStatus:  http.StatusOK,
+		},
+		{
+			name:        "unsupported content type",
+			contentType: "text/plain",
+			body:        "query=up",
+			wantStatus:  http.StatusUnsupportedMediaType,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*received = nil
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/query", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			req.Header.Set("X-Tenant", "a")
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+			if tt.wantStatus != http.StatusOK {
+				if *received != nil {
+					t.Errorf("rejected request reached the upstream with %v", *received)
+				}
+				return
+			}
+			if got := received.Get("query"); got != `up{team="a"}` {
+				t.Errorf("upstream query = %q, want %q", got, `up{team="a"}`)
+			}
+		})
+	}
+}
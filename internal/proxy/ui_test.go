@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+// uiExchange is a request of a recorded Prometheus web UI session, with the
+// request the upstream is expected to receive and its response
+type uiExchange struct {
+	Name          string          `json:"name"`
+	Path          string          `json:"path"`
+	Query         url.Values      `json:"query"`
+	UpstreamPath  string          `json:"upstream_path"`
+	UpstreamQuery url.Values      `json:"upstream_query"`
+	UpstreamBody  json.RawMessage `json:"upstream_body"`
+	Response      json.RawMessage `json:"response"`
+}
+
+func TestUICompat(t *testing.T) {
+	data, err := os.ReadFile("testdata/ui_session.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var session []uiExchange
+	if err := json.Unmarshal(data, &session); err != nil {
+		t.Fatal(err)
+	}
+
+	exchanges := make(map[string]uiExchange)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		exchange, ok := exchanges[r.URL.Path]
+		if !ok {
+			t.Errorf("unexpected upstream request %s", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		if query := r.URL.Query(); !equalValues(query, exchange.UpstreamQuery) {
+			t.Errorf("%s: upstream query = %v, want %v", exchange.Name, query, exchange.UpstreamQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(exchange.UpstreamBody)
+	}))
+	defer upstream.Close()
+
+	cfg := &config.Config{
+		TargetPrometheus: upstream.URL,
+		Mappings: []config.Mapping{
+			{
+				Direction: config.DirectionQuery,
+				Rules:     []config.Rule{{SourceLabel: "instance", TargetLabel: "host"}},
+			},
+			{
+				Direction: config.DirectionResult,
+				Rules:     []config.Rule{{SourceLabel: "host", TargetLabel: "instance"}},
+			},
+		},
+		UI: config.UI{Compat: true},
+	}
+	p, err := New(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	for _, exchange := range session {
+		t.Run(exchange.Name, func(t *testing.T) {
+			exchanges = map[string]uiExchange{exchange.UpstreamPath: exchange}
+
+			req := httptest.NewRequest(http.MethodGet, exchange.Path+"?"+exchange.Query.Encode(), nil)
+			rec := httptest.NewRecorder()
+			p.ServeHTTP(rec, req)
+
+			resp := rec.Result()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, body %s", resp.StatusCode, body)
+			}
+
+			var got, want interface{}
+			if err := json.Unmarshal(body, &got); err != nil {
+				t.Fatalf("invalid response %s: %v", body, err)
+			}
+			if err := json.Unmarshal(exchange.Response, &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("response = %s, want %s", body, exchange.Response)
+			}
+		})
+	}
+}
+
+// equalValues reports whether two sets of query parameters are equal,
+// treating nil and empty as the same
+func equalValues(a, b url.Values) bool {
+	if len(a) == 0 && len(b) == 0 {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,210 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Scopes of a limit
+const (
+	ScopeClient = "client"
+	ScopeGlobal = "global"
+)
+
+// Reasons a request is rejected
+const (
+	ReasonRate        = "rate"
+	ReasonConcurrency = "concurrency"
+)
+
+// sweepInterval is how often the state of idle clients is dropped
+const sweepInterval = time.Minute
+
+// Limits are the limits of a single client or of all clients together. Zero
+// values disable a limit.
+type Limits struct {
+	// Rate is the number of requests per second
+	Rate float64
+	// Burst is the number of requests allowed at once above the rate
+	Burst int
+	// MaxConcurrent is the maximum number of requests in flight
+	MaxConcurrent int
+}
+
+// Error is returned for a request that exceeds a limit
+type Error struct {
+	Scope  string
+	Reason string
+	// RetryAfter is how long the client should wait before retrying
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Reason == ReasonConcurrency {
+		return fmt.Sprintf("too many concurrent requests (%s limit)", e.Scope)
+	}
+	return fmt.Sprintf("too many requests (%s limit)", e.Scope)
+}
+
+// state is the token bucket and the requests in flight of a client or of
+// all clients
+type state struct {
+	tokens float64
+	last   time.Time
+	active int
+}
+
+// Limiter limits the rate and the concurrency of requests per client and
+// globally. A nil Limiter lets all requests through.
+type Limiter struct {
+	perClient Limits
+	global    Limits
+
+	mu        sync.Mutex
+	all       *state
+	clients   map[string]*state
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// New creates a limiter with the given limits per client and globally. A
+// rate allows bursts of at least one request.
+func New(perClient, global Limits) *Limiter {
+	for _, limits := range []*Limits{&perClient, &global} {
+		if limits.Rate > 0 && limits.Burst < 1 {
+			limits.Burst = 1
+		}
+	}
+
+	l := &Limiter{
+		perClient: perClient,
+		global:    global,
+		clients:   make(map[string]*state),
+		now:       time.Now,
+	}
+	l.all = l.newState(global)
+	return l
+}
+
+// newState returns the state of a client that sent no requests yet
+func (l *Limiter) newState(limits Limits) *state {
+	return &state{tokens: float64(limits.Burst), last: l.now()}
+}
+
+// Allow takes a token for a request of the client. Tokens are only taken if
+// both the client's and the global rate allow the request.
+func (l *Limiter) Allow(client string) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	c := l.client(client)
+	if wait := refill(c, l.perClient, now); wait > 0 {
+		return &Error{Scope: ScopeClient, Reason: ReasonRate, RetryAfter: wait}
+	}
+	if wait := refill(l.all, l.global, now); wait > 0 {
+		return &Error{Scope: ScopeGlobal, Reason: ReasonRate, RetryAfter: wait}
+	}
+	if l.perClient.Rate > 0 {
+		c.tokens--
+	}
+	if l.global.Rate > 0 {
+		l.all.tokens--
+	}
+	return nil
+}
+
+// Acquire counts a request of the client as in flight until release is
+// called, unless the client or all clients already have the maximum number
+// of requests in flight
+func (l *Limiter) Acquire(client string) (release func(), err error) {
+	if l == nil {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	c := l.client(client)
+	if limit := l.perClient.MaxConcurrent; limit > 0 && c.active >= limit {
+		return nil, &Error{Scope: ScopeClient, Reason: ReasonConcurrency, RetryAfter: time.Second}
+	}
+	if limit := l.global.MaxConcurrent; limit > 0 && l.all.active >= limit {
+		return nil, &Error{Scope: ScopeGlobal, Reason: ReasonConcurrency, RetryAfter: time.Second}
+	}
+	c.active++
+	l.all.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			c.active--
+			l.all.active--
+		})
+	}, nil
+}
+
+// Stats returns the number of clients tracked and the number of requests
+// in flight
+func (l *Limiter) Stats() (clients, active int) {
+	if l == nil {
+		return 0, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.clients), l.all.active
+}
+
+// client returns the state of a client, creating it if needed
+func (l *Limiter) client(client string) *state {
+	c, ok := l.clients[client]
+	if !ok {
+		c = l.newState(l.perClient)
+		l.clients[client] = c
+	}
+	return c
+}
+
+// sweep drops the state of clients without requests in flight whose bucket
+// is full again, which is the same as the state of a new client
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for client, c := range l.clients {
+		if c.active == 0 && refill(c, l.perClient, now) == 0 && c.tokens >= float64(l.perClient.Burst) {
+			delete(l.clients, client)
+		}
+	}
+}
+
+// refill adds the tokens earned since the last refill to the bucket and
+// returns how long to wait for a token, or zero if one is available
+func refill(s *state, limits Limits, now time.Time) time.Duration {
+	if limits.Rate <= 0 {
+		return 0
+	}
+
+	if elapsed := now.Sub(s.last).Seconds(); elapsed > 0 {
+		s.tokens = math.Min(float64(limits.Burst), s.tokens+elapsed*limits.Rate)
+	}
+	s.last = now
+
+	if s.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - s.tokens) / limits.Rate * float64(time.Second))
+}
@@ -0,0 +1,109 @@
+package ratelimit
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLimiterRate(t *testing.T) {
+	now := time.Unix(1718000000, 0)
+	l := New(Limits{Rate: 2, Burst: 3}, Limits{Rate: 10, Burst: 4})
+	l.now = func() time.Time { return now }
+	l.all = l.newState(l.global)
+
+	// The burst of a client is allowed at once
+	for i := 0; i < 3; i++ {
+		if err := l.Allow("a"); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	err := l.Allow("a")
+	var limitErr *Error
+	if !errors.As(err, &limitErr) || limitErr.Scope != ScopeClient || limitErr.Reason != ReasonRate {
+		t.Fatalf("expected client rate limit error, got %v", err)
+	}
+	if limitErr.RetryAfter != 500*time.Millisecond {
+		t.Errorf("RetryAfter = %s, want 500ms", limitErr.RetryAfter)
+	}
+
+	// Other clients are limited by the global burst
+	if err := l.Allow("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Allow("b"); !errors.As(err, &limitErr) || limitErr.Scope != ScopeGlobal {
+		t.Fatalf("expected global rate limit error, got %v", err)
+	}
+
+	// Tokens are refilled at the rate
+	now = now.Add(500 * time.Millisecond)
+	if err := l.Allow("a"); err != nil {
+		t.Errorf("expected request after refill to be allowed, got %v", err)
+	}
+	if err := l.Allow("a"); err == nil {
+		t.Error("expected second request after refill to be limited")
+	}
+}
+
+func TestLimiterConcurrency(t *testing.T) {
+	l := New(Limits{MaxConcurrent: 2}, Limits{MaxConcurrent: 3})
+
+	releaseA1, err := l.Acquire("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire("a"); err != nil {
+		t.Fatal(err)
+	}
+	var limitErr *Error
+	if _, err := l.Acquire("a"); !errors.As(err, &limitErr) || limitErr.Scope != ScopeClient || limitErr.Reason != ReasonConcurrency {
+		t.Fatalf("expected client concurrency limit error, got %v", err)
+	}
+
+	if _, err := l.Acquire("b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire("c"); !errors.As(err, &limitErr) || limitErr.Scope != ScopeGlobal {
+		t.Fatalf("expected global concurrency limit error, got %v", err)
+	}
+
+	// Releasing twice frees a single slot
+	releaseA1()
+	releaseA1()
+	if _, active := l.Stats(); active != 2 {
+		t.Errorf("active = %d, want 2", active)
+	}
+	if _, err := l.Acquire("c"); err != nil {
+		t.Errorf("expected request after release to be allowed, got %v", err)
+	}
+}
+
+func TestLimiterSweep(t *testing.T) {
+	now := time.Unix(1718000000, 0)
+	l := New(Limits{Rate: 1, Burst: 1}, Limits{})
+	l.now = func() time.Time { return now }
+
+	l.Allow("a")
+	l.Allow("b")
+	release, _ := l.Acquire("c")
+	defer release()
+
+	// Idle clients are dropped once their bucket is full again
+	now = now.Add(2 * sweepInterval)
+	l.Allow("d")
+	if clients, _ := l.Stats(); clients != 2 {
+		t.Errorf("clients = %d, want 2 (c in flight and d)", clients)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	if err := l.Allow("a"); err != nil {
+		t.Error(err)
+	}
+	release, err := l.Acquire("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+}
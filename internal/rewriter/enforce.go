@@ -0,0 +1,44 @@
+package rewriter
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/promql"
+)
+
+// ErrLabelConflict is returned when a query selects a value of the enforced
+// label other than the enforced one
+var ErrLabelConflict = errors.New("query conflicts with enforced label")
+
+// EnforceLabel injects a label="value" matcher into every vector selector of
+// the query. Selectors that already match the label exactly against the
+// same value are left alone; any other matcher on the label is rejected
+// with ErrLabelConflict so queries cannot escape the enforced value.
+func EnforceLabel(query, label, value string) (string, error) {
+	enforced := promql.Matcher{Name: label, Type: promql.MatchEqual, Value: value}
+
+	return promql.RewriteSelectors(query, func(sel *promql.Selector) error {
+		if len(sel.Groups) == 0 {
+			sel.Groups = [][]promql.Matcher{{enforced}}
+			return nil
+		}
+
+		for i, group := range sel.Groups {
+			found := false
+			for _, m := range group {
+				if m.Name != label {
+					continue
+				}
+				if m != enforced {
+					return fmt.Errorf("%w: matcher %s is not allowed", ErrLabelConflict, m)
+				}
+				found = true
+			}
+			if !found {
+				sel.Groups[i] = append(group, enforced)
+			}
+		}
+		return nil
+	})
+}
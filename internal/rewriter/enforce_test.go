@@ -0,0 +1,121 @@
+package rewriter
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestEnforceLabel(t *testing.T) {
+	// Test cases
+	testCases := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "Bare metric",
+			input:    `up`,
+			expected: `up{team="a"}`,
+		},
+		{
+			name:     "Existing matchers",
+			input:    `up{job="prometheus"}`,
+			expected: `up{job="prometheus",team="a"}`,
+		},
+		{
+			name:     "Empty matchers",
+			input:    `up{}`,
+			expected: `up{team="a"}`,
+		},
+		{
+			name:     "Same value",
+			input:    `up{team="a"}`,
+			expected: `up{team="a"}`,
+		},
+		{
+			name:     "Selector without metric name",
+			input:    `{__name__=~"up|down"}`,
+			expected: `{__name__=~"up|down",team="a"}`,
+		},
+		{
+			name:     "Functions and aggregations",
+			input:    `sum by (job) (rate(http_requests_total{code="500"}[5m])) / on(job) group_left sum(rate(http_requests_total[5m])) by (job)`,
+			expected: `sum by (job) (rate(http_requests_total{code="500",team="a"}[5m])) / on(job) group_left sum(rate(http_requests_total{team="a"}[5m])) by (job)`,
+		},
+		{
+			name:     "Binary keywords",
+			input:    `up and on(instance) node_up or vector(1) unless down offset 5m > bool 1`,
+			expected: `up{team="a"} and on(instance) node_up{team="a"} or vector(1) unless down{team="a"} offset 5m > bool 1`,
+		},
+		{
+			name:     "Keywords used as metric names",
+			input:    `sum + offset`,
+			expected: `sum{team="a"} + offset{team="a"}`,
+		},
+		{
+			name:     "Subquery",
+			input:    `max_over_time(rate(x[1m])[1h:5m] @ start())`,
+			expected: `max_over_time(rate(x{team="a"}[1m])[1h:5m] @ start())`,
+		},
+		{
+			name:     "Strings and comments are preserved",
+			input:    "label_replace(up, \"dst\", \"$1\", \"src\", \"(.*)\") # up{",
+			expected: "label_replace(up{team=\"a\"}, \"dst\", \"$1\", \"src\", \"(.*)\") # up{",
+		},
+		{
+			name:     "Matcher groups",
+			input:    `{job="a" or job="b"}`,
+			expected: `{job="a",team="a" or job="b",team="a"}`,
+		},
+		{
+			name:     "Numbers",
+			input:    `up * 1e-3 + Inf - 0x1f`,
+			expected: `up{team="a"} * 1e-3 + Inf - 0x1f`,
+		},
+	}
+
+	// Run tests
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := EnforceLabel(tc.input, "team", "a")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, result)
+			}
+		})
+	}
+}
+
+func TestEnforceLabelRejectsEscapes(t *testing.T) {
+	for _, input := range []string{
+		`up{team="b"}`,
+		`up{team=~".*"}`,
+		`up{team!="a"}`,
+		`up{"team"="b"}`,
+		`up{team="a"} or down{team="a",team=~"b"}`,
+		`{job="x" or team="b"}`,
+	} {
+		t.Run(input, func(t *testing.T) {
+			if _, err := EnforceLabel(input, "team", "a"); !errors.Is(err, ErrLabelConflict) {
+				t.Errorf("Expected label conflict, got %v", err)
+			}
+		})
+	}
+}
+
+func TestEnforceLabelInvalidQuery(t *testing.T) {
+	for _, input := range []string{
+		`up{team="a"`,
+		`up{job="a}`,
+		`up{job}`,
+		`rate(up[5m)`,
+	} {
+		t.Run(input, func(t *testing.T) {
+			if _, err := EnforceLabel(input, "team", "a"); err == nil {
+				t.Errorf("Expected error for %q", input)
+			}
+		})
+	}
+}
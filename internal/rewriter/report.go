@@ -0,0 +1,80 @@
+package rewriter
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+// warningPrefix starts the warnings added to responses
+const warningPrefix = "prom-relabel-proxy: "
+
+// Report describes what rewriting a result did
+type Report struct {
+	// Applied counts the series each rule renamed a label in
+	Applied map[config.Rule]int
+	// Collisions counts the series in which a rule overwrote an existing
+	// label with the same name as its target label
+	Collisions map[config.Rule]int
+	// Skipped counts series whose labels were not an object and were not
+	// rewritten
+	Skipped int
+	// ParseError is set if the result could not be parsed or encoded, in
+	// which case it was not rewritten
+	ParseError error
+}
+
+// newReport creates an empty report
+func newReport() *Report {
+	return &Report{
+		Applied:    make(map[config.Rule]int),
+		Collisions: make(map[config.Rule]int),
+	}
+}
+
+func (r *Report) applied(rule config.Rule) {
+	r.Applied[rule]++
+}
+
+func (r *Report) collision(rule config.Rule) {
+	r.Collisions[rule]++
+}
+
+// Warnings returns the report as warnings for the Prometheus API response
+func (r *Report) Warnings() []string {
+	var warnings []string
+
+	if r.ParseError != nil {
+		warnings = append(warnings, warningPrefix+fmt.Sprintf("response could not be parsed, labels were not rewritten: %v", r.ParseError))
+	}
+
+	for _, rule := range sortedRules(r.Applied) {
+		warnings = append(warnings, warningPrefix+fmt.Sprintf("renamed label %q to %q in %d series", rule.SourceLabel, rule.TargetLabel, r.Applied[rule]))
+	}
+
+	for _, rule := range sortedRules(r.Collisions) {
+		warnings = append(warnings, warningPrefix+fmt.Sprintf("label %q was overwritten by %q in %d series where both existed", rule.TargetLabel, rule.SourceLabel, r.Collisions[rule]))
+	}
+
+	if r.Skipped > 0 {
+		warnings = append(warnings, warningPrefix+fmt.Sprintf("partially rewritten, %d series with invalid labels were left unchanged", r.Skipped))
+	}
+
+	return warnings
+}
+
+// sortedRules returns the rules of a count map in a stable order
+func sortedRules(counts map[config.Rule]int) []config.Rule {
+	rules := make([]config.Rule, 0, len(counts))
+	for rule := range counts {
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].SourceLabel != rules[j].SourceLabel {
+			return rules[i].SourceLabel < rules[j].SourceLabel
+		}
+		return rules[i].TargetLabel < rules[j].TargetLabel
+	})
+	return rules
+}
@@ -1,88 +1,111 @@
 package rewriter
 
 import (
-	"encoding/json"
-	"log"
+	"bytes"
+	"log/slog"
 	"net/url"
-	"regexp"
-	"strings"
 
 	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/promql"
 )
 
 // Rewriter handles the rewriting of labels in Prometheus queries and results
 type Rewriter struct {
 	queryRules  []config.Rule
 	resultRules []config.Rule
+
+	// profiles holds a rewriter for each named mapping profile
+	profiles map[string]*Rewriter
 }
 
 // New creates a new Rewriter with the given configuration
 func New(cfg *config.Config) *Rewriter {
-	return &Rewriter{
-		queryRules:  cfg.GetQueryRules(),
-		resultRules: cfg.GetResultRules(),
-	}
+	r := &Rewriter{}
+	r.UpdateConfig(cfg)
+	return r
 }
 
 // UpdateConfig updates the rewriter with new configuration
 func (r *Rewriter) UpdateConfig(cfg *config.Config) {
 	r.queryRules = cfg.GetQueryRules()
 	r.resultRules = cfg.GetResultRules()
+
+	profiles := make(map[string]*Rewriter)
+	for name, profile := range cfg.GetProfiles() {
+		profiles[name] = &Rewriter{
+			queryRules:  profile.GetQueryRules(),
+			resultRules: profile.GetResultRules(),
+		}
+	}
+	r.profiles = profiles
+}
+
+// Profile returns the rewriter for a named mapping profile. The empty name
+// selects the default mappings.
+func (r *Rewriter) Profile(name string) (*Rewriter, bool) {
+	if name == "" {
+		return r, true
+	}
+	profile, ok := r.profiles[name]
+	return profile, ok
 }
 
 // RewriteQuery rewrites labels in a Prometheus query
 func (r *Rewriter) RewriteQuery(query string) string {
-	if len(r.queryRules) == 0 {
+	return rewriteQuery(query, r.queryRules)
+}
+
+// RewriteResultQuery rewrites labels in a Prometheus query returned by the
+// upstream, such as a formatted query, with the result rules
+func (r *Rewriter) RewriteResultQuery(query string) string {
+	return rewriteQuery(query, r.resultRules)
+}
+
+// rewriteQuery renames the labels of the matchers in a query. Queries that
+// cannot be parsed are returned unchanged, to be rejected by the upstream.
+func rewriteQuery(query string, rules []config.Rule) string {
+	if len(rules) == 0 {
 		return query
 	}
 
-	// Simple label matcher pattern: {label="value"} or {label=~"value"}
-	// This is a simplified approach and might need to be enhanced for complex PromQL
-	labelPattern := regexp.MustCompile(`\{([^{}]*)\}`)
-	
-	return labelPattern.ReplaceAllStringFunc(query, func(match string) string {
-		// Remove the braces
-		inner := match[1 : len(match)-1]
-		
-		// Split by comma for multiple label matchers
-		parts := strings.Split(inner, ",")
-		
-		for i, part := range parts {
-			for _, rule := range r.queryRules {
-				// Look for the source label in this part
-				if strings.HasPrefix(strings.TrimSpace(part), rule.SourceLabel+"=") ||
-				   strings.HasPrefix(strings.TrimSpace(part), rule.SourceLabel+"=~") ||
-				   strings.HasPrefix(strings.TrimSpace(part), rule.SourceLabel+"!=") ||
-				   strings.HasPrefix(strings.TrimSpace(part), rule.SourceLabel+"!~") {
-					// Replace the label name but keep the operator and value
-					operator := "="
-					if strings.Contains(part, "=~") {
-						operator = "=~"
-					} else if strings.Contains(part, "!=") {
-						operator = "!="
-					} else if strings.Contains(part, "!~") {
-						operator = "!~"
+	rewritten, err := promql.RewriteSelectors(query, func(sel *promql.Selector) error {
+		for _, group := range sel.Groups {
+			for i, m := range group {
+				for _, rule := range rules {
+					if m.Name == rule.SourceLabel {
+						group[i].Name = rule.TargetLabel
+						break
 					}
-					
-					valueStart := strings.Index(part, operator) + len(operator)
-					value := part[valueStart:]
-					
-					parts[i] = rule.TargetLabel + operator + value
-					break
 				}
 			}
 		}
-		
-		return "{" + strings.Join(parts, ",") + "}"
+		return nil
 	})
+	if err != nil {
+		return query
+	}
+	return rewritten
 }
 
-// RewriteQueryURL rewrites labels in a Prometheus query URL
-func (r *Rewriter) RewriteQueryURL(queryURL *url.URL) *url.URL {
+// RewriteLabelName rewrites a label name in a query
+func (r *Rewriter) RewriteLabelName(name string) string {
+	for _, rule := range r.queryRules {
+		if name == rule.SourceLabel {
+			return rule.TargetLabel
+		}
+	}
+	return name
+}
+
+// RewriteQueryURL rewrites labels in the PromQL parameters of a Prometheus
+// query URL, by default query and match[]
+func (r *Rewriter) RewriteQueryURL(queryURL *url.URL, params ...string) *url.URL {
 	query := queryURL.Query()
 	
-	// Handle different Prometheus API endpoints
-	for _, param := range []string{"query", "match[]"} {
+	if len(params) == 0 {
+		params = config.DefaultEndpoint.QueryParams
+	}
+	for _, param := range params {
 		if values, exists := query[param]; exists {
 			for i, value := range values {
 				query[param][i] = r.RewriteQuery(value)
@@ -96,53 +119,24 @@ func (r *Rewriter) RewriteQueryURL(queryURL *url.URL) *url.URL {
 
 // RewriteResultJSON rewrites labels in Prometheus JSON result
 func (r *Rewriter) RewriteResultJSON(jsonData []byte) []byte {
-	if len(r.resultRules) == 0 {
-		return jsonData
-	}
-
-	// Parse the JSON
-	var data map[string]interface{}
-	if err := json.Unmarshal(jsonData, &data); err != nil {
-		log.Printf("Error parsing JSON response: %v", err)
-		return jsonData
-	}
-
-	// Process the data structure
-	r.processJSONData(data)
-
-	// Re-encode the JSON
-	result, err := json.Marshal(data)
-	if err != nil {
-		log.Printf("Error encoding JSON response: %v", err)
-		return jsonData
+	result, report := r.RewriteResult(jsonData, false)
+	if report.ParseError != nil {
+		slog.Warn("failed to parse JSON response", slog.Any("error", report.ParseError))
 	}
-
 	return result
 }
 
-// processJSONData recursively processes the JSON data structure
-func (r *Rewriter) processJSONData(data interface{}) {
-	switch v := data.(type) {
-	case map[string]interface{}:
-		// Check if this is a metric object with labels
-		if metric, ok := v["metric"].(map[string]interface{}); ok {
-			// This is a metric object, rewrite the labels
-			for _, rule := range r.resultRules {
-				if val, exists := metric[rule.SourceLabel]; exists {
-					metric[rule.TargetLabel] = val
-					delete(metric, rule.SourceLabel)
-				}
-			}
-		}
-		
-		// Process all fields recursively
-		for _, value := range v {
-			r.processJSONData(value)
-		}
-	case []interface{}:
-		// Process array elements
-		for _, item := range v {
-			r.processJSONData(item)
-		}
+// RewriteResult rewrites labels in Prometheus JSON result and reports what
+// was done. If addWarnings is set, the report is appended to the warnings
+// of the response. The original body is returned if it cannot be parsed.
+func (r *Rewriter) RewriteResult(jsonData []byte, addWarnings bool) ([]byte, *Report) {
+	var buf bytes.Buffer
+	report, err := r.RewriteResultStream(&buf, bytes.NewReader(jsonData), addWarnings)
+	if err != nil {
+		report.ParseError = err
+	}
+	if report.ParseError != nil {
+		return jsonData, report
 	}
+	return buf.Bytes(), report
 }
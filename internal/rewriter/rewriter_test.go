@@ -74,6 +74,31 @@ func TestRewriteQuery(t *testing.T) {
 			input:    `up{foo="bar"}`,
 			expected: `up{foo="bar"}`,
 		},
+		{
+			name:     "Strings containing matchers",
+			input:    `label_replace(up{job="a"}, "dst", "{instance=\"x\"}", "src", "(.*)")`,
+			expected: `label_replace(up{service="a"}, "dst", "{instance=\"x\"}", "src", "(.*)")`,
+		},
+		{
+			name:     "Commas in values",
+			input:    `up{instance=~"a,b",job="c"}`,
+			expected: `up{host=~"a,b",service="c"}`,
+		},
+		{
+			name:     "Subquery",
+			input:    `max_over_time(rate(up{instance="a"}[5m])[1h:1m])`,
+			expected: `max_over_time(rate(up{host="a"}[5m])[1h:1m])`,
+		},
+		{
+			name:     "Matcher groups",
+			input:    `{instance="a" or job="b"}`,
+			expected: `{host="a" or service="b"}`,
+		},
+		{
+			name:     "Unparseable query",
+			input:    `up{instance="a"`,
+			expected: `up{instance="a"`,
+		},
 	}
 
 	// Run tests
@@ -237,3 +262,136 @@ func TestRewriteResultJSON(t *testing.T) {
 		})
 	}
 }
+
+func TestProfile(t *testing.T) {
+	// Create a test configuration with a named profile
+	cfg := &config.Config{
+		TargetPrometheus: "http://localhost:9090",
+		Mappings: []config.Mapping{
+			{
+				Direction: config.DirectionQuery,
+				Rules: []config.Rule{
+					{
+						SourceLabel: "host",
+						TargetLabel: "instance",
+					},
+				},
+			},
+		},
+		Profiles: map[string]config.Profile{
+			"legacy": {
+				Mappings: []config.Mapping{
+					{
+						Direction: config.DirectionQuery,
+						Rules: []config.Rule{
+							{
+								SourceLabel: "node",
+								TargetLabel: "instance",
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// Create a rewriter
+	rw := New(cfg)
+
+	defaultRw, ok := rw.Profile("")
+	if !ok {
+		t.Fatalf("Expected default profile")
+	}
+	if result := defaultRw.RewriteQuery(`up{host="a",node="b"}`); result != `up{instance="a",node="b"}` {
+		t.Errorf("Unexpected default profile result %q", result)
+	}
+
+	legacyRw, ok := rw.Profile("legacy")
+	if !ok {
+		t.Fatalf("Expected legacy profile")
+	}
+	if result := legacyRw.RewriteQuery(`up{host="a",node="b"}`); result != `up{host="a",instance="b"}` {
+		t.Errorf("Unexpected legacy profile result %q", result)
+	}
+
+	if _, ok := rw.Profile("unknown"); ok {
+		t.Errorf("Expected unknown profile to be missing")
+	}
+}
+
+func TestRewriteResultWarnings(t *testing.T) {
+	// Create a test configuration
+	cfg := &config.Config{
+		TargetPrometheus: "http://localhost:9090",
+		Mappings: []config.Mapping{
+			{
+				Direction: config.DirectionResult,
+				Rules: []config.Rule{
+					{
+						SourceLabel: "host",
+						TargetLabel: "instance",
+					},
+				},
+			},
+		},
+	}
+
+	// Create a rewriter
+	rw := New(cfg)
+
+	input := `{"status":"success","data":{"resultType":"vector","result":[` +
+		`{"metric":{"host":"a"},"value":[1,"1"]},` +
+		`{"metric":{"host":"b","instance":"c"},"value":[1,"1"]},` +
+		`{"metric":null,"value":[1,"1"]}` +
+		`]},"warnings":["upstream warning"]}`
+
+	result, report := rw.RewriteResult([]byte(input), true)
+
+	var parsed struct {
+		Warnings []string `json:"warnings"`
+	}
+	if err := json.Unmarshal(result, &parsed); err != nil {
+		t.Fatalf("Failed to parse result: %v", err)
+	}
+
+	expected := []string{
+		"upstream warning",
+		`prom-relabel-proxy: renamed label "host" to "instance" in 2 series`,
+		`prom-relabel-proxy: label "instance" was overwritten by "host" in 1 series where both existed`,
+		"prom-relabel-proxy: partially rewritten, 1 series with invalid labels were left unchanged",
+	}
+	if !reflect.DeepEqual(parsed.Warnings, expected) {
+		t.Errorf("Expected warnings %q, got %q", expected, parsed.Warnings)
+	}
+
+	// Without warnings the report is still returned
+	result, report = rw.RewriteResult([]byte(`not json`), false)
+	if string(result) != "not json" {
+		t.Errorf("Expected unparseable body to be passed through, got %s", result)
+	}
+	if report.ParseError == nil {
+		t.Errorf("Expected parse error in report")
+	}
+}
+
+func TestRewriteLabelName(t *testing.T) {
+	cfg := &config.Config{
+		TargetPrometheus: "http://localhost:9090",
+		Mappings: []config.Mapping{
+			{
+				Direction: config.DirectionQuery,
+				Rules: []config.Rule{
+					{SourceLabel: "instance", TargetLabel: "host"},
+				},
+			},
+		},
+	}
+	rw := New(cfg)
+
+	if got := rw.RewriteLabelName("instance"); got != "host" {
+		t.Errorf("RewriteLabelName(instance) = %q, want host", got)
+	}
+	if got := rw.RewriteLabelName("job"); got != "job" {
+		t.Errorf("RewriteLabelName(job) = %q, want job", got)
+	}
+}
@@ -0,0 +1,814 @@
+package rewriter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/promapi"
+)
+
+const (
+	// maxDepth limits the nesting of JSON documents that are rewritten
+	maxDepth = 100
+
+	// bufferSize is the size of the input and output buffers
+	bufferSize = 64 * 1024
+)
+
+// syntaxError is returned for invalid JSON input
+type syntaxError struct {
+	msg    string
+	offset int64
+}
+
+func (e *syntaxError) Error() string {
+	return fmt.Sprintf("invalid JSON at offset %d: %s", e.offset, e.msg)
+}
+
+// RewriteResultStream copies a Prometheus JSON result from src to dst,
+// rewriting the labels of metric objects. Everything else, including sample
+// values, is copied through as is, so memory use does not depend on the
+// size of the result. If addWarnings is set, the report is appended to the
+// warnings of the response.
+//
+// If the input is not valid JSON, the rest of it is copied unchanged from
+// the point the error was found and the error is set in the report. The
+// returned error is only set if reading src or writing dst failed.
+func (r *Rewriter) RewriteResultStream(dst io.Writer, src io.Reader, addWarnings bool) (*Report, error) {
+	return r.RewriteResponseStream(dst, src, config.ResponseRewriterResult, addWarnings)
+}
+
+// RewriteResponseStream is like RewriteResultStream, but rewrites the
+// response as described by the response rewriter, one of the
+// config.ResponseRewriter constants
+func (r *Rewriter) RewriteResponseStream(dst io.Writer, src io.Reader, response string, addWarnings bool) (*Report, error) {
+	report := newReport()
+	if len(r.resultRules) == 0 || response == config.ResponseRewriterNone {
+		_, err := io.Copy(dst, src)
+		return report, err
+	}
+
+	out := bufio.NewWriterSize(dst, bufferSize)
+	s := &streamRewriter{
+		rules:       r.resultRules,
+		src:         src,
+		buf:         make([]byte, bufferSize),
+		out:         out,
+		report:      report,
+		addWarnings: addWarnings,
+		response:    response,
+	}
+
+	err := s.document()
+	var synErr *syntaxError
+	if errors.As(err, &synErr) {
+		report.ParseError = err
+		// Emit what was buffered and pass the remaining input through
+		if s.capture != nil {
+			out.Write(s.capture.Bytes())
+		}
+		err = s.copyRest()
+	}
+	if err != nil {
+		return report, err
+	}
+	return report, out.Flush()
+}
+
+// streamRewriter is a JSON tokenizer that copies its input to its output,
+// rewriting metric objects on the way
+type streamRewriter struct {
+	rules       []config.Rule
+	out         *bufio.Writer
+	report      *Report
+	addWarnings bool
+	response    string
+
+	// src is read into buf, of which buf[pos:end] has not been consumed
+	src      io.Reader
+	buf      []byte
+	pos, end int
+	readErr  error
+
+	// capture buffers the output while a metric object is read
+	capture *bytes.Buffer
+	offset  int64
+
+	// collect receives a copy of the output while an object key is read
+	collect *bytes.Buffer
+
+	// warningsDone is set once the report was added to the response
+	warningsDone bool
+
+	// err is set if writing the output failed
+	err error
+}
+
+// document rewrites a complete JSON document
+func (s *streamRewriter) document() error {
+	if err := s.space(); err != nil {
+		return err
+	}
+	c, err := s.peek()
+	if err != nil {
+		return err
+	}
+	if c != '{' {
+		// Not a Prometheus API response
+		return s.errorf("expected object, got %q", c)
+	}
+	if err := s.object(0, true); err != nil {
+		return err
+	}
+	// Copy trailing whitespace
+	return s.copyRest()
+}
+
+// copyRest copies the remaining input to the output
+func (s *streamRewriter) copyRest() error {
+	s.write(s.buf[s.pos:s.end])
+	s.pos = s.end
+	if s.err != nil {
+		return s.err
+	}
+	if s.readErr != nil {
+		if s.readErr == io.EOF {
+			return nil
+		}
+		return s.readErr
+	}
+	_, err := io.Copy(s.out, s.src)
+	return err
+}
+
+// fill reads more input if all buffered input was consumed. The end of the
+// input is a syntax error.
+func (s *streamRewriter) fill() error {
+	for s.pos == s.end {
+		if s.readErr == io.EOF {
+			return s.errorf("unexpected end of input")
+		}
+		if s.readErr != nil {
+			return s.readErr
+		}
+		s.pos = 0
+		s.end, s.readErr = s.src.Read(s.buf)
+	}
+	return nil
+}
+
+// value copies a JSON value
+func (s *streamRewriter) value(depth int) error {
+	if depth > maxDepth {
+		return s.errorf("nesting too deep")
+	}
+
+	c, err := s.peek()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c == '{':
+		return s.object(depth, false)
+	case c == '[':
+		return s.array(depth, false, false)
+	case c == '"':
+		_, err := s.str(false)
+		return err
+	case c == '-' || (c >= '0' && c <= '9') || c == 't' || c == 'f' || c == 'n':
+		return s.literal()
+	}
+	return s.errorf("unexpected character %q", c)
+}
+
+// labelSetKey reports whether the values of an object key are label sets
+func (s *streamRewriter) labelSetKey(key string) bool {
+	switch key {
+	case "metric":
+		return true
+	case "labels", "seriesLabels":
+		return s.response == config.ResponseRewriterLabels
+	}
+	return false
+}
+
+// object copies a JSON object. Label sets, such as the values of "metric"
+// keys, are rewritten. If top is set, the report is added to the response
+// warnings.
+func (s *streamRewriter) object(depth int, top bool) error {
+	if err := s.expect('{'); err != nil {
+		return err
+	}
+
+	first := true
+	for {
+		if err := s.space(); err != nil {
+			return err
+		}
+		c, err := s.peek()
+		if err != nil {
+			return err
+		}
+		if c == '}' {
+			if top {
+				if err := s.appendWarningsKey(first); err != nil {
+					return err
+				}
+			}
+			return s.expect('}')
+		}
+		if !first {
+			if err := s.expect(','); err != nil {
+				return err
+			}
+			if err := s.space(); err != nil {
+				return err
+			}
+		}
+		first = false
+
+		key, err := s.str(true)
+		if err != nil {
+			return err
+		}
+		if err := s.space(); err != nil {
+			return err
+		}
+		if err := s.expect(':'); err != nil {
+			return err
+		}
+		if err := s.space(); err != nil {
+			return err
+		}
+
+		c, err = s.peek()
+		if err != nil {
+			return err
+		}
+		switch {
+		case s.labelSetKey(key) && c == '{':
+			err = s.metric(depth + 1)
+		case key == "metric" && c != '"':
+			// A label named "metric" is a string, anything else is a
+			// series with invalid labels
+			s.report.Skipped++
+			err = s.value(depth + 1)
+		case top && key == "warnings" && c == '[':
+			err = s.array(depth+1, true, false)
+		case top && key == "data" && c == '[' && s.response == config.ResponseRewriterSeries:
+			err = s.array(depth+1, false, true)
+		case top && key == "data" && c == '[' && s.response == config.ResponseRewriterLabelNames:
+			err = s.labelNames(depth + 1)
+		case top && key == "data" && c == '"' && s.response == config.ResponseRewriterQuery:
+			err = s.query()
+		default:
+			err = s.value(depth + 1)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// array copies a JSON array. If warnings is set, the report is appended to
+// its elements. If labelSets is set, its objects are rewritten as metric
+// objects. Arrays are scanned without tokenizing them, as they mostly hold
+// samples, until an object is found in them.
+func (s *streamRewriter) array(depth int, warnings, labelSets bool) error {
+	if err := s.expect('['); err != nil {
+		return err
+	}
+
+	// nesting counts the arrays nested in this one that are open
+	nesting := 0
+	empty := true
+	inString, escaped := false, false
+
+	for {
+		if err := s.fill(); err != nil {
+			return err
+		}
+
+		i := s.pos
+	scan:
+		for ; i < s.end; i++ {
+			c := s.buf[i]
+			if inString {
+				switch {
+				case escaped:
+					escaped = false
+				case c == '\\':
+					escaped = true
+				case c == '"':
+					inString = false
+				}
+				continue
+			}
+
+			switch c {
+			case ' ', '\t', '\r', '\n':
+				continue
+			case '"':
+				inString = true
+			case '[':
+				nesting++
+				if depth+nesting > maxDepth {
+					return s.errorf("nesting too deep")
+				}
+			case ']':
+				if nesting == 0 {
+					break scan
+				}
+				nesting--
+			case '{':
+				empty = false
+				break scan
+			}
+			empty = false
+		}
+
+		s.write(s.buf[s.pos:i])
+		s.offset += int64(i - s.pos)
+		s.pos = i
+		if s.err != nil {
+			return s.err
+		}
+		if i == s.end {
+			continue
+		}
+
+		if s.buf[i] == '{' {
+			var err error
+			if labelSets && nesting == 0 {
+				err = s.metric(depth + 1)
+			} else {
+				err = s.object(depth+nesting+1, false)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if warnings {
+			if err := s.appendWarnings(empty); err != nil {
+				return err
+			}
+		}
+		return s.expect(']')
+	}
+}
+
+// metric reads a metric object and writes it with its labels rewritten
+func (s *streamRewriter) metric(depth int) error {
+	var buf bytes.Buffer
+	outer := s.capture
+	s.capture = &buf
+	err := s.object(depth, false)
+	s.capture = outer
+	if err != nil {
+		// Emit the partial object before the rest of the input
+		s.write(buf.Bytes())
+		return err
+	}
+
+	rewritten, err := rewriteMetric(buf.Bytes(), s.rules, s.report)
+	if err != nil {
+		// Labels are not strings, leave them unchanged
+		s.report.Skipped++
+		rewritten = buf.Bytes()
+	}
+	s.write(rewritten)
+	return s.err
+}
+
+// labelNames reads an array of label names and writes it with the names
+// rewritten
+func (s *streamRewriter) labelNames(depth int) error {
+	var buf bytes.Buffer
+	outer := s.capture
+	s.capture = &buf
+	err := s.array(depth, false, false)
+	s.capture = outer
+	if err != nil {
+		s.write(buf.Bytes())
+		return err
+	}
+
+	rewritten, err := rewriteLabelNames(buf.Bytes(), s.rules, s.report)
+	if err != nil {
+		// Not a list of names, leave it unchanged
+		rewritten = buf.Bytes()
+	}
+	s.write(rewritten)
+	return s.err
+}
+
+// query reads a string holding a PromQL expression and writes it with the
+// labels of its matchers rewritten
+func (s *streamRewriter) query() error {
+	var buf bytes.Buffer
+	outer := s.capture
+	s.capture = &buf
+	_, err := s.str(false)
+	s.capture = outer
+	if err != nil {
+		s.write(buf.Bytes())
+		return err
+	}
+
+	var query string
+	if err := json.Unmarshal(buf.Bytes(), &query); err != nil {
+		return s.errorf("invalid string: %v", err)
+	}
+	rewritten := buf.Bytes()
+	if q := rewriteQuery(query, s.rules); q != query {
+		if rewritten, err = promapi.Marshal(q); err != nil {
+			return err
+		}
+	}
+	s.write(rewritten)
+	return s.err
+}
+
+// appendWarningsKey adds the report as warnings key to the top-level object
+func (s *streamRewriter) appendWarningsKey(empty bool) error {
+	warnings := s.warnings()
+	if len(warnings) == 0 {
+		return nil
+	}
+	if !empty {
+		s.write([]byte{','})
+	}
+	s.write([]byte(`"warnings":`))
+	encoded, err := promapi.Marshal(warnings)
+	if err != nil {
+		return err
+	}
+	s.write(encoded)
+	return s.err
+}
+
+// appendWarnings adds the report to an existing warnings array
+func (s *streamRewriter) appendWarnings(empty bool) error {
+	for _, warning := range s.warnings() {
+		if !empty {
+			s.write([]byte{','})
+		}
+		empty = false
+		encoded, err := promapi.Marshal(warning)
+		if err != nil {
+			return err
+		}
+		s.write(encoded)
+	}
+	return s.err
+}
+
+// warnings returns the warnings to add to the response, only once
+func (s *streamRewriter) warnings() []string {
+	if !s.addWarnings || s.warningsDone {
+		return nil
+	}
+	s.warningsDone = true
+	return s.report.Warnings()
+}
+
+// Stop tables for span, marking the bytes that end a span
+var (
+	stringStop  [256]bool
+	literalStop [256]bool
+	spaceStop   [256]bool
+)
+
+func init() {
+	for c := 0; c < 0x20; c++ {
+		stringStop[c] = true
+	}
+	stringStop['"'] = true
+	stringStop['\\'] = true
+
+	for _, c := range []byte(",}] \t\r\n{[\":") {
+		literalStop[c] = true
+	}
+
+	for c := range spaceStop {
+		spaceStop[c] = true
+	}
+	for _, c := range []byte(" \t\r\n") {
+		spaceStop[c] = false
+	}
+}
+
+// span copies input up to the first byte marked in stop and returns that
+// byte without consuming it. Bytes are copied from the read buffer in bulk.
+func (s *streamRewriter) span(stop *[256]bool) (byte, error) {
+	for {
+		if err := s.fill(); err != nil {
+			return 0, err
+		}
+
+		i := s.pos
+		for i < s.end && !stop[s.buf[i]] {
+			i++
+		}
+		s.write(s.buf[s.pos:i])
+		s.offset += int64(i - s.pos)
+		s.pos = i
+		if s.err != nil {
+			return 0, s.err
+		}
+
+		if i < s.end {
+			return s.buf[i], nil
+		}
+	}
+}
+
+// str copies a JSON string and returns its decoded value if decode is set
+func (s *streamRewriter) str(decode bool) (string, error) {
+	if decode {
+		var raw bytes.Buffer
+		s.collect = &raw
+		defer func() { s.collect = nil }()
+	}
+	if err := s.expect('"'); err != nil {
+		return "", err
+	}
+
+	for {
+		c, err := s.span(&stringStop)
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case c == '"':
+			if _, err := s.next(); err != nil {
+				return "", err
+			}
+			if !decode {
+				return "", nil
+			}
+			var value string
+			if err := json.Unmarshal(s.collect.Bytes(), &value); err != nil {
+				return "", s.errorf("invalid string: %v", err)
+			}
+			return value, nil
+		case c == '\\':
+			// Copy the escape and the escaped character
+			if _, err := s.next(); err != nil {
+				return "", err
+			}
+			if _, err := s.next(); err != nil {
+				return "", err
+			}
+		default:
+			return "", s.errorf("control character in string")
+		}
+	}
+}
+
+// literal copies a number, true, false or null
+func (s *streamRewriter) literal() error {
+	c, err := s.span(&literalStop)
+	if err != nil {
+		return err
+	}
+	switch c {
+	case '{', '[', '"', ':':
+		return s.errorf("unexpected character %q", c)
+	}
+	return nil
+}
+
+// space copies whitespace
+func (s *streamRewriter) space() error {
+	_, err := s.span(&spaceStop)
+	return err
+}
+
+// expect copies the next byte, which must be c
+func (s *streamRewriter) expect(c byte) error {
+	got, err := s.peek()
+	if err != nil {
+		return err
+	}
+	if got != c {
+		return s.errorf("expected %q, got %q", c, got)
+	}
+	_, err = s.next()
+	return err
+}
+
+// peek returns the next input byte without consuming it. The end of the
+// input is a syntax error.
+func (s *streamRewriter) peek() (byte, error) {
+	if s.pos == s.end {
+		if err := s.fill(); err != nil {
+			return 0, err
+		}
+	}
+	return s.buf[s.pos], nil
+}
+
+// next consumes the next input byte and copies it to the output
+func (s *streamRewriter) next() (byte, error) {
+	c, err := s.peek()
+	if err != nil {
+		return 0, err
+	}
+	s.pos++
+	s.offset++
+	if s.collect != nil {
+		s.collect.WriteByte(c)
+	}
+	if s.capture != nil {
+		s.capture.WriteByte(c)
+	} else if err := s.out.WriteByte(c); err != nil {
+		s.err = err
+		return 0, err
+	}
+	return c, nil
+}
+
+// write writes to the capture buffer or the output
+func (s *streamRewriter) write(p []byte) {
+	if s.collect != nil {
+		s.collect.Write(p)
+	}
+	if s.capture != nil {
+		s.capture.Write(p)
+		return
+	}
+	if _, err := s.out.Write(p); err != nil {
+		s.err = err
+	}
+}
+
+// errorf returns a syntax error at the current offset
+func (s *streamRewriter) errorf(format string, args ...interface{}) error {
+	return &syntaxError{msg: fmt.Sprintf(format, args...), offset: s.offset}
+}
+
+// label is a label of a metric object. Besides the decoded name, the
+// original bytes are kept so that labels that are not renamed are written
+// back as they were read.
+type label struct {
+	name string
+	// rawName is the original name, or nil if the label was renamed
+	rawName []byte
+	// space is the whitespace before the name, sep the bytes between name
+	// and value, and after the whitespace between value and the next comma
+	space, sep, after []byte
+	value             json.RawMessage
+}
+
+// rewriteMetric applies the rules to the labels of a metric object. Labels
+// keep their position and bytes except for renamed names; the object is
+// returned unchanged if no rule applies.
+func rewriteMetric(raw []byte, rules []config.Rule, report *Report) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+
+	var labels []label
+	offset := int(dec.InputOffset())
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		name, _ := tok.(string)
+		nameEnd := int(dec.InputOffset())
+
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		if len(value) == 0 || value[0] != '"' {
+			return nil, fmt.Errorf("value of label %q is not a string", name)
+		}
+		valueEnd := int(dec.InputOffset())
+
+		// The name is preceded by whitespace and a comma, if it is not the
+		// first label
+		before := raw[offset:nameEnd]
+		nameStart := offset + bytes.IndexByte(before, '"')
+		space := raw[offset:nameStart]
+		if i := bytes.IndexByte(space, ','); i >= 0 {
+			labels[len(labels)-1].after = space[:i]
+			space = space[i+1:]
+		}
+
+		labels = append(labels, label{
+			name:    name,
+			rawName: raw[nameStart:nameEnd],
+			space:   space,
+			sep:     raw[nameEnd : valueEnd-len(value)],
+			value:   value,
+		})
+		offset = valueEnd
+	}
+	// Whitespace before the closing brace
+	trailing := raw[offset : len(raw)-1]
+
+	changed := false
+	for _, rule := range rules {
+		src := labelIndex(labels, rule.SourceLabel)
+		if src < 0 || rule.SourceLabel == rule.TargetLabel {
+			continue
+		}
+		if dst := labelIndex(labels, rule.TargetLabel); dst >= 0 {
+			report.collision(rule)
+			labels = append(labels[:dst], labels[dst+1:]...)
+			if dst < src {
+				src--
+			}
+		}
+		labels[src].name = rule.TargetLabel
+		labels[src].rawName = nil
+		report.applied(rule)
+		changed = true
+	}
+	if !changed {
+		return raw, nil
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(raw)+16))
+	buf.WriteByte('{')
+	for i, l := range labels {
+		if i > 0 {
+			buf.Write(labels[i-1].after)
+			buf.WriteByte(',')
+		}
+		buf.Write(l.space)
+		if l.rawName != nil {
+			buf.Write(l.rawName)
+		} else {
+			name, err := promapi.Marshal(l.name)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(name)
+		}
+		buf.Write(l.sep)
+		buf.Write(l.value)
+	}
+	buf.Write(trailing)
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// rewriteLabelNames applies the rules to a JSON array of label names. A
+// renamed name that is already in the list is dropped. The array is
+// returned unchanged if no rule applies.
+func rewriteLabelNames(raw []byte, rules []config.Rule, report *Report) ([]byte, error) {
+	var names []string
+	if err := json.Unmarshal(raw, &names); err != nil {
+		return nil, err
+	}
+
+	changed := false
+	for _, rule := range rules {
+		src, dst := -1, -1
+		for i, name := range names {
+			switch name {
+			case rule.SourceLabel:
+				src = i
+			case rule.TargetLabel:
+				dst = i
+			}
+		}
+		if src < 0 || rule.SourceLabel == rule.TargetLabel {
+			continue
+		}
+		if dst >= 0 {
+			report.collision(rule)
+			names = append(names[:src], names[src+1:]...)
+		} else {
+			names[src] = rule.TargetLabel
+		}
+		report.applied(rule)
+		changed = true
+	}
+	if !changed {
+		return raw, nil
+	}
+	return promapi.Marshal(names)
+}
+
+// labelIndex returns the index of the named label, or -1
+func labelIndex(labels []label, name string) int {
+	for i, l := range labels {
+		if l.name == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,181 @@
+package rewriter
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+func TestRewriteResultStream(t *testing.T) {
+	// Create a test configuration
+	cfg := &config.Config{
+		TargetPrometheus: "http://localhost:9090",
+		Mappings: []config.Mapping{
+			{
+				Direction: config.DirectionResult,
+				Rules: []config.Rule{
+					{
+						SourceLabel: "host",
+						TargetLabel: "instance",
+					},
+				},
+			},
+		},
+	}
+
+	// Create a rewriter
+	rw := New(cfg)
+
+	testCases := []struct {
+		name        string
+		input       string
+		addWarnings bool
+		expected    string
+		parseError  bool
+	}{
+		{
+			name:     "matrix samples are copied verbatim",
+			input:    `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up","host":"a"},"values":[[1700000000.123,"1"],[1700000015.1, "1e-7"]]}]}}` + "\n",
+			expected: `{"status":"success","data":{"resultType":"matrix","result":[{"metric":{"__name__":"up","instance":"a"},"values":[[1700000000.123,"1"],[1700000015.1, "1e-7"]]}]}}` + "\n",
+		},
+		{
+			name:     "label values are not escaped",
+			input:    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"host":"a<b>&c","path":"é"},"value":[1,"1"]}]}}`,
+			expected: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"instance":"a<b>&c","path":"é"},"value":[1,"1"]}]}}`,
+		},
+		{
+			name:     "formatting of other labels is preserved",
+			input:    "{\"status\":\"success\",\"data\":{\"resultType\":\"vector\",\"result\":[{\"metric\": { \"p\\u00e4th\" : \"\\u003c/\" ,\n \"host\":\"a\" },\"value\":[1.50e3,\"0.10\"]}]}}",
+			expected: "{\"status\":\"success\",\"data\":{\"resultType\":\"vector\",\"result\":[{\"metric\": { \"p\\u00e4th\" : \"\\u003c/\" ,\n \"instance\":\"a\" },\"value\":[1.50e3,\"0.10\"]}]}}",
+		},
+		{
+			name:     "strings that look like keys are ignored",
+			input:    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"metric":"{\"host\":1}"},"value":[1,"[{\"metric\":{\"host\":\"a\"}}]"]}]}}`,
+			expected: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"metric":"{\"host\":1}"},"value":[1,"[{\"metric\":{\"host\":\"a\"}}]"]}]}}`,
+		},
+		{
+			name:     "metric objects nested in metric objects",
+			input:    `{"status":"success","data":{"result":[{"metric":{"metric":{"a":"b"},"instance":"x"}}]}}`,
+			expected: `{"status":"success","data":{"result":[{"metric":{"metric":{"a":"b"},"instance":"x"}}]}}`,
+		},
+		{
+			name:     "nested metric objects are rewritten",
+			input:    `{"status":"success","data":{"result":[{"metric":{"metric":{"host":"b"},"host":"x"}},{"metric":{"host":"c"}}]}}`,
+			expected: `{"status":"success","data":{"result":[{"metric":{"metric":{"instance":"b"},"host":"x"}},{"metric":{"instance":"c"}}]}}`,
+		},
+		{
+			name:        "warnings are added",
+			input:       `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"host":"a"},"value":[1,"1"]}]}}`,
+			addWarnings: true,
+			expected:    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"instance":"a"},"value":[1,"1"]}]},"warnings":["prom-relabel-proxy: renamed label \"host\" to \"instance\" in 1 series"]}`,
+		},
+		{
+			name:        "warnings are appended",
+			input:       `{"status":"success","data":{"resultType":"vector","result":[]},"warnings":["slow"]}`,
+			addWarnings: true,
+			expected:    `{"status":"success","data":{"resultType":"vector","result":[]},"warnings":["slow"]}`,
+		},
+		{
+			name:       "invalid JSON is passed through",
+			input:      `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"host":"a"},"value":[1,"1"]}`,
+			expected:   `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"instance":"a"},"value":[1,"1"]}`,
+			parseError: true,
+		},
+		{
+			name:       "non-object is passed through",
+			input:      `<html>error</html>`,
+			expected:   `<html>error</html>`,
+			parseError: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			report, err := rw.RewriteResultStream(&out, strings.NewReader(tc.input), tc.addWarnings)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result := out.String(); result != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, result)
+			}
+			if (report.ParseError != nil) != tc.parseError {
+				t.Errorf("Unexpected parse error %v", report.ParseError)
+			}
+		})
+	}
+}
+
+func TestRewriteResponseStream(t *testing.T) {
+	cfg := &config.Config{
+		TargetPrometheus: "http://localhost:9090",
+		Mappings: []config.Mapping{
+			{
+				Direction: config.DirectionResult,
+				Rules: []config.Rule{
+					{SourceLabel: "host", TargetLabel: "instance"},
+					{SourceLabel: "service", TargetLabel: "job"},
+				},
+			},
+		},
+	}
+	rw := New(cfg)
+
+	testCases := []struct {
+		name     string
+		response string
+		input    string
+		expected string
+	}{
+		{
+			name:     "series",
+			response: config.ResponseRewriterSeries,
+			input:    `{"status":"success","data":[{"__name__":"up","host":"a"},{"__name__":"up","host":"b"}]}`,
+			expected: `{"status":"success","data":[{"__name__":"up","instance":"a"},{"__name__":"up","instance":"b"}]}`,
+		},
+		{
+			name:     "label names",
+			response: config.ResponseRewriterLabelNames,
+			input:    `{"status":"success","data":["__name__","host","job","service"]}`,
+			expected: `{"status":"success","data":["__name__","instance","job"]}`,
+		},
+		{
+			name:     "labels",
+			response: config.ResponseRewriterLabels,
+			input:    `{"status":"success","data":{"alerts":[{"labels":{"alertname":"Down","host":"a"},"annotations":{"host":"a"}}]}}`,
+			expected: `{"status":"success","data":{"alerts":[{"labels":{"alertname":"Down","instance":"a"},"annotations":{"host":"a"}}]}}`,
+		},
+		{
+			name:     "query",
+			response: config.ResponseRewriterQuery,
+			input:    `{"status":"success","data":"sum(up{host=\"a\"})"}`,
+			expected: `{"status":"success","data":"sum(up{instance=\"a\"})"}`,
+		},
+		{
+			name:     "none",
+			response: config.ResponseRewriterNone,
+			input:    `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"host":"a"},"value":[1,"1"]}]}}`,
+			expected: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"host":"a"},"value":[1,"1"]}]}}`,
+		},
+		{
+			name:     "result does not rewrite series",
+			response: config.ResponseRewriterResult,
+			input:    `{"status":"success","data":[{"__name__":"up","host":"a"}]}`,
+			expected: `{"status":"success","data":[{"__name__":"up","host":"a"}]}`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if _, err := rw.RewriteResponseStream(&out, strings.NewReader(tc.input), tc.response, false); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if result := out.String(); result != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, result)
+			}
+		})
+	}
+}
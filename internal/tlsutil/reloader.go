@@ -0,0 +1,66 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/fileutil"
+)
+
+// KeyPair is a certificate and private key loaded from files and reloaded
+// when they change
+type KeyPair struct {
+	r *fileutil.Reloader[*tls.Certificate]
+}
+
+// NewKeyPair loads a certificate and key from PEM files
+func NewKeyPair(certFile, keyFile string) (*KeyPair, error) {
+	r, err := fileutil.NewReloader(func() (*tls.Certificate, error) {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load key pair: %w", err)
+		}
+		return &cert, nil
+	}, certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{r: r}, nil
+}
+
+// Certificate returns the current certificate
+func (k *KeyPair) Certificate() *tls.Certificate {
+	return k.r.Get()
+}
+
+// CertPool is a pool of CA certificates loaded from a PEM bundle and
+// reloaded when it changes
+type CertPool struct {
+	r *fileutil.Reloader[*x509.CertPool]
+}
+
+// NewCertPool loads a CA bundle from a PEM file
+func NewCertPool(caFile string) (*CertPool, error) {
+	r, err := fileutil.NewReloader(func() (*x509.CertPool, error) {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", caFile)
+		}
+		return pool, nil
+	}, caFile)
+	if err != nil {
+		return nil, err
+	}
+	return &CertPool{r: r}, nil
+}
+
+// Pool returns the current certificate pool
+func (c *CertPool) Pool() *x509.CertPool {
+	return c.r.Get()
+}
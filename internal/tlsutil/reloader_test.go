@@ -0,0 +1,163 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a new self-signed CA certificate with the common name
+// and its key as PEM files
+func writeCert(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	if keyFile != "" {
+		writeFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	}
+}
+
+// writeFile writes a file with a new modification time, so it is reloaded
+// even if the size did not change
+func writeFile(t *testing.T, name string, data []byte) {
+	t.Helper()
+
+	var modTime time.Time
+	if info, err := os.Stat(name); err == nil {
+		modTime = info.ModTime().Add(time.Second)
+	} else {
+		modTime = time.Now()
+	}
+	if err := os.WriteFile(name, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(name, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// waitForCheck waits until the files are checked for changes again
+func waitForCheck() {
+	time.Sleep(1100 * time.Millisecond)
+}
+
+func TestKeyPairReload(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		rotate func(t *testing.T, certFile, keyFile string)
+		wantCN string
+	}{
+		{
+			name:   "unchanged",
+			rotate: func(*testing.T, string, string) {},
+			wantCN: "first",
+		},
+		{
+			name: "rotated",
+			rotate: func(t *testing.T, certFile, keyFile string) {
+				writeCert(t, certFile, keyFile, "second")
+			},
+			wantCN: "second",
+		},
+		{
+			name: "invalid key pair",
+			rotate: func(t *testing.T, certFile, keyFile string) {
+				writeFile(t, keyFile, []byte("not a key"))
+			},
+			wantCN: "first",
+		},
+		{
+			name: "removed",
+			rotate: func(t *testing.T, certFile, keyFile string) {
+				if err := os.Remove(certFile); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantCN: "first",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+			writeCert(t, certFile, keyFile, "first")
+
+			keyPair, err := NewKeyPair(certFile, keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := keyPair.Certificate().Leaf.Subject.CommonName; got != "first" {
+				t.Fatalf("initial common name = %q, want first", got)
+			}
+
+			tt.rotate(t, certFile, keyFile)
+			waitForCheck()
+			if got := keyPair.Certificate().Leaf.Subject.CommonName; got != tt.wantCN {
+				t.Errorf("common name = %q, want %q", got, tt.wantCN)
+			}
+		})
+	}
+}
+
+func TestCertPoolReload(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.crt")
+	writeCert(t, caFile, "", "first CA")
+
+	pool, err := NewCertPool(caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := pool.Pool()
+
+	// The same pool is returned until the bundle changes
+	if pool.Pool() != first {
+		t.Error("pool changed without a new bundle")
+	}
+
+	writeCert(t, caFile, "", "second CA")
+	waitForCheck()
+	if pool.Pool() == first {
+		t.Error("pool was not reloaded after the bundle was rotated")
+	}
+
+	if _, err := NewCertPool(filepath.Join(dir, "missing.crt")); err == nil {
+		t.Error("expected an error for a missing CA file")
+	}
+}
@@ -0,0 +1,63 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+// NewServerConfig creates a TLS configuration for the listener. The
+// certificate, key and client CA bundle are reloaded when the files change.
+func NewServerConfig(cfg config.ServerTLS) (*tls.Config, error) {
+	keyPair, err := NewKeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	base := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ClientAuth: clientAuthType(cfg),
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return keyPair.Certificate(), nil
+		},
+	}
+
+	if cfg.ClientCAFile == "" {
+		return base, nil
+	}
+
+	caPool, err := NewCertPool(cfg.ClientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Build the config per handshake so a reloaded CA bundle takes effect
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := base.Clone()
+		c.GetConfigForClient = nil
+		c.ClientCAs = caPool.Pool()
+		return c, nil
+	}
+	return base, nil
+}
+
+// clientAuthType maps the configured client auth policy to crypto/tls. If
+// a client CA is configured without a policy, certificates are required.
+func clientAuthType(cfg config.ServerTLS) tls.ClientAuthType {
+	switch cfg.ClientAuth {
+	case config.ClientAuthRequest:
+		return tls.RequestClientCert
+	case config.ClientAuthRequire:
+		return tls.RequireAnyClientCert
+	case config.ClientAuthVerifyIfGiven:
+		return tls.VerifyClientCertIfGiven
+	case config.ClientAuthRequireAndVerify:
+		return tls.RequireAndVerifyClientCert
+	case config.ClientAuthNone:
+		return tls.NoClientCert
+	}
+	if cfg.ClientCAFile != "" {
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.NoClientCert
+}
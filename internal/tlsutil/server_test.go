@@ -0,0 +1,88 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"path/filepath"
+	"testing"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+func TestClientAuthType(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.ServerTLS
+		want tls.ClientAuthType
+	}{
+		{name: "default", cfg: config.ServerTLS{}, want: tls.NoClientCert},
+		{name: "default with client CA", cfg: config.ServerTLS{ClientCAFile: "ca.crt"}, want: tls.RequireAndVerifyClientCert},
+		{name: "none with client CA", cfg: config.ServerTLS{ClientCAFile: "ca.crt", ClientAuth: config.ClientAuthNone}, want: tls.NoClientCert},
+		{name: "request", cfg: config.ServerTLS{ClientAuth: config.ClientAuthRequest}, want: tls.RequestClientCert},
+		{name: "require", cfg: config.ServerTLS{ClientAuth: config.ClientAuthRequire}, want: tls.RequireAnyClientCert},
+		{name: "verify if given", cfg: config.ServerTLS{ClientAuth: config.ClientAuthVerifyIfGiven}, want: tls.VerifyClientCertIfGiven},
+		{name: "require and verify", cfg: config.ServerTLS{ClientAuth: config.ClientAuthRequireAndVerify}, want: tls.RequireAndVerifyClientCert},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := clientAuthType(tt.cfg); got != tt.want {
+				t.Errorf("clientAuthType() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewServerConfig(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	cfg := config.ServerTLS{
+		CertFile:     filepath.Join(dir, "tls.crt"),
+		KeyFile:      filepath.Join(dir, "tls.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	writeCert(t, cfg.CertFile, cfg.KeyFile, "server")
+	writeCert(t, cfg.ClientCAFile, "", "first CA")
+
+	tlsConfig, err := NewServerConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("ClientAuth = %v, want %v", tlsConfig.ClientAuth, tls.RequireAndVerifyClientCert)
+	}
+
+	handshake := func() (*tls.Certificate, *tls.Config) {
+		t.Helper()
+		cert, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientConfig, err := tlsConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert, clientConfig
+	}
+
+	cert, clientConfig := handshake()
+	if got := cert.Leaf.Subject.CommonName; got != "server" {
+		t.Errorf("server certificate = %q, want server", got)
+	}
+	firstPool := clientConfig.ClientCAs
+	if firstPool == nil {
+		t.Fatal("client CAs not set")
+	}
+
+	// New handshakes use the rotated certificate and client CA bundle
+	writeCert(t, cfg.CertFile, cfg.KeyFile, "rotated server")
+	writeCert(t, cfg.ClientCAFile, "", "second CA")
+	waitForCheck()
+	cert, clientConfig = handshake()
+	if got := cert.Leaf.Subject.CommonName; got != "rotated server" {
+		t.Errorf("server certificate = %q, want rotated server", got)
+	}
+	if clientConfig.ClientCAs == firstPool {
+		t.Error("client CAs were not reloaded")
+	}
+}
@@ -0,0 +1,84 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+func TestSetup(t *testing.T) {
+	zero := 0.0
+	tests := []struct {
+		name         string
+		cfg          config.Tracing
+		wantProvider bool
+		wantSampled  bool
+	}{
+		{name: "disabled", cfg: config.Tracing{}},
+		{
+			name:         "http",
+			cfg:          config.Tracing{Enabled: true, Endpoint: "localhost:4318", Insecure: true},
+			wantProvider: true,
+			wantSampled:  true,
+		},
+		{
+			name:         "grpc",
+			cfg:          config.Tracing{Enabled: true, Protocol: config.TracingProtocolGRPC, Endpoint: "localhost:4317", Insecure: true},
+			wantProvider: true,
+			wantSampled:  true,
+		},
+		{
+			name:         "sample ratio 0",
+			cfg:          config.Tracing{Enabled: true, Endpoint: "localhost:4318", Insecure: true, SampleRatio: &zero},
+			wantProvider: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			otel.SetTracerProvider(noop.NewTracerProvider())
+			t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+			shutdown, err := Setup(context.Background(), tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() {
+				// Nothing is listening for the exported span
+				ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+				defer cancel()
+				shutdown(ctx)
+			}()
+
+			_, isSDK := otel.GetTracerProvider().(*sdktrace.TracerProvider)
+			if isSDK != tt.wantProvider {
+				t.Errorf("SDK tracer provider installed = %v, want %v", isSDK, tt.wantProvider)
+			}
+
+			_, span := Tracer().Start(context.Background(), "test")
+			defer span.End()
+			if got := span.SpanContext().IsSampled(); got != tt.wantSampled {
+				t.Errorf("span sampled = %v, want %v", got, tt.wantSampled)
+			}
+
+			// Incoming trace context is propagated whether or not tracing
+			// is enabled
+			header := http.Header{}
+			header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+			ctx := otel.GetTextMapPropagator().Extract(context.Background(), propagation.HeaderCarrier(header))
+			out := http.Header{}
+			otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(out))
+			if got := out.Get("traceparent"); got != header.Get("traceparent") {
+				t.Errorf("propagated traceparent = %q, want %q", got, header.Get("traceparent"))
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package upstream
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrBreakerOpen is returned for requests rejected by an open circuit
+// breaker, or while another request probes the upstream
+var ErrBreakerOpen = errors.New("circuit breaker open")
+
+// BreakerState is the state of a circuit breaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets all requests through
+	BreakerClosed BreakerState = iota
+	// BreakerHalfOpen lets a single request through to probe the upstream
+	BreakerHalfOpen
+	// BreakerOpen rejects all requests
+	BreakerOpen
+)
+
+// String returns the name of the state
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+// Breaker is a circuit breaker that opens after a number of consecutive
+// failures. A nil Breaker always lets requests through.
+type Breaker struct {
+	threshold    int
+	openDuration time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// NewBreaker creates a circuit breaker that opens after threshold
+// consecutive failures and probes the upstream again after openDuration
+func NewBreaker(threshold int, openDuration time.Duration) *Breaker {
+	return &Breaker{
+		threshold:    threshold,
+		openDuration: openDuration,
+	}
+}
+
+// Allow reports whether a request may be sent. Once the open duration has
+// passed, a single probing request is allowed.
+func (b *Breaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.currentState() {
+	case BreakerOpen:
+		return false
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+	}
+	return true
+}
+
+// State returns the current state of the breaker
+func (b *Breaker) State() BreakerState {
+	if b == nil {
+		return BreakerClosed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.currentState()
+}
+
+// currentState returns the state, treating an open breaker whose open
+// duration has passed as half-open
+func (b *Breaker) currentState() BreakerState {
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.openDuration {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// Success records a successful request, closing the breaker
+func (b *Breaker) Success() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.state = BreakerClosed
+	b.failures = 0
+	b.probing = false
+}
+
+// Failure records a failed request, opening the breaker once the threshold
+// is reached or if the probing request failed
+func (b *Breaker) Failure() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == BreakerHalfOpen || b.failures >= b.threshold {
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+	b.probing = false
+}
+
+// abort records a request whose outcome is unknown, e.g. because the client
+// went away, allowing another probing request
+func (b *Breaker) abort() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+// Transport returns a RoundTripper that rejects requests the breaker does
+// not allow with ErrBreakerOpen and records the outcome of the others.
+// Connection errors and 502, 503 and 504 responses are failures.
+func (b *Breaker) Transport(next http.RoundTripper) http.RoundTripper {
+	if b == nil {
+		return next
+	}
+	return &breakerTransport{next: next, breaker: b}
+}
+
+// breakerTransport records the outcome of requests in a breaker
+type breakerTransport struct {
+	next    http.RoundTripper
+	breaker *Breaker
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// The probe is only taken by requests that are actually sent
+	if !t.breaker.Allow() {
+		return nil, ErrBreakerOpen
+	}
+
+	resp, err := t.next.RoundTrip(req)
+
+	switch {
+	case err != nil && req.Context().Err() != nil:
+		t.breaker.abort()
+	case err != nil:
+		t.breaker.Failure()
+	case resp.StatusCode == http.StatusBadGateway,
+		resp.StatusCode == http.StatusServiceUnavailable,
+		resp.StatusCode == http.StatusGatewayTimeout:
+		t.breaker.Failure()
+	default:
+		t.breaker.Success()
+	}
+
+	return resp, err
+}
@@ -0,0 +1,114 @@
+package upstream
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	b := NewBreaker(2, 50*time.Millisecond)
+
+	b.Failure()
+	if !b.Allow() {
+		t.Fatal("breaker opened before reaching the failure threshold")
+	}
+
+	b.Failure()
+	if b.Allow() {
+		t.Fatal("breaker allowed a request after reaching the failure threshold")
+	}
+	if got := b.State(); got != BreakerOpen {
+		t.Fatalf("State() = %v, want %v", got, BreakerOpen)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if got := b.State(); got != BreakerHalfOpen {
+		t.Fatalf("State() = %v, want %v", got, BreakerHalfOpen)
+	}
+	if !b.Allow() {
+		t.Fatal("breaker did not allow a probing request")
+	}
+	if b.Allow() {
+		t.Fatal("breaker allowed a second probing request")
+	}
+
+	// A failed probe opens the breaker again
+	b.Failure()
+	if b.Allow() {
+		t.Fatal("breaker allowed a request after a failed probe")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !b.Allow() {
+		t.Fatal("breaker did not allow a probing request")
+	}
+	b.Success()
+	if got := b.State(); got != BreakerClosed {
+		t.Fatalf("State() = %v, want %v", got, BreakerClosed)
+	}
+	if !b.Allow() {
+		t.Fatal("closed breaker rejected a request")
+	}
+}
+
+func TestNilBreaker(t *testing.T) {
+	var b *Breaker
+	if !b.Allow() {
+		t.Error("nil breaker rejected a request")
+	}
+	if got := b.State(); got != BreakerClosed {
+		t.Errorf("State() = %v, want %v", got, BreakerClosed)
+	}
+}
+
+// roundTripFunc implements http.RoundTripper with a function
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestBreakerTransport(t *testing.T) {
+	b := NewBreaker(1, 50*time.Millisecond)
+	status := http.StatusServiceUnavailable
+	sent := 0
+	transport := b.Transport(roundTripFunc(func(*http.Request) (*http.Response, error) {
+		sent++
+		return &http.Response{StatusCode: status, Body: http.NoBody}, nil
+	}))
+	roundTrip := func() error {
+		req := httptest.NewRequest(http.MethodGet, "http://prometheus/api/v1/query", nil)
+		_, err := transport.RoundTrip(req)
+		return err
+	}
+
+	// A failure opens the breaker, which rejects requests without sending
+	// them
+	if err := roundTrip(); err != nil {
+		t.Fatal(err)
+	}
+	if err := roundTrip(); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("expected ErrBreakerOpen, got %v", err)
+	}
+	if sent != 1 {
+		t.Fatalf("sent %d requests, want 1", sent)
+	}
+
+	// Checking the state does not take the probe, the next request does
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if got := b.State(); got != BreakerHalfOpen {
+			t.Fatalf("State() = %v, want %v", got, BreakerHalfOpen)
+		}
+	}
+	status = http.StatusOK
+	if err := roundTrip(); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.State(); got != BreakerClosed || sent != 2 {
+		t.Errorf("State() = %v after %d requests, want %v after 2", got, sent, BreakerClosed)
+	}
+}
@@ -0,0 +1,150 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+// Checker periodically checks the health of an upstream. A nil Checker
+// always reports the upstream as healthy.
+type Checker struct {
+	name     string
+	url      string
+	client   *http.Client
+	interval time.Duration
+	logger   *slog.Logger
+
+	healthy  atomic.Bool
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// NewChecker creates a health checker for the upstream at target. The
+// upstream is considered healthy until the first check completes.
+func NewChecker(name string, target *url.URL, transport http.RoundTripper, cfg config.HealthCheck, logger *slog.Logger) *Checker {
+	checkURL := *target
+	checkURL.Path = singleJoiningSlash(target.Path, cfg.Path)
+	checkURL.RawPath = ""
+
+	c := &Checker{
+		name:     name,
+		url:      checkURL.String(),
+		client:   &http.Client{Transport: transport, Timeout: cfg.Timeout},
+		interval: cfg.Interval,
+		logger:   logger,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	c.healthy.Store(true)
+	return c
+}
+
+// Start runs the health checks in the background until Stop is called
+func (c *Checker) Start() {
+	if c == nil {
+		return
+	}
+
+	go func() {
+		defer close(c.done)
+
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for {
+			c.check()
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops the health checks
+func (c *Checker) Stop() {
+	if c == nil {
+		return
+	}
+	c.stopOnce.Do(func() { close(c.stop) })
+	<-c.done
+}
+
+// Healthy reports whether the last health check succeeded
+func (c *Checker) Healthy() bool {
+	if c == nil {
+		return true
+	}
+	return c.healthy.Load()
+}
+
+// check performs a single health check and logs state changes
+func (c *Checker) check() {
+	err := c.probe()
+	healthy := err == nil
+
+	if c.healthy.Swap(healthy) != healthy {
+		if healthy {
+			c.logger.Info("upstream is healthy", slog.String("upstream", c.name))
+		} else {
+			c.logger.Warn("upstream is unhealthy", slog.String("upstream", c.name), slog.Any("error", err))
+		}
+	}
+}
+
+// probe requests the health check URL, returning an error unless the
+// upstream responds with a 2xx status
+func (c *Checker) probe() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// singleJoiningSlash joins two URL paths with a single slash, like
+// httputil.NewSingleHostReverseProxy does
+func singleJoiningSlash(a, b string) string {
+	aslash := len(a) > 0 && a[len(a)-1] == '/'
+	bslash := len(b) > 0 && b[0] == '/'
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
@@ -0,0 +1,97 @@
+package upstream
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+func TestChecker(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	var path atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path.Store(r.URL.Path)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer server.Close()
+
+	target, _ := url.Parse(server.URL + "/prometheus/")
+	cfg := config.HealthCheck{Enabled: true, Path: "/-/ready", Interval: time.Hour, Timeout: time.Second}
+	c := NewChecker("primary", target, http.DefaultTransport, cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	if !c.Healthy() {
+		t.Fatal("upstream is unhealthy before the first check")
+	}
+
+	// A failed check marks the upstream down
+	status.Store(http.StatusServiceUnavailable)
+	c.check()
+	if c.Healthy() {
+		t.Error("upstream is healthy after a failed check")
+	}
+	if got := path.Load(); got != "/prometheus/-/ready" {
+		t.Errorf("health check path = %v, want /prometheus/-/ready", got)
+	}
+
+	// A successful check marks it up again
+	status.Store(http.StatusOK)
+	c.check()
+	if !c.Healthy() {
+		t.Error("upstream is unhealthy after a successful check")
+	}
+
+	// Unreachable upstreams are down
+	server.Close()
+	c.check()
+	if c.Healthy() {
+		t.Error("unreachable upstream is healthy")
+	}
+}
+
+func TestCheckerStart(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	target, _ := url.Parse(server.URL)
+	cfg := config.HealthCheck{Enabled: true, Path: "/-/ready", Interval: 10 * time.Millisecond, Timeout: time.Second}
+	c := NewChecker("primary", target, http.DefaultTransport, cfg, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	c.Start()
+	time.Sleep(55 * time.Millisecond)
+	c.Stop()
+
+	if c.Healthy() {
+		t.Error("upstream is healthy after failed checks")
+	}
+	n := requests.Load()
+	if n < 2 {
+		t.Errorf("upstream received %d health checks, want at least 2", n)
+	}
+
+	// No checks are sent once stopped
+	time.Sleep(30 * time.Millisecond)
+	if got := requests.Load(); got != n {
+		t.Errorf("upstream received %d health checks after Stop, want %d", got, n)
+	}
+}
+
+func TestNilChecker(t *testing.T) {
+	var c *Checker
+	c.Start()
+	c.Stop()
+	if !c.Healthy() {
+		t.Error("nil checker reported the upstream as unhealthy")
+	}
+}
@@ -0,0 +1,128 @@
+package upstream
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/fileutil"
+	"github.com/zwo-bot/prom-relabel-proxy/internal/tlsutil"
+)
+
+// NewTransport creates a RoundTripper for the upstream Prometheus that
+// applies the configured TLS settings, authentication and static headers
+func NewTransport(cfg config.Upstream) (http.RoundTripper, error) {
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	rt := &authTransport{
+		next:    transport,
+		headers: cfg.Headers,
+	}
+
+	if cfg.BasicAuth != nil {
+		rt.username = cfg.BasicAuth.Username
+		rt.password = cfg.BasicAuth.Password
+		if cfg.BasicAuth.PasswordFile != "" {
+			rt.passwordFile, err = fileutil.NewSecret(cfg.BasicAuth.PasswordFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	rt.bearerToken = cfg.BearerToken
+	if cfg.BearerTokenFile != "" {
+		rt.bearerTokenFile, err = fileutil.NewSecret(cfg.BearerTokenFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rt, nil
+}
+
+// newTLSConfig creates the client TLS configuration. The client certificate
+// is reloaded when its files change.
+func newTLSConfig(cfg config.UpstreamTLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		data, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read upstream CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in upstream CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" {
+		keyPair, err := tlsutil.NewKeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return keyPair.Certificate(), nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// authTransport adds credentials and static headers to upstream requests
+type authTransport struct {
+	next http.RoundTripper
+
+	username     string
+	password     string
+	passwordFile *fileutil.Secret
+
+	bearerToken     string
+	bearerTokenFile *fileutil.Secret
+
+	headers map[string]string
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if len(t.headers) == 0 && t.username == "" && t.bearerToken == "" && t.bearerTokenFile == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	// RoundTrippers must not modify the caller's request
+	req = req.Clone(req.Context())
+
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+
+	switch {
+	case t.username != "":
+		password := t.password
+		if t.passwordFile != nil {
+			password = t.passwordFile.Value()
+		}
+		req.SetBasicAuth(t.username, password)
+	case t.bearerTokenFile != nil:
+		req.Header.Set("Authorization", "Bearer "+t.bearerTokenFile.Value())
+	case t.bearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+t.bearerToken)
+	}
+
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,147 @@
+package upstream
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zwo-bot/prom-relabel-proxy/internal/config"
+)
+
+func TestTransport(t *testing.T) {
+	dir := t.TempDir()
+	passwordFile := filepath.Join(dir, "password")
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(passwordFile, []byte("file-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tokenFile, []byte("file-token\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		cfg         config.Upstream
+		wantAuth    string
+		wantHeaders map[string]string
+	}{
+		{name: "no credentials", cfg: config.Upstream{}, wantAuth: "client"},
+		{
+			name:     "basic auth",
+			cfg:      config.Upstream{BasicAuth: &config.BasicAuth{Username: "proxy", Password: "secret"}},
+			wantAuth: "Basic cHJveHk6c2VjcmV0",
+		},
+		{
+			name:     "basic auth password file",
+			cfg:      config.Upstream{BasicAuth: &config.BasicAuth{Username: "proxy", PasswordFile: passwordFile}},
+			wantAuth: "Basic cHJveHk6ZmlsZS1zZWNyZXQ=",
+		},
+		{
+			name:     "bearer token",
+			cfg:      config.Upstream{BearerToken: "token"},
+			wantAuth: "Bearer token",
+		},
+		{
+			name:     "bearer token file",
+			cfg:      config.Upstream{BearerTokenFile: tokenFile},
+			wantAuth: "Bearer file-token",
+		},
+		{
+			name:        "headers",
+			cfg:         config.Upstream{Headers: map[string]string{"X-Scope-OrgID": "tenant", "Authorization": "Bearer static"}},
+			wantAuth:    "Bearer static",
+			wantHeaders: map[string]string{"X-Scope-OrgID": "tenant"},
+		},
+		{
+			name:     "credentials override headers",
+			cfg:      config.Upstream{BearerToken: "token", Headers: map[string]string{"Authorization": "Bearer static"}},
+			wantAuth: "Bearer token",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got http.Header
+			upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Header.Clone()
+			}))
+			defer upstream.Close()
+
+			transport, err := NewTransport(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, upstream.URL+"/api/v1/query", nil)
+			req.RequestURI = ""
+			req.Header.Set("Authorization", "client")
+			resp, err := transport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if auth := got.Get("Authorization"); auth != tt.wantAuth {
+				t.Errorf("upstream Authorization = %q, want %q", auth, tt.wantAuth)
+			}
+			for name, want := range tt.wantHeaders {
+				if value := got.Get(name); value != want {
+					t.Errorf("upstream %s = %q, want %q", name, value, want)
+				}
+			}
+
+			// The credentials are added to a copy, so they do not show up in
+			// the client's request, e.g. in logs or error responses
+			if auth := req.Header.Get("Authorization"); auth != "client" {
+				t.Errorf("client Authorization = %q, want client", auth)
+			}
+			if auth := resp.Header.Get("Authorization"); auth != "" {
+				t.Errorf("response Authorization = %q, want none", auth)
+			}
+		})
+	}
+}
+
+func TestTransportSecretRotation(t *testing.T) {
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("first"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var auth string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer upstream.Close()
+
+	transport, err := NewTransport(config.Upstream{BearerTokenFile: tokenFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip := func() string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, upstream.URL, nil)
+		resp, err := transport.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return auth
+	}
+
+	if got := roundTrip(); got != "Bearer first" {
+		t.Fatalf("Authorization = %q, want Bearer first", got)
+	}
+
+	// The rotated token is used once the file is checked again
+	if err := os.WriteFile(tokenFile, []byte("rotated\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if got := roundTrip(); got != "Bearer rotated" {
+		t.Errorf("Authorization = %q, want Bearer rotated", got)
+	}
+}